@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Algorithm presets a connection can select. Explicit per-connection lists
+// take precedence over the preset's list for the same category.
+const (
+	algorithmPresetDefault = ""
+	algorithmPresetModern  = "modern"
+	algorithmPresetLegacy  = "legacy"
+)
+
+var modernAlgorithms = ssh.Algorithms{
+	KeyExchanges: []string{
+		ssh.KeyExchangeMLKEM768X25519,
+		ssh.KeyExchangeCurve25519,
+		ssh.KeyExchangeECDHP256,
+		ssh.KeyExchangeECDHP384,
+		ssh.KeyExchangeECDHP521,
+		ssh.KeyExchangeDH16SHA512,
+	},
+	Ciphers: []string{
+		ssh.CipherChaCha20Poly1305,
+		ssh.CipherAES256GCM,
+		ssh.CipherAES128GCM,
+		ssh.CipherAES256CTR,
+		ssh.CipherAES128CTR,
+	},
+	MACs: []string{
+		ssh.HMACSHA256ETM,
+		ssh.HMACSHA512ETM,
+	},
+	HostKeys: []string{
+		ssh.KeyAlgoED25519,
+		ssh.KeyAlgoECDSA256,
+		ssh.KeyAlgoECDSA384,
+		ssh.KeyAlgoECDSA521,
+		ssh.KeyAlgoRSASHA512,
+		ssh.KeyAlgoRSASHA256,
+	},
+}
+
+// legacyAlgorithms offers everything x/crypto/ssh implements. The secure
+// algorithms come first so that modern servers still negotiate them.
+func legacyAlgorithms() ssh.Algorithms {
+	supported := ssh.SupportedAlgorithms()
+	insecure := ssh.InsecureAlgorithms()
+	return ssh.Algorithms{
+		KeyExchanges: append(supported.KeyExchanges, insecure.KeyExchanges...),
+		Ciphers:      append(supported.Ciphers, insecure.Ciphers...),
+		MACs:         append(supported.MACs, insecure.MACs...),
+		HostKeys:     append(supported.HostKeys, insecure.HostKeys...),
+	}
+}
+
+func presetAlgorithms(preset string) (ssh.Algorithms, error) {
+	switch preset {
+	case algorithmPresetDefault:
+		return ssh.Algorithms{}, nil
+	case algorithmPresetModern:
+		return modernAlgorithms, nil
+	case algorithmPresetLegacy:
+		return legacyAlgorithms(), nil
+	}
+	return ssh.Algorithms{}, fmt.Errorf("unknown algorithm preset %q", preset)
+}
+
+// validateAlgorithms rejects names x/crypto/ssh would otherwise silently
+// ignore, so typos are caught when the connection is saved.
+func validateAlgorithms(conn *SSHConnection) error {
+	if _, err := presetAlgorithms(conn.AlgorithmPreset); err != nil {
+		return err
+	}
+	known := legacyAlgorithms()
+	checks := []struct {
+		kind  string
+		names []string
+		known []string
+	}{
+		{"key exchange", conn.KeyExchanges, known.KeyExchanges},
+		{"cipher", conn.Ciphers, known.Ciphers},
+		{"MAC", conn.MACs, known.MACs},
+		{"host key algorithm", conn.HostKeyAlgorithms, known.HostKeys},
+	}
+	for _, check := range checks {
+		for _, name := range check.names {
+			if !slices.Contains(check.known, name) {
+				return fmt.Errorf("unsupported %s %q", check.kind, name)
+			}
+		}
+	}
+	return nil
+}
+
+// applyAlgorithms sets the connection's algorithm overrides on config. An
+// empty list leaves the x/crypto/ssh default for that category.
+func applyAlgorithms(config *ssh.ClientConfig, conn *SSHConnection) {
+	preset, err := presetAlgorithms(conn.AlgorithmPreset)
+	if err != nil {
+		preset = ssh.Algorithms{}
+	}
+	config.KeyExchanges = firstNonEmpty(conn.KeyExchanges, preset.KeyExchanges)
+	config.Ciphers = firstNonEmpty(conn.Ciphers, preset.Ciphers)
+	config.MACs = firstNonEmpty(conn.MACs, preset.MACs)
+	config.HostKeyAlgorithms = firstNonEmpty(conn.HostKeyAlgorithms, preset.HostKeys)
+}
+
+func firstNonEmpty(lists ...[]string) []string {
+	for _, list := range lists {
+		if len(list) > 0 {
+			return list
+		}
+	}
+	return nil
+}
+
+// negotiatedAlgorithms reports what the client and server agreed on during
+// the handshake, or nil if the connection does not expose it.
+func negotiatedAlgorithms(client *ssh.Client) map[string]string {
+	meta, ok := client.Conn.(ssh.AlgorithmsConnMetadata)
+	if !ok {
+		return nil
+	}
+	algs := meta.Algorithms()
+	return map[string]string{
+		"key_exchange":            algs.KeyExchange,
+		"host_key":                algs.HostKey,
+		"cipher_client_to_server": algs.Write.Cipher,
+		"cipher_server_to_client": algs.Read.Cipher,
+		"mac_client_to_server":    algs.Write.MAC,
+		"mac_server_to_client":    algs.Read.MAC,
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// Directory download formats.
+const (
+	archiveZip   = "zip"
+	archiveTarGz = "tar.gz"
+)
+
+// archiveErrorsName is added to an archive listing the entries that could
+// not be read, since the HTTP status is long sent by the time they fail.
+const archiveErrorsName = "WEBSSH-ERRORS.txt"
+
+// archiveFilter selects the entries of a directory archive. Patterns are
+// globs matched against both the path relative to the archived directory
+// and the base name, so "*.log" and "logs/*.log" both work.
+type archiveFilter struct {
+	Include []string
+	Exclude []string
+}
+
+func matchAny(patterns []string, rel string) bool {
+	base := path.Base(rel)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, rel); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, base); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (f archiveFilter) validate() error {
+	for _, pattern := range append(f.Include, f.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+// archiveWriter is the part of zip and tar writing that differs.
+type archiveWriter interface {
+	dir(name string, info os.FileInfo) error
+	symlink(name, target string, info os.FileInfo) error
+	file(name string, info os.FileInfo, r io.Reader) error
+	Close() error
+}
+
+func newArchiveWriter(w io.Writer, format string) (archiveWriter, error) {
+	switch format {
+	case "", archiveZip:
+		return &zipArchive{zw: zip.NewWriter(w)}, nil
+	case archiveTarGz:
+		gz := gzip.NewWriter(w)
+		return &tarArchive{gz: gz, tw: tar.NewWriter(gz)}, nil
+	}
+	return nil, fmt.Errorf("unknown archive format %q", format)
+}
+
+// writeDirectoryArchive streams dir into an archive as it is read, so large
+// directories are never held in memory. Entries that cannot be read are
+// skipped and listed in archiveErrorsName at the end of the archive.
+func writeDirectoryArchive(aw archiveWriter, c *sftp.Client, dir string, filter archiveFilter) ([]string, error) {
+	var failures []string
+	fail := func(rel string, err error) {
+		failures = append(failures, fmt.Sprintf("%s: %v", rel, err))
+	}
+
+	// Entries are stored under the directory's own name.
+	root := path.Base(dir)
+	if root == "/" || root == "." {
+		root = "root"
+	}
+	walker := c.Walk(dir)
+	for walker.Step() {
+		p := walker.Path()
+		rel := strings.TrimPrefix(strings.TrimPrefix(p, dir), "/")
+		if err := walker.Err(); err != nil {
+			fail(path.Join(root, rel), err)
+			continue
+		}
+		info := walker.Stat()
+		name := path.Join(root, rel)
+
+		if rel != "" && matchAny(filter.Exclude, rel) {
+			if info.IsDir() {
+				walker.SkipDir()
+			}
+			continue
+		}
+
+		var err error
+		switch {
+		case info.IsDir():
+			err = aw.dir(name, info)
+		case len(filter.Include) > 0 && !matchAny(filter.Include, rel):
+			// Includes pick files; directories are always kept so that
+			// matches inside them are found.
+			continue
+		case info.Mode()&os.ModeSymlink != 0:
+			var target string
+			if target, err = c.ReadLink(p); err == nil {
+				err = aw.symlink(name, target, info)
+			}
+		case !info.Mode().IsRegular():
+			continue
+		default:
+			err = addArchiveFile(aw, c, p, name, info)
+		}
+		if err != nil {
+			if errors.As(err, new(archiveWriteError)) {
+				return failures, err
+			}
+			fail(name, err)
+		}
+	}
+
+	return failures, finishArchive(aw, root, failures)
+}
+
+// finishArchive lists failures in archiveErrorsName, if there were any,
+// and closes the archive.
+func finishArchive(aw archiveWriter, root string, failures []string) error {
+	if len(failures) > 0 {
+		report := strings.Join(failures, "\n") + "\n"
+		info := &archiveTextInfo{name: archiveErrorsName, size: int64(len(report)), modTime: time.Now()}
+		if err := aw.file(path.Join(root, archiveErrorsName), info, strings.NewReader(report)); err != nil {
+			return err
+		}
+	}
+	return aw.Close()
+}
+
+// writeSCPArchive is writeDirectoryArchive for a directory sent by scp in
+// source mode, starting after its first record. scp follows symlinks, so
+// they are stored as what they point to.
+func writeSCPArchive(aw archiveWriter, d *scpDownload, first *scpEntry, filter archiveFilter) ([]string, error) {
+	var failures []string
+	root := first.name
+	if root == "/" || root == "." {
+		root = "root"
+	}
+	if err := aw.dir(root, first.info()); err != nil {
+		return failures, err
+	}
+
+	// dirs is the path below root of the directory being received, and
+	// skipped how many of its innermost directories are excluded.
+	var dirs []string
+	skipped := 0
+	for {
+		entry, err := d.next()
+		if err == io.EOF {
+			break
+		}
+		var scpErr *scpError
+		if errors.As(err, &scpErr) && scpErr.warning {
+			failures = append(failures, scpErr.Error())
+			continue
+		}
+		if err != nil {
+			return failures, err
+		}
+		if entry.end {
+			if len(dirs) == 0 {
+				break
+			}
+			dirs = dirs[:len(dirs)-1]
+			if skipped > 0 {
+				skipped--
+			}
+			continue
+		}
+
+		rel := path.Join(append(dirs, entry.name)...)
+		name := path.Join(root, rel)
+		if entry.isDir {
+			dirs = append(dirs, entry.name)
+			if skipped > 0 || matchAny(filter.Exclude, rel) {
+				skipped++
+				continue
+			}
+			err = aw.dir(name, entry.info())
+		} else {
+			if skipped > 0 || matchAny(filter.Exclude, rel) ||
+				len(filter.Include) > 0 && !matchAny(filter.Include, rel) {
+				// next skips the file's data.
+				continue
+			}
+			if err = aw.file(name, entry.info(), d.file()); err == nil {
+				err = d.endFile()
+			}
+		}
+		if err != nil {
+			if errors.As(err, new(archiveWriteError)) {
+				return failures, err
+			}
+			var scpErr *scpError
+			if !errors.As(err, &scpErr) || !scpErr.warning {
+				return failures, err
+			}
+			failures = append(failures, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	return failures, finishArchive(aw, root, failures)
+}
+
+func addArchiveFile(aw archiveWriter, c *sftp.Client, p, name string, info os.FileInfo) error {
+	f, err := c.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return aw.file(name, info, f)
+}
+
+// archiveWriteError marks failures writing the archive itself, usually
+// because the browser went away; unlike read errors they end the download.
+type archiveWriteError struct{ error }
+
+// entryWriter tags errors from the archive's writer so they can be told
+// apart from errors reading the remote file during a copy.
+type entryWriter struct{ w io.Writer }
+
+func (e entryWriter) Write(p []byte) (int, error) {
+	n, err := e.w.Write(p)
+	if err != nil {
+		err = archiveWriteError{err}
+	}
+	return n, err
+}
+
+// archiveTextInfo describes the generated errors file.
+type archiveTextInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (i *archiveTextInfo) Name() string       { return i.name }
+func (i *archiveTextInfo) Size() int64        { return i.size }
+func (i *archiveTextInfo) Mode() os.FileMode  { return 0644 }
+func (i *archiveTextInfo) ModTime() time.Time { return i.modTime }
+func (i *archiveTextInfo) IsDir() bool        { return false }
+func (i *archiveTextInfo) Sys() interface{}   { return nil }
+
+type zipArchive struct {
+	zw *zip.Writer
+}
+
+func (a *zipArchive) header(name string, info os.FileInfo) (io.Writer, error) {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return nil, err
+	}
+	header.Name = name
+	if info.IsDir() {
+		header.Name += "/"
+	} else if info.Mode().IsRegular() {
+		header.Method = zip.Deflate
+	}
+	w, err := a.zw.CreateHeader(header)
+	if err != nil {
+		return nil, archiveWriteError{err}
+	}
+	return w, nil
+}
+
+func (a *zipArchive) dir(name string, info os.FileInfo) error {
+	_, err := a.header(name, info)
+	return err
+}
+
+// symlink stores the link target as the entry's content, as Info-ZIP does.
+func (a *zipArchive) symlink(name, target string, info os.FileInfo) error {
+	w, err := a.header(name, info)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, target); err != nil {
+		return archiveWriteError{err}
+	}
+	return nil
+}
+
+func (a *zipArchive) file(name string, info os.FileInfo, r io.Reader) error {
+	w, err := a.header(name, info)
+	if err != nil {
+		return err
+	}
+	// The entry has already been started, so a read error leaves it
+	// truncated; it is still reported in the errors file.
+	_, err = io.Copy(entryWriter{w}, r)
+	return err
+}
+
+func (a *zipArchive) Close() error {
+	return a.zw.Close()
+}
+
+type tarArchive struct {
+	gz *gzip.Writer
+	tw *tar.Writer
+}
+
+func (a *tarArchive) header(name, link string, info os.FileInfo) (*tar.Header, error) {
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return nil, err
+	}
+	header.Name = name
+	if info.IsDir() {
+		header.Name += "/"
+	}
+	if stat, ok := info.Sys().(*sftp.FileStat); ok {
+		header.Uid = int(stat.UID)
+		header.Gid = int(stat.GID)
+	}
+	return header, nil
+}
+
+func (a *tarArchive) write(header *tar.Header) error {
+	if err := a.tw.WriteHeader(header); err != nil {
+		return archiveWriteError{err}
+	}
+	return nil
+}
+
+func (a *tarArchive) dir(name string, info os.FileInfo) error {
+	header, err := a.header(name, "", info)
+	if err != nil {
+		return err
+	}
+	return a.write(header)
+}
+
+func (a *tarArchive) symlink(name, target string, info os.FileInfo) error {
+	header, err := a.header(name, target, info)
+	if err != nil {
+		return err
+	}
+	return a.write(header)
+}
+
+func (a *tarArchive) file(name string, info os.FileInfo, r io.Reader) error {
+	header, err := a.header(name, "", info)
+	if err != nil {
+		return err
+	}
+	if err := a.write(header); err != nil {
+		return err
+	}
+	// The size is fixed in the header, so a file that shrinks while it is
+	// read is padded with zeros and one that grows is cut off.
+	n, err := io.CopyN(entryWriter{a.tw}, r, header.Size)
+	if errors.As(err, new(archiveWriteError)) {
+		return err
+	}
+	if n < header.Size {
+		if _, padErr := io.CopyN(a.tw, zeroReader{}, header.Size-n); padErr != nil {
+			return archiveWriteError{padErr}
+		}
+		if err == nil || err == io.EOF {
+			err = fmt.Errorf("file shrank while reading (%d of %d bytes)", n, header.Size)
+		}
+		return err
+	}
+	return nil
+}
+
+func (a *tarArchive) Close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	return a.gz.Close()
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// maxArchiveOps is how many archives one WebSocket may have queued or
+	// being created or extracted at once.
+	maxArchiveOps = 4
+	// archiveProgressInterval is how often progress is reported.
+	archiveProgressInterval = 500 * time.Millisecond
+	// maxArchiveStderr is how much of a failed command's error output is
+	// kept for the message sent to the browser.
+	maxArchiveStderr = 4 << 10
+)
+
+// Archive operations, reported as "op" in "archive" messages.
+const (
+	archiveCompress = "compress"
+	archiveExtract  = "extract"
+)
+
+// Ways an archive was created or extracted.
+const (
+	archiveByExec = "exec"
+	archiveBySFTP = "sftp"
+)
+
+// errNoArchiveTool means the remote host cannot run the command, so the
+// archive is handled over SFTP instead.
+var errNoArchiveTool = errors.New("archive tool not available")
+
+// errArchiveExists refuses to replace an archive unless forced. It is
+// reported with the code "exists" so the browser can ask first.
+var errArchiveExists = errors.New("archive already exists")
+
+// archiveOp is a compress or extract running on behalf of one WebSocket. It
+// sends "archive" messages: one when it starts, progress at most every
+// archiveProgressInterval, and a final one with done set.
+type archiveOp struct {
+	ws      *wsConn
+	ctx     context.Context
+	account transferAccount
+	id      string
+	op      string
+	method  string
+	path    string
+	target  string
+
+	mutex    sync.Mutex
+	files    int
+	current  string
+	lastSent time.Time
+}
+
+// handleArchive compresses or extracts on the remote host. For "compress",
+// msg.Path is the file or directory to archive and msg.Target the archive
+// to create, whose extension picks the format (.zip, .tar.gz or .tgz); an
+// existing archive is only replaced with msg.Force. For "extract", msg.Path
+// is a .zip, .tar, .tar.gz or .tgz archive and msg.Target the directory to
+// unpack into, by default the archive's own; msg.OnConflict is the policy
+// for files that already exist.
+//
+// tar, zip and unzip are run on the host when it has them, so the data never
+// passes through this server. Otherwise the archive is streamed over SFTP.
+// Extraction into a jail, or with a policy other than overwrite, always uses
+// SFTP, which checks every entry; what SFTP moves counts towards account's
+// limits.
+//
+// It runs as a queued job; cancelling ctx stops it.
+func handleArchive(ctx context.Context, ws *wsConn, sshClient *ssh.Client, jail *pathJail, account transferAccount, msg wsMessage) error {
+	a := &archiveOp{ws: ws, ctx: ctx, account: account, id: msg.ID, op: msg.Type, path: msg.Path, target: msg.Target}
+	done := map[string]interface{}{"id": msg.ID, "op": msg.Type, "path": msg.Path, "target": msg.Target, "done": true}
+
+	if msg.ID == "" || msg.Path == "" {
+		err := errors.New("id and path are required")
+		done["error"] = err.Error()
+		sendJSON(ws, "archive", done)
+		return err
+	}
+
+	var summary *extractSummary
+	var failures []string
+	sftpClient, err := sshPool.SFTP(sshClient)
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err == nil {
+		if msg.Type == archiveCompress {
+			failures, err = a.compress(sshClient, sftpClient, jail, msg.Force)
+		} else {
+			summary, err = a.extract(sshClient, sftpClient, jail, msg.OnConflict)
+		}
+	}
+
+	done["ok"] = err == nil
+	done["path"] = a.path
+	done["target"] = a.target
+	done["files"] = a.files
+	if a.method != "" {
+		done["method"] = a.method
+	}
+	if summary != nil {
+		done["summary"] = summary
+	}
+	if len(failures) > 0 {
+		done["errors"] = failures
+	}
+	switch {
+	case ctx.Err() != nil:
+		done["stopped"] = true
+	case err != nil:
+		done["error"] = err.Error()
+		if errors.Is(err, errArchiveExists) {
+			done["code"] = "exists"
+		}
+	}
+	sendJSON(ws, "archive", done)
+	return err
+}
+
+// refuseArchive tells the browser an archive request was not started.
+func refuseArchive(ws *wsConn, msg wsMessage, reason string) {
+	sendJSON(ws, "archive", map[string]interface{}{
+		"id": msg.ID, "op": msg.Type, "path": msg.Path, "target": msg.Target, "done": true, "error": reason,
+	})
+}
+
+// compress creates a.target from a.path. A half-written archive is removed
+// when it fails. Entries that could not be read over SFTP are returned, and
+// listed in the archive as well.
+func (a *archiveOp) compress(sshClient *ssh.Client, c *sftp.Client, jail *pathJail, force bool) ([]string, error) {
+	format, err := compressFormat(a.target)
+	if err != nil {
+		return nil, err
+	}
+	if a.path, err = jail.ResolveEntry(c, "compress", a.path); err != nil {
+		return nil, err
+	}
+	if a.target == "" {
+		return nil, errors.New("target is required")
+	}
+	if a.target, err = jail.Resolve(c, "compress", a.target); err != nil {
+		return nil, err
+	}
+	if a.target == a.path || strings.HasPrefix(a.target, strings.TrimSuffix(a.path, "/")+"/") {
+		return nil, errors.New("the archive cannot be created inside what it archives")
+	}
+	if _, err := c.Lstat(a.path); err != nil {
+		return nil, err
+	}
+	if _, err := c.Lstat(a.target); err == nil {
+		if !force {
+			return nil, fmt.Errorf("%s: %w", a.target, errArchiveExists)
+		}
+		// zip adds to an existing archive rather than replacing it.
+		if err := c.Remove(a.target); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	var failures []string
+	err = a.compressExec(sshClient, format)
+	if errors.Is(err, errNoArchiveTool) {
+		failures, err = a.compressSFTP(c, format)
+	}
+	if err != nil {
+		c.Remove(a.target)
+	}
+	return failures, err
+}
+
+// compressFormat picks the archive format from the name of the archive.
+func compressFormat(name string) (string, error) {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return archiveZip, nil
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return archiveTarGz, nil
+	}
+	return "", errors.New("archive name must end in .zip, .tar.gz or .tgz")
+}
+
+func (a *archiveOp) compressExec(sshClient *ssh.Client, format string) error {
+	parent, name := path.Split(a.path)
+	if parent == "" {
+		parent = "/"
+	}
+	if format == archiveZip {
+		// -y stores symlinks rather than what they point to, as tar does.
+		if strings.HasPrefix(name, "-") {
+			name = "./" + name
+		}
+		cmd := "cd " + shellQuote(parent) + " && zip -r -y " + shellQuote(a.target) + " " + shellQuote(name)
+		return a.exec(sshClient, "zip", cmd, zipOutputName)
+	}
+	cmd := "tar -czvf " + shellQuote(a.target) + " -C " + shellQuote(parent) + " -- " + shellQuote(name)
+	return a.exec(sshClient, "tar", cmd, tarOutputName)
+}
+
+func (a *archiveOp) compressSFTP(c *sftp.Client, format string) ([]string, error) {
+	a.start(archiveBySFTP)
+	f, err := c.OpenFile(a.target, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return nil, err
+	}
+	meter := newStreamMeter(a.ctx, a.account)
+	defer meter.close()
+	// Checking for cancellation on each write, not just each entry,
+	// stops a large file part way.
+	aw, err := newArchiveWriter(meter.writer(&cancelWriter{w: f, ctx: a.ctx}), format)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	failures, err := writeDirectoryArchive(&progressArchive{aw, a, meter}, c, a.path, archiveFilter{})
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	var archiveErr archiveWriteError
+	if errors.As(err, &archiveErr) {
+		err = archiveErr.error
+	}
+	return failures, err
+}
+
+// extract unpacks a.path into a.target.
+func (a *archiveOp) extract(sshClient *ssh.Client, c *sftp.Client, jail *pathJail, policy string) (*extractSummary, error) {
+	if !validConflictPolicy(policy) {
+		return nil, fmt.Errorf("invalid conflict policy %q", policy)
+	}
+	if policy == "" {
+		policy = conflictOverwrite
+	}
+	if !isArchiveName(a.path) {
+		return nil, errors.New("only .zip, .tar, .tar.gz and .tgz files can be extracted")
+	}
+	var err error
+	if a.path, err = jail.Resolve(c, "extract", a.path); err != nil {
+		return nil, err
+	}
+	info, err := c.Stat(a.path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", a.path)
+	}
+	if a.target == "" {
+		a.target = path.Dir(a.path)
+	}
+	if a.target, err = jail.Resolve(c, "extract", a.target); err != nil {
+		return nil, err
+	}
+	if err := c.MkdirAll(a.target); err != nil {
+		return nil, err
+	}
+
+	// tar and unzip would follow symlinks out of a jail, and only know how
+	// to overwrite or skip silently, so the summary would be empty.
+	if jail == nil && policy == conflictOverwrite {
+		err := a.extractExec(sshClient)
+		if !errors.Is(err, errNoArchiveTool) {
+			return nil, err
+		}
+	}
+	a.start(archiveBySFTP)
+	meter := newStreamMeter(a.ctx, a.account)
+	defer meter.close()
+	return extractRemoteArchive(c, jail, a.path, a.path, a.target, policy, a.progress, meter)
+}
+
+func (a *archiveOp) extractExec(sshClient *ssh.Client) error {
+	lower := strings.ToLower(a.path)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		cmd := "unzip -o " + shellQuote(a.path) + " -d " + shellQuote(a.target)
+		return a.exec(sshClient, "unzip", cmd, unzipOutputName)
+	case strings.HasSuffix(lower, ".tar"):
+		cmd := "tar -xvf " + shellQuote(a.path) + " -C " + shellQuote(a.target)
+		return a.exec(sshClient, "tar", cmd, tarOutputName)
+	}
+	cmd := "tar -xzvf " + shellQuote(a.path) + " -C " + shellQuote(a.target)
+	return a.exec(sshClient, "tar", cmd, tarOutputName)
+}
+
+// exec runs cmd on the remote host, counting the entries it lists as
+// progress. It returns errNoArchiveTool when tool is not installed or
+// commands cannot be run at all, as on SFTP-only accounts.
+func (a *archiveOp) exec(sshClient *ssh.Client, tool, cmd string, parse func(line string) (string, bool)) error {
+	if !remoteCommandExists(sshClient, tool) {
+		return errNoArchiveTool
+	}
+	session, err := sshClient.NewSession()
+	if err != nil {
+		return errNoArchiveTool
+	}
+	defer session.Close()
+	go func() {
+		<-a.ctx.Done()
+		// Closing the session alone leaves the command running on
+		// servers that do not hang up on it.
+		session.Signal(ssh.SIGTERM)
+		session.Close()
+	}()
+
+	a.start(archiveByExec)
+	stderr := &limitedTail{max: maxArchiveStderr}
+	session.Stdout = &lineWriter{line: func(line string) {
+		if name, ok := parse(line); ok {
+			a.progress(name)
+		}
+	}}
+	session.Stderr = stderr
+	err = session.Run(cmd)
+	if a.ctx.Err() != nil {
+		return a.ctx.Err()
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%s failed: %s", tool, msg)
+		}
+		return fmt.Errorf("%s failed: %v", tool, err)
+	}
+	return nil
+}
+
+// remoteCommandExists asks the remote shell whether it can run name. Hosts
+// that force a command, such as internal-sftp, print nothing.
+func remoteCommandExists(client *ssh.Client, name string) bool {
+	session, err := client.NewSession()
+	if err != nil {
+		return false
+	}
+	defer session.Close()
+	out, err := session.Output("command -v " + shellQuote(name))
+	return err == nil && strings.Contains(string(out), name)
+}
+
+// Parsers for the entries listed by each tool.
+
+func tarOutputName(line string) (string, bool) {
+	return line, line != ""
+}
+
+// zipOutputName reads "  adding: dir/file (deflated 60%)".
+func zipOutputName(line string) (string, bool) {
+	name, ok := strings.CutPrefix(strings.TrimSpace(line), "adding: ")
+	if !ok {
+		return "", false
+	}
+	if i := strings.LastIndex(name, " ("); i > 0 {
+		name = name[:i]
+	}
+	return name, true
+}
+
+// unzipOutputName reads "  inflating: /dest/file" and similar lines.
+func unzipOutputName(line string) (string, bool) {
+	verb, name, ok := strings.Cut(strings.TrimSpace(line), ": ")
+	switch verb {
+	case "inflating", "extracting", "creating", "linking":
+		return strings.TrimSpace(name), ok
+	}
+	return "", false
+}
+
+func (a *archiveOp) start(method string) {
+	a.method = method
+	sendJSON(a.ws, "archive", map[string]interface{}{
+		"id": a.id, "op": a.op, "path": a.path, "target": a.target, "method": method, "started": true,
+	})
+}
+
+// progress counts an entry and reports it if the last report is old enough.
+// It fails once the operation is cancelled, which stops SFTP streaming.
+func (a *archiveOp) progress(name string) error {
+	if err := a.ctx.Err(); err != nil {
+		return err
+	}
+	a.mutex.Lock()
+	a.files++
+	a.current = name
+	if time.Since(a.lastSent) < archiveProgressInterval {
+		a.mutex.Unlock()
+		return nil
+	}
+	a.lastSent = time.Now()
+	update := map[string]interface{}{"id": a.id, "op": a.op, "files": a.files, "current": a.current}
+	a.mutex.Unlock()
+	sendJSON(a.ws, "archive", update)
+	return nil
+}
+
+// progressArchive reports each entry written to an archive over SFTP and
+// meters the files read into it.
+type progressArchive struct {
+	archiveWriter
+	op    *archiveOp
+	meter *streamMeter
+}
+
+func (p *progressArchive) report(name string) error {
+	if err := p.op.progress(name); err != nil {
+		return archiveWriteError{err}
+	}
+	return nil
+}
+
+func (p *progressArchive) dir(name string, info os.FileInfo) error {
+	if err := p.report(name); err != nil {
+		return err
+	}
+	return p.archiveWriter.dir(name, info)
+}
+
+func (p *progressArchive) symlink(name, target string, info os.FileInfo) error {
+	if err := p.report(name); err != nil {
+		return err
+	}
+	return p.archiveWriter.symlink(name, target, info)
+}
+
+func (p *progressArchive) file(name string, info os.FileInfo, r io.Reader) error {
+	if err := p.report(name); err != nil {
+		return err
+	}
+	err := p.archiveWriter.file(name, info, p.meter.reader(r))
+	if limitError(err) && !errors.As(err, new(archiveWriteError)) {
+		// Running out of quota ends the archive, not just this file.
+		err = archiveWriteError{err}
+	}
+	return err
+}
+
+// cancelWriter fails once ctx is done.
+type cancelWriter struct {
+	w   io.Writer
+	ctx context.Context
+}
+
+func (w *cancelWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
+
+// lineWriter calls line for each line written to it.
+type lineWriter struct {
+	line    func(string)
+	partial []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	data := append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		w.line(string(bytes.TrimSuffix(data[:i], []byte("\r"))))
+		data = data[i+1:]
+	}
+	if len(data) > maxTailLineLength {
+		data = nil
+	}
+	w.partial = append(w.partial[:0], data...)
+	return len(p), nil
+}
+
+// limitedTail keeps the last max bytes written to it.
+type limitedTail struct {
+	max int
+	buf []byte
+}
+
+func (t *limitedTail) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.max {
+		t.buf = t.buf[len(t.buf)-t.max:]
+	}
+	return len(p), nil
+}
+
+func (t *limitedTail) String() string {
+	return string(t.buf)
+}
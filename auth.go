@@ -3,11 +3,17 @@ package main
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
+	"net"
 	"net/http"
+	"sync"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
+var errTooManyAttempts = errors.New("too many failed attempts, try again later")
+
 func authMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if noAuth {
@@ -78,3 +84,69 @@ func verifyPassword(password, hash string) bool {
 	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
 	return err == nil
 }
+
+// loginThrottle limits guessing: once max attempts for a key, such as a
+// username or client address, failed within window, further attempts are
+// refused until the window ends. An attempt counts as soon as it starts, so
+// that many sent at once cannot all get through before the first fails.
+type loginThrottle struct {
+	max      int
+	window   time.Duration
+	mutex    sync.Mutex
+	attempts map[string]*loginAttempts
+}
+
+type loginAttempts struct {
+	count int
+	reset time.Time
+}
+
+func newLoginThrottle(max int, window time.Duration) *loginThrottle {
+	return &loginThrottle{max: max, window: window, attempts: make(map[string]*loginAttempts)}
+}
+
+// attempt records an attempt for each key, or returns errTooManyAttempts
+// without recording anything if one of them has used up its attempts.
+func (t *loginThrottle) attempt(keys ...string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := time.Now()
+	for k, a := range t.attempts {
+		if now.After(a.reset) {
+			delete(t.attempts, k)
+		}
+	}
+	for _, key := range keys {
+		if a := t.attempts[key]; a != nil && a.count >= t.max {
+			return errTooManyAttempts
+		}
+	}
+	for _, key := range keys {
+		a := t.attempts[key]
+		if a == nil {
+			a = &loginAttempts{reset: now.Add(t.window)}
+			t.attempts[key] = a
+		}
+		a.count++
+	}
+	return nil
+}
+
+// succeeded forgets the attempts of keys, after they turned out to be
+// genuine.
+func (t *loginThrottle) succeeded(keys ...string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, key := range keys {
+		delete(t.attempts, key)
+	}
+}
+
+// clientAddress is the IP address r came from, for throttling.
+func clientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
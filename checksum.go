@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// checksumExecTimeout bounds how long sha256sum may run on the remote host
+// before the checksum falls back to reading the file over SFTP.
+const checksumExecTimeout = 10 * time.Minute
+
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// Ways a remote checksum was computed.
+const (
+	checksumByExec = "exec"
+	checksumBySFTP = "sftp"
+)
+
+// parseExpectedChecksum checks a SHA-256 supplied by the user. Tools print
+// hashes in either case, so it is lowered; an empty value means nothing is
+// to be verified.
+func parseExpectedChecksum(s string) (string, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return "", nil
+	}
+	if len(s) != sha256.Size*2 {
+		return "", fmt.Errorf("expected checksum must be %d hexadecimal characters", sha256.Size*2)
+	}
+	if _, err := hex.DecodeString(s); err != nil {
+		return "", fmt.Errorf("expected checksum is not hexadecimal")
+	}
+	return s, nil
+}
+
+// verifyChecksum compares the SHA-256 of what was transferred with the one
+// the user expected, if any.
+func verifyChecksum(expected, actual string) error {
+	if expected != "" && expected != actual {
+		return fmt.Errorf("%w: expected %s, got %s", errChecksumMismatch, expected, actual)
+	}
+	return nil
+}
+
+func sumHex(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// remoteChecksum returns the SHA-256 of a remote file and how it was
+// computed. Running sha256sum on the host avoids copying the file to this
+// server, so it is tried first when sshClient is set; hosts that do not
+// allow commands or lack the tool are read over SFTP instead, reporting
+// progress to t. Either stops when ctx is cancelled.
+func remoteChecksum(ctx context.Context, t *transfer, sshClient *ssh.Client, c *sftp.Client, p string) (string, string, error) {
+	if sshClient != nil {
+		if sum, err := execChecksum(ctx, sshClient, p); err == nil {
+			return sum, checksumByExec, nil
+		} else if ctx.Err() != nil {
+			return "", "", ctx.Err()
+		}
+	}
+	sum, err := sftpChecksum(ctx, t, c, p)
+	return sum, checksumBySFTP, err
+}
+
+func execChecksum(ctx context.Context, client *ssh.Client, p string) (string, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+	ctx, cancel := context.WithTimeout(ctx, checksumExecTimeout)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		session.Close()
+	}()
+
+	var stdout bytes.Buffer
+	session.Stdout = &stdout
+	if err := session.Run("sha256sum -b -- " + shellQuote(p)); err != nil {
+		return "", err
+	}
+	// sha256sum prints "<hash> *<path>"; names with newlines are escaped
+	// with a leading backslash.
+	fields := strings.Fields(strings.TrimPrefix(stdout.String(), `\`))
+	if len(fields) == 0 {
+		return "", errors.New("sha256sum printed nothing")
+	}
+	return parseExpectedChecksum(fields[0])
+}
+
+func sftpChecksum(ctx context.Context, t *transfer, c *sftp.Client, p string) (string, error) {
+	f, err := c.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, &transferReader{ctx: ctx, r: f, t: t}); err != nil {
+		return "", err
+	}
+	return sumHex(h), nil
+}
+
+// remoteFileChecksum is the SHA-256 of a remote file.
+type remoteFileChecksum struct {
+	Path   string
+	Size   int64
+	SHA256 string
+	Method string
+}
+
+// handleFileChecksum replies with a "checksum" message carrying the SHA-256
+// of msg.Path. When msg.Hash is set, the result also says whether it
+// matched.
+func handleFileChecksum(ctx context.Context, t *transfer, ws *wsConn, sshClient *ssh.Client, jail *pathJail, msg wsMessage) error {
+	result := map[string]interface{}{
+		"id":   msg.ID,
+		"path": msg.Path,
+	}
+	expected, err := parseExpectedChecksum(msg.Hash)
+	var sum *remoteFileChecksum
+	if err == nil {
+		sum, err = checksumFile(ctx, t, sshClient, jail, msg.Path)
+	}
+	result["ok"] = err == nil
+	if err != nil {
+		result["error"] = err.Error()
+		sendJSON(ws, "checksum", result)
+		return err
+	}
+	result["path"] = sum.Path
+	result["size"] = sum.Size
+	result["sha256"] = sum.SHA256
+	result["method"] = sum.Method
+	if expected != "" {
+		result["expected"] = expected
+		result["match"] = expected == sum.SHA256
+	}
+	sendJSON(ws, "checksum", result)
+	return nil
+}
+
+func checksumFile(ctx context.Context, t *transfer, sshClient *ssh.Client, jail *pathJail, p string) (*remoteFileChecksum, error) {
+	sftpClient, err := sshPool.SFTP(sshClient)
+	if err != nil {
+		return nil, err
+	}
+	if p, err = jail.Resolve(sftpClient, "checksum", p); err != nil {
+		return nil, err
+	}
+	info, err := sftpClient.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", p)
+	}
+	t.update(func(t *transfer) {
+		t.BytesTotal = info.Size()
+		t.FilesTotal = 1
+	})
+	sum, method, err := remoteChecksum(ctx, t, sshClient, sftpClient, p)
+	if err != nil {
+		return nil, err
+	}
+	return &remoteFileChecksum{Path: p, Size: info.Size(), SHA256: sum, Method: method}, nil
+}
+
+// hashingWriter feeds h only the bytes w accepted, so the hash stays in
+// step with the file even when a write fails part way.
+type hashingWriter struct {
+	w io.Writer
+	h hash.Hash
+}
+
+func (hw *hashingWriter) Write(p []byte) (int, error) {
+	n, err := hw.w.Write(p)
+	hw.h.Write(p[:n])
+	return n, err
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseExpectedChecksum(t *testing.T) {
+	const sum = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	tests := []struct {
+		name  string
+		input string
+		want  string
+		ok    bool
+	}{
+		{"empty", "", "", true},
+		{"blank", "   ", "", true},
+		{"lower case", sum, sum, true},
+		{"upper case", strings.ToUpper(sum), sum, true},
+		{"surrounding space", " " + sum + "\n", sum, true},
+		{"too short", sum[:63], "", false},
+		{"too long", sum + "0", "", false},
+		{"not hexadecimal", "g" + sum[1:], "", false},
+		{"with file name", sum + "  file.txt", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseExpectedChecksum(tt.input)
+			if (err == nil) != tt.ok || got != tt.want {
+				t.Errorf("parseExpectedChecksum(%q) = %q, %v; want %q, ok %v", tt.input, got, err, tt.want, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+)
+
+// maxSymlinkDepth matches the limit Linux puts on nested symlinks.
+const maxSymlinkDepth = 40
+
+var errPathNotAllowed = errors.New("path is outside the allowed directories")
+
+// pathJail confines the file browser on one connection to the directories
+// an admin allowed for the user and for the connection. A path must lie
+// inside one root of every non-empty list, after following symlinks, so a
+// link inside a root cannot be used to reach the rest of the filesystem.
+//
+// The jail only covers file operations made through WebSSH; a user with a
+// terminal can still reach whatever the remote account can.
+type pathJail struct {
+	username string
+	connID   int
+	lists    [][]string
+}
+
+// jailFS is what a pathJail needs from an SFTP client to follow paths.
+type jailFS interface {
+	Getwd() (string, error)
+	Lstat(p string) (os.FileInfo, error)
+	ReadLink(p string) (string, error)
+}
+
+// newPathJail returns the jail for user on conn. It is nil when neither
+// has allowed roots, and a nil jail allows every path.
+func newPathJail(user *User, conn *SSHConnection) *pathJail {
+	j := &pathJail{username: user.Username, connID: conn.ID}
+	for _, roots := range [][]string{user.AllowedRoots, conn.AllowedRoots} {
+		if len(roots) > 0 {
+			j.lists = append(j.lists, roots)
+		}
+	}
+	if len(j.lists) == 0 {
+		return nil
+	}
+	return j
+}
+
+// parseAllowedRoots checks roots entered by an admin: each must be an
+// absolute path. They are returned cleaned, without duplicates.
+func parseAllowedRoots(roots []string) ([]string, error) {
+	var cleaned []string
+	seen := make(map[string]bool)
+	for _, root := range roots {
+		root = strings.TrimSpace(root)
+		if root == "" {
+			continue
+		}
+		if !strings.HasPrefix(root, "/") {
+			return nil, fmt.Errorf("allowed root %q must be an absolute path", root)
+		}
+		root = path.Clean(root)
+		if !seen[root] {
+			seen[root] = true
+			cleaned = append(cleaned, root)
+		}
+	}
+	return cleaned, nil
+}
+
+// Home is where the browser starts when no path is given: the remote
+// working directory if it is allowed, otherwise the first allowed root.
+func (j *pathJail) Home(c jailFS) string {
+	wd, _ := c.Getwd()
+	if j == nil {
+		return wd
+	}
+	if _, err := j.check(c, wd, true); err == nil {
+		return wd
+	}
+	return j.lists[len(j.lists)-1][0]
+}
+
+// Resolve checks p for action and returns it cleaned. If p is a symlink,
+// its target must be allowed too; use ResolveEntry for operations on the
+// link itself. Refused paths are recorded in the audit log.
+func (j *pathJail) Resolve(c jailFS, action, p string) (string, error) {
+	return j.resolve(c, action, p, true)
+}
+
+// ResolveEntry is Resolve for operations that act on a directory entry
+// rather than what it points to, such as deleting or renaming a symlink.
+func (j *pathJail) ResolveEntry(c jailFS, action, p string) (string, error) {
+	return j.resolve(c, action, p, false)
+}
+
+func (j *pathJail) resolve(c jailFS, action, p string, follow bool) (string, error) {
+	if !path.IsAbs(p) {
+		wd, err := c.Getwd()
+		if err != nil {
+			return "", err
+		}
+		p = path.Join(wd, p)
+	}
+	p = path.Clean(p)
+	if j == nil {
+		return p, nil
+	}
+	if _, err := j.check(c, p, follow); err != nil {
+		if errors.Is(err, errPathNotAllowed) {
+			j.audit(action, p, err)
+		}
+		return "", err
+	}
+	return p, nil
+}
+
+func (j *pathJail) check(c jailFS, p string, follow bool) (string, error) {
+	real, err := j.realPath(c, p, follow)
+	if err != nil {
+		return "", err
+	}
+	for _, roots := range j.lists {
+		if !j.within(c, roots, real) {
+			return "", fmt.Errorf("%s: %w", p, errPathNotAllowed)
+		}
+	}
+	return real, nil
+}
+
+func (j *pathJail) within(c jailFS, roots []string, p string) bool {
+	for _, root := range roots {
+		// A root may itself be reached through a symlink, such as /home
+		// on some systems.
+		candidates := []string{root}
+		if real, err := j.realPath(c, root, true); err == nil && real != root {
+			candidates = append(candidates, real)
+		}
+		for _, r := range candidates {
+			if r == "/" || p == r || strings.HasPrefix(p, r+"/") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// realPath resolves the symlinks in p one component at a time. SFTP's
+// realpath is not used because not every server resolves links with it.
+// Components that do not exist yet, as when creating a file, are kept as
+// they are. Unless follow is set, a symlink in the last component is not
+// resolved.
+func (j *pathJail) realPath(c jailFS, p string, follow bool) (string, error) {
+	resolved := "/"
+	rest := strings.Split(strings.TrimPrefix(path.Clean(p), "/"), "/")
+	links := 0
+	for len(rest) > 0 {
+		name := rest[0]
+		rest = rest[1:]
+		if name == "" || name == "." {
+			continue
+		}
+		next := path.Join(resolved, name)
+		if len(rest) == 0 && !follow {
+			return next, nil
+		}
+		info, err := c.Lstat(next)
+		if errors.Is(err, os.ErrNotExist) {
+			return path.Join(append([]string{next}, rest...)...), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		if links++; links > maxSymlinkDepth {
+			return "", fmt.Errorf("%s: too many levels of symbolic links", p)
+		}
+		target, err := c.ReadLink(next)
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(target) {
+			resolved = "/"
+		}
+		rest = append(strings.Split(strings.TrimPrefix(path.Clean(target), "/"), "/"), rest...)
+	}
+	return resolved, nil
+}
+
+func (j *pathJail) audit(action, p string, err error) {
+	log.Printf("AUDIT: user %s denied %s on connection %d: %v", j.username, action, j.connID, err)
+	if dbErr := addAuditEventDB(j.username, j.connID, action, p, err.Error()); dbErr != nil {
+		log.Printf("Failed to record audit event: %v", dbErr)
+	}
+}
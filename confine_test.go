@@ -0,0 +1,194 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"testing"
+)
+
+// fakeJailFS is a remote filesystem of directories, files and symlinks.
+type fakeJailFS struct {
+	wd    string
+	dirs  []string
+	files []string
+	links map[string]string
+}
+
+// fakeLink is a symlink's own entry.
+type fakeLink struct{ fakeFileInfo }
+
+func (fakeLink) Mode() os.FileMode { return os.ModeSymlink | 0777 }
+
+func (fs *fakeJailFS) Getwd() (string, error) { return fs.wd, nil }
+
+func (fs *fakeJailFS) Lstat(p string) (os.FileInfo, error) {
+	if _, ok := fs.links[p]; ok {
+		return fakeLink{fakeFileInfo{name: p}}, nil
+	}
+	for _, d := range fs.dirs {
+		if d == p {
+			return fakeFileInfo{name: p, dir: true}, nil
+		}
+	}
+	for _, f := range fs.files {
+		if f == p {
+			return fakeFileInfo{name: p}, nil
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+func (fs *fakeJailFS) ReadLink(p string) (string, error) {
+	if target, ok := fs.links[p]; ok {
+		return target, nil
+	}
+	return "", errors.New("not a symlink")
+}
+
+func newFakeJailFS() *fakeJailFS {
+	return &fakeJailFS{
+		wd:    "/home/alice",
+		dirs:  []string{"/etc", "/home", "/home/alice", "/home/alice/docs", "/home/bob"},
+		files: []string{"/etc/passwd", "/home/alice/docs/a.txt"},
+		links: map[string]string{
+			"/data":                "/home/alice",
+			"/home/alice/out":      "/etc",
+			"/home/alice/rel":      "../bob",
+			"/home/alice/inside":   "docs",
+			"/home/alice/chain":    "out",
+			"/home/alice/loop":     "loop",
+			"/home/alice/tobob":    "/home/alice/rel",
+			"/home/alice/docs/up":  "..",
+			"/home/alice/docs/esc": "../../bob",
+		},
+	}
+}
+
+// useTestDatabase points db at an empty in-memory database with the audit
+// log, which refused paths are written to.
+func useTestDatabase(t *testing.T) {
+	t.Helper()
+	testDB, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every connection to :memory: would be a database of its own.
+	testDB.SetMaxOpenConns(1)
+	_, err = testDB.Exec(`CREATE TABLE audit_log (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        username TEXT NOT NULL,
+        connection_id INTEGER NOT NULL DEFAULT 0,
+        action TEXT NOT NULL,
+        path TEXT NOT NULL DEFAULT '',
+        detail TEXT NOT NULL DEFAULT ''
+    )`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := db
+	db = testDB
+	t.Cleanup(func() {
+		db = saved
+		testDB.Close()
+	})
+}
+
+func TestPathJailResolve(t *testing.T) {
+	useTestDatabase(t)
+	fs := newFakeJailFS()
+	jail := &pathJail{username: "alice", connID: 1, lists: [][]string{{"/home/alice"}}}
+
+	// want is the resolved path, or one of "denied" and "error".
+	tests := []struct {
+		name   string
+		jail   *pathJail
+		path   string
+		follow bool
+		want   string
+	}{
+		{"file inside", jail, "/home/alice/docs/a.txt", true, "/home/alice/docs/a.txt"},
+		{"root itself", jail, "/home/alice", true, "/home/alice"},
+		{"relative to the working directory", jail, "docs/a.txt", true, "/home/alice/docs/a.txt"},
+		{"not created yet", jail, "/home/alice/new/file.txt", true, "/home/alice/new/file.txt"},
+		{"link within the root", jail, "/home/alice/inside/a.txt", true, "/home/alice/inside/a.txt"},
+		{"dot-dot out of the root", jail, "/home/alice/../bob", true, "denied"},
+		{"name sharing the root's prefix", jail, "/home/alicex", true, "denied"},
+		{"absolute link out", jail, "/home/alice/out", true, "denied"},
+		{"through a link out", jail, "/home/alice/out/passwd", true, "denied"},
+		{"new file through a link out", jail, "/home/alice/out/new.txt", true, "denied"},
+		{"relative link out", jail, "/home/alice/rel", true, "denied"},
+		{"chain of links out", jail, "/home/alice/chain/passwd", true, "denied"},
+		{"link to a link out", jail, "/home/alice/tobob", true, "denied"},
+		{"dot-dot link out", jail, "/home/alice/docs/esc", true, "denied"},
+		{"dot-dot link within", jail, "/home/alice/docs/up/docs", true, "/home/alice/docs/up/docs"},
+		{"link loop", jail, "/home/alice/loop", true, "error"},
+		{"link entry itself", jail, "/home/alice/out", false, "/home/alice/out"},
+		{"entry through a link out", jail, "/home/alice/out/passwd", false, "denied"},
+		{"root reached through a link", &pathJail{lists: [][]string{{"/data"}}}, "/home/alice/docs", true, "/home/alice/docs"},
+		{"path through the root's link", &pathJail{lists: [][]string{{"/data"}}}, "/data/docs/a.txt", true, "/data/docs/a.txt"},
+		{"every list must allow", &pathJail{lists: [][]string{{"/home/alice"}, {"/home/alice/docs"}}}, "/home/alice/out", false, "denied"},
+		{"no jail", nil, "/etc/../etc/passwd", true, "/etc/passwd"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			var err error
+			if tt.follow {
+				got, err = tt.jail.Resolve(fs, "test", tt.path)
+			} else {
+				got, err = tt.jail.ResolveEntry(fs, "test", tt.path)
+			}
+			switch tt.want {
+			case "denied":
+				if !errors.Is(err, errPathNotAllowed) {
+					t.Errorf("Resolve(%q) = %q, %v; want errPathNotAllowed", tt.path, got, err)
+				}
+			case "error":
+				if err == nil || errors.Is(err, errPathNotAllowed) {
+					t.Errorf("Resolve(%q) = %q, %v; want another error", tt.path, got, err)
+				}
+			default:
+				if err != nil || got != tt.want {
+					t.Errorf("Resolve(%q) = %q, %v; want %q", tt.path, got, err, tt.want)
+				}
+			}
+		})
+	}
+
+	var denied int
+	if err := db.QueryRow("SELECT COUNT(*) FROM audit_log WHERE action = 'test'").Scan(&denied); err != nil {
+		t.Fatal(err)
+	}
+	if denied != 11 {
+		t.Errorf("%d refusals audited, want 11", denied)
+	}
+}
+
+func TestPathJailRealPath(t *testing.T) {
+	fs := newFakeJailFS()
+	var jail *pathJail
+
+	tests := []struct {
+		path   string
+		follow bool
+		want   string
+	}{
+		{"/home/alice/docs/a.txt", true, "/home/alice/docs/a.txt"},
+		{"/home/alice/inside/a.txt", true, "/home/alice/docs/a.txt"},
+		{"/home/alice/chain", true, "/etc"},
+		{"/home/alice/chain", false, "/home/alice/chain"},
+		{"/home/alice/rel/x", true, "/home/bob/x"},
+		{"/home/alice/docs/up/docs", true, "/home/alice/docs"},
+		{"/data/missing/deeper", true, "/home/alice/missing/deeper"},
+		{"/", true, "/"},
+	}
+	for _, tt := range tests {
+		got, err := jail.realPath(fs, tt.path, tt.follow)
+		if err != nil || got != tt.want {
+			t.Errorf("realPath(%q, %v) = %q, %v; want %q", tt.path, tt.follow, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/net/webdav"
+)
+
+// davPrefix is where connections are served over WebDAV, as
+// /dav/{connectionID}/path/on/the/host.
+const davPrefix = "/dav/"
+
+// davAuthCacheTTL is how long a WebDAV client's password is remembered.
+// File managers send it with every request, and checking the hash each
+// time would make browsing slow.
+const davAuthCacheTTL = 5 * time.Minute
+
+// Basic authentication is refused for a username or client address after
+// davMaxFailures wrong passwords within davFailureWindow.
+const (
+	davMaxFailures   = 10
+	davFailureWindow = 15 * time.Minute
+)
+
+var (
+	davAuthCache      = make(map[string]time.Time)
+	davAuthCacheMutex sync.Mutex
+	davThrottle       = newLoginThrottle(davMaxFailures, davFailureWindow)
+
+	// davLocks holds the locks of each user's connection, which clients
+	// such as Finder and Windows take before writing.
+	davLocks      = make(map[string]webdav.LockSystem)
+	davLocksMutex sync.Mutex
+)
+
+// handleWebDAV serves a connection's files over WebDAV so it can be mounted
+// in a file manager. Requests carry the browser session cookie or, as file
+// managers do, the WebSSH username and password with Basic authentication.
+// The same feature flags, allowed roots and transfer limits apply as in the
+// file browser.
+//
+//	/dav/{connectionID}/path
+func handleWebDAV(w http.ResponseWriter, r *http.Request) {
+	if disableFileBrowser {
+		http.Error(w, "File browser is disabled", http.StatusForbidden)
+		return
+	}
+	user := davAuthenticate(w, r)
+	if user == nil {
+		return
+	}
+
+	connID, remotePath, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, davPrefix), "/")
+	if connID == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, davPrefix+connID+"/") {
+		// The connection itself is the root directory.
+		r.URL.Path += "/"
+	}
+	remotePath = "/" + remotePath
+	if disableDownload && r.Method == http.MethodGet {
+		http.Error(w, "Downloads are disabled", http.StatusForbidden)
+		return
+	}
+
+	sftpClient, jail, release, err := acquireConnectionSFTP(user.ID, connID)
+	if errors.Is(err, errConnectionNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to get SFTP client: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer release()
+
+	// The handler turns most errors into generic statuses, so refusals
+	// and limits are answered here first.
+	p, err := jail.Resolve(sftpClient, "webdav", remotePath)
+	if errors.Is(err, errPathNotAllowed) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	account := newTransferAccount(r, user.ID)
+	fs := &davFS{c: sftpClient, jail: jail, ctx: r.Context(), account: account, quota: account.quota()}
+	switch r.Method {
+	case http.MethodGet:
+		if info, err := sftpClient.Stat(p); err == nil && info.Mode().IsRegular() {
+			if err := checkTransferSize(user.ID, info.Size(), maxDownloadSize); err != nil {
+				http.Error(w, err.Error(), limitStatus(err))
+				return
+			}
+		}
+	case http.MethodPut:
+		if r.ContentLength > 0 {
+			if err := checkTransferSize(user.ID, r.ContentLength, maxUploadSize); err != nil {
+				http.Error(w, err.Error(), limitStatus(err))
+				return
+			}
+		}
+		if fs.upload, err = capTransfer(user.ID, maxUploadSize); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	defer fs.quota.close()
+
+	handler := &webdav.Handler{
+		Prefix:     davPrefix + connID,
+		FileSystem: fs,
+		LockSystem: davLockSystem(user.ID, connID),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				log.Printf("WebDAV %s %s for %s: %v", r.Method, r.URL.Path, user.Username, err)
+			}
+		},
+	}
+	handler.ServeHTTP(&davResponseWriter{ResponseWriter: w, fs: fs}, r)
+}
+
+// davResponseWriter reports a PUT stopped by a transfer limit with the
+// limit's status, where the handler would answer 405.
+type davResponseWriter struct {
+	http.ResponseWriter
+	fs       *davFS
+	replaced bool
+}
+
+func (w *davResponseWriter) WriteHeader(code int) {
+	if code >= http.StatusBadRequest && w.fs.limitErr != nil {
+		w.replaced = true
+		http.Error(w.ResponseWriter, w.fs.limitErr.Error(), limitStatus(w.fs.limitErr))
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *davResponseWriter) Write(p []byte) (int, error) {
+	if w.replaced {
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// davAuthenticate returns the user making a WebDAV request, or nil after
+// asking for credentials.
+func davAuthenticate(w http.ResponseWriter, r *http.Request) *User {
+	if username := getSessionUser(r); username != "" {
+		if user, err := getUserByUsernameDB(username); err == nil && user != nil {
+			return user
+		}
+	}
+	if username, password, ok := r.BasicAuth(); ok {
+		user, err := davCheckPassword(username, password, clientAddress(r))
+		if errors.Is(err, errTooManyAttempts) {
+			w.Header().Set("Retry-After", fmt.Sprint(int(davFailureWindow.Seconds())))
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return nil
+		}
+		if user != nil {
+			return user
+		}
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="WebSSH", charset="UTF-8"`)
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	return nil
+}
+
+// davCheckPassword checks credentials as the login page does. Accepted ones
+// are cached by a hash that includes the stored password hash, so changing
+// the password ends the cache entry. Users with two-factor authentication
+// cannot log in with a password alone; they can only use WebDAV from a
+// browser that is logged in. Passwords not in the cache are checked
+// outside the lock, since bcrypt takes about a second, and the attempts
+// are throttled per user and per client address.
+func davCheckPassword(username, password, addr string) (*User, error) {
+	user, err := getUserByUsernameDB(username)
+	if err != nil || user == nil || !user.IsApproved || user.TOTPEnabled || twoFactorRequired(user) {
+		return nil, davThrottle.attempt("addr:" + addr)
+	}
+	sum := sha256.Sum256([]byte(username + "\x00" + password + "\x00" + user.Password))
+	key := hex.EncodeToString(sum[:])
+
+	davAuthCacheMutex.Lock()
+	expires, ok := davAuthCache[key]
+	davAuthCacheMutex.Unlock()
+	if ok && time.Now().Before(expires) {
+		return user, nil
+	}
+
+	throttleKeys := []string{"user:" + username, "addr:" + addr}
+	if err := davThrottle.attempt(throttleKeys...); err != nil {
+		return nil, err
+	}
+	if !verifyPassword(password, user.Password) {
+		log.Printf("WebDAV: wrong password for user %s from %s", username, addr)
+		return nil, nil
+	}
+	davThrottle.succeeded(throttleKeys...)
+
+	davAuthCacheMutex.Lock()
+	defer davAuthCacheMutex.Unlock()
+	now := time.Now()
+	for k, expires := range davAuthCache {
+		if now.After(expires) {
+			delete(davAuthCache, k)
+		}
+	}
+	davAuthCache[key] = now.Add(davAuthCacheTTL)
+	return user, nil
+}
+
+func davLockSystem(userID int, connID string) webdav.LockSystem {
+	key := fmt.Sprintf("%d/%s", userID, connID)
+	davLocksMutex.Lock()
+	defer davLocksMutex.Unlock()
+	ls := davLocks[key]
+	if ls == nil {
+		ls = webdav.NewMemLS()
+		davLocks[key] = ls
+	}
+	return ls
+}
+
+// davFS is a webdav.FileSystem over one request's SFTP client. Names are
+// absolute paths on the host, checked against the jail like the file
+// browser's. It counts the bytes moved for the transfer quota.
+type davFS struct {
+	c       *sftp.Client
+	jail    *pathJail
+	ctx     context.Context
+	account transferAccount
+	// upload caps what a PUT may write when its size is not known up
+	// front.
+	upload transferCap
+	// quota is charged with what files are read and written.
+	quota *quotaMeter
+	// limitErr is set when a write went over upload.
+	limitErr error
+}
+
+// resolve checks name against the jail. Refusals are reported as
+// permission errors, which the handler understands.
+func (fs *davFS) resolve(name string, follow bool) (string, error) {
+	resolve := fs.jail.Resolve
+	if !follow {
+		resolve = fs.jail.ResolveEntry
+	}
+	p, err := resolve(fs.c, "webdav", name)
+	if errors.Is(err, errPathNotAllowed) {
+		return "", &os.PathError{Op: "webdav", Path: name, Err: os.ErrPermission}
+	}
+	return p, err
+}
+
+func (fs *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	p, err := fs.resolve(name, true)
+	if err != nil {
+		return err
+	}
+	return fs.c.Mkdir(p)
+}
+
+func (fs *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	p, err := fs.resolve(name, true)
+	if err != nil {
+		return nil, err
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		f, err := fs.c.OpenFile(p, flag)
+		if err != nil {
+			return nil, err
+		}
+		return fs.newFile(f), nil
+	}
+	info, err := fs.c.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return &davDir{fs: fs, path: p, info: info}, nil
+	}
+	f, err := fs.c.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	return fs.newFile(f), nil
+}
+
+func (fs *davFS) newFile(f *sftp.File) *davFile {
+	return &davFile{
+		file: f,
+		fs:   fs,
+		r:    &meteredReader{r: f, ctx: fs.ctx, limiter: fs.account.limiter(downloadDirection), quota: fs.quota},
+		w:    &meteredWriter{w: f, ctx: fs.ctx, limiter: fs.account.limiter(uploadDirection), cap: fs.upload, quota: fs.quota, direction: uploadDirection},
+	}
+}
+
+// RemoveAll deletes name without following symlinks out of the jail. The
+// root of the host is never removed.
+func (fs *davFS) RemoveAll(ctx context.Context, name string) error {
+	p, err := fs.resolve(name, false)
+	if err != nil {
+		return err
+	}
+	if p == "/" {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrPermission}
+	}
+	return removeAllRemote(fs.c, p)
+}
+
+func (fs *davFS) Rename(ctx context.Context, oldName, newName string) error {
+	oldPath, err := fs.resolve(oldName, false)
+	if err != nil {
+		return err
+	}
+	newPath, err := fs.resolve(newName, true)
+	if err != nil {
+		return err
+	}
+	// The handler has already removed an existing target when the client
+	// allowed overwriting.
+	return fs.c.Rename(oldPath, newPath)
+}
+
+func (fs *davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	p, err := fs.resolve(name, true)
+	if err != nil {
+		return nil, err
+	}
+	info, err := fs.c.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	return davFileInfo{info}, nil
+}
+
+// davFile is an open remote file. It wraps rather than embeds the
+// sftp.File so that copies go through Read and Write, and are metered.
+type davFile struct {
+	file *sftp.File
+	fs   *davFS
+	r    *meteredReader
+	w    *meteredWriter
+	// partial is set when a write was stopped by a limit, and the file
+	// is removed on close rather than left truncated.
+	partial bool
+}
+
+func (f *davFile) Read(p []byte) (int, error) { return f.r.Read(p) }
+
+func (f *davFile) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if errors.Is(err, errTooLarge) || errors.Is(err, errQuotaExceeded) {
+		f.fs.limitErr = err
+		f.partial = true
+	}
+	return n, err
+}
+
+func (f *davFile) Seek(offset int64, whence int) (int64, error) {
+	return f.file.Seek(offset, whence)
+}
+
+func (f *davFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, &os.PathError{Op: "readdir", Path: f.file.Name(), Err: errors.New("not a directory")}
+}
+
+func (f *davFile) Stat() (os.FileInfo, error) {
+	info, err := f.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return davFileInfo{info}, nil
+}
+
+func (f *davFile) Close() error {
+	err := f.file.Close()
+	if f.partial {
+		f.fs.c.Remove(f.file.Name())
+	}
+	return err
+}
+
+// davDir is an open remote directory.
+type davDir struct {
+	fs      *davFS
+	path    string
+	info    os.FileInfo
+	entries []os.FileInfo
+	read    bool
+}
+
+func (d *davDir) Read([]byte) (int, error)  { return 0, d.notFile("read") }
+func (d *davDir) Write([]byte) (int, error) { return 0, d.notFile("write") }
+func (d *davDir) Seek(int64, int) (int64, error) {
+	return 0, d.notFile("seek")
+}
+func (d *davDir) Close() error               { return nil }
+func (d *davDir) Stat() (os.FileInfo, error) { return davFileInfo{d.info}, nil }
+
+func (d *davDir) notFile(op string) error {
+	return &os.PathError{Op: op, Path: d.path, Err: errors.New("is a directory")}
+}
+
+// Readdir lists the directory as os.File.Readdir does. Symlinks are shown
+// as what they point to, so linked directories can be opened.
+func (d *davDir) Readdir(count int) ([]os.FileInfo, error) {
+	if !d.read {
+		entries, err := d.fs.c.ReadDir(d.path)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.Mode()&os.ModeSymlink != 0 {
+				if target, err := d.fs.c.Stat(path.Join(d.path, entry.Name())); err == nil {
+					entry = renamedFileInfo{target, entry.Name()}
+				}
+			}
+			d.entries = append(d.entries, davFileInfo{entry})
+		}
+		d.read = true
+	}
+	if count <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n := min(count, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+// davFileInfo gives the content type from the name, so that listings do
+// not open and read every file to sniff it.
+type davFileInfo struct {
+	os.FileInfo
+}
+
+func (i davFileInfo) ContentType(ctx context.Context) (string, error) {
+	if t := mime.TypeByExtension(path.Ext(i.Name())); t != "" {
+		return t, nil
+	}
+	return "application/octet-stream", nil
+}
+
+// renamedFileInfo is the target of a symlink under the link's name.
+type renamedFileInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (i renamedFileInfo) Name() string { return i.name }
@@ -7,6 +7,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -35,6 +36,16 @@ func initDatabase() error {
 	if _, err := db.Exec(createUsersTable); err != nil {
 		return fmt.Errorf("failed to create users table: %w", err)
 	}
+	for _, column := range []struct{ name, definition string }{
+		{"allowed_roots", "TEXT NOT NULL DEFAULT ''"},
+		{"files_only", "BOOLEAN NOT NULL DEFAULT 0"},
+		{"totp_secret", "TEXT NOT NULL DEFAULT ''"},
+		{"totp_enabled", "BOOLEAN NOT NULL DEFAULT 0"},
+	} {
+		if err := addColumnIfMissing("users", column.name, column.definition); err != nil {
+			return err
+		}
+	}
 
 	createConnectionsTable := `
     CREATE TABLE IF NOT EXISTS connections (
@@ -50,7 +61,120 @@ func initDatabase() error {
 	if _, err := db.Exec(createConnectionsTable); err != nil {
 		return fmt.Errorf("failed to create connections table: %w", err)
 	}
+	for _, column := range []struct{ name, definition string }{
+		{"disable_health_check", "BOOLEAN NOT NULL DEFAULT 0"},
+		{"algorithm_preset", "TEXT NOT NULL DEFAULT ''"},
+		{"key_exchanges", "TEXT NOT NULL DEFAULT ''"},
+		{"ciphers", "TEXT NOT NULL DEFAULT ''"},
+		{"macs", "TEXT NOT NULL DEFAULT ''"},
+		{"host_key_algorithms", "TEXT NOT NULL DEFAULT ''"},
+		{"allowed_roots", "TEXT NOT NULL DEFAULT ''"},
+		{"startup_command", "TEXT NOT NULL DEFAULT ''"},
+	} {
+		if err := addColumnIfMissing("connections", column.name, column.definition); err != nil {
+			return err
+		}
+	}
+
+	createHealthTable := `
+    CREATE TABLE IF NOT EXISTS connection_health (
+        connection_id INTEGER PRIMARY KEY,
+        status TEXT NOT NULL,
+        latency_ms INTEGER NOT NULL DEFAULT 0,
+        banner TEXT NOT NULL DEFAULT '',
+        previous_banner TEXT NOT NULL DEFAULT '',
+        banner_changed_at DATETIME,
+        last_error TEXT NOT NULL DEFAULT '',
+        checked_at DATETIME NOT NULL,
+        FOREIGN KEY(connection_id) REFERENCES connections(id)
+    );`
+	if _, err := db.Exec(createHealthTable); err != nil {
+		return fmt.Errorf("failed to create connection_health table: %w", err)
+	}
+
+	createAuditTable := `
+    CREATE TABLE IF NOT EXISTS audit_log (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        username TEXT NOT NULL,
+        connection_id INTEGER NOT NULL DEFAULT 0,
+        action TEXT NOT NULL,
+        path TEXT NOT NULL DEFAULT '',
+        detail TEXT NOT NULL DEFAULT ''
+    );`
+	if _, err := db.Exec(createAuditTable); err != nil {
+		return fmt.Errorf("failed to create audit_log table: %w", err)
+	}
+
+	createUsageTable := `
+    CREATE TABLE IF NOT EXISTS transfer_usage (
+        user_id INTEGER NOT NULL,
+        day TEXT NOT NULL,
+        uploaded INTEGER NOT NULL DEFAULT 0,
+        downloaded INTEGER NOT NULL DEFAULT 0,
+        PRIMARY KEY (user_id, day),
+        FOREIGN KEY(user_id) REFERENCES users(id)
+    );`
+	if _, err := db.Exec(createUsageTable); err != nil {
+		return fmt.Errorf("failed to create transfer_usage table: %w", err)
+	}
+
+	createRecoveryCodesTable := `
+    CREATE TABLE IF NOT EXISTS recovery_codes (
+        user_id INTEGER NOT NULL,
+        code_hash TEXT NOT NULL,
+        PRIMARY KEY (user_id, code_hash),
+        FOREIGN KEY(user_id) REFERENCES users(id)
+    );`
+	if _, err := db.Exec(createRecoveryCodesTable); err != nil {
+		return fmt.Errorf("failed to create recovery_codes table: %w", err)
+	}
+
+	createSettingsTable := `
+    CREATE TABLE IF NOT EXISTS settings (
+        key TEXT PRIMARY KEY,
+        value TEXT NOT NULL
+    );`
+	if _, err := db.Exec(createSettingsTable); err != nil {
+		return fmt.Errorf("failed to create settings table: %w", err)
+	}
+
+	return nil
+}
+
+// addColumnIfMissing lets databases created by older versions pick up new
+// columns on startup.
+func addColumnIfMissing(table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("failed to inspect %s table: %w", table, err)
+	}
+	defer rows.Close()
 
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			colType    string
+			notNull    bool
+			defaultVal sql.NullString
+			primaryKey int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultVal, &primaryKey); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
+	}
 	return nil
 }
 
@@ -67,19 +191,31 @@ func createUserDB(username, password string, isAdmin, isApproved bool) error {
 }
 
 func getUserByUsernameDB(username string) (*User, error) {
-	var user User
-	err := db.QueryRow("SELECT id, username, password, is_admin, is_approved, registration_date FROM users WHERE username = ?", username).Scan(&user.ID, &user.Username, &user.Password, &user.IsAdmin, &user.IsApproved, &user.RegistrationDate)
+	return scanUser(db.QueryRow("SELECT id, username, password, is_admin, is_approved, registration_date, allowed_roots, files_only, totp_enabled FROM users WHERE username = ?", username))
+}
+
+func getUserByIDDB(id int) (*User, error) {
+	return scanUser(db.QueryRow("SELECT id, username, password, is_admin, is_approved, registration_date, allowed_roots, files_only, totp_enabled FROM users WHERE id = ?", id))
+}
+
+func scanUser(row *sql.Row) (*User, error) {
+	var (
+		user  User
+		roots string
+	)
+	err := row.Scan(&user.ID, &user.Username, &user.Password, &user.IsAdmin, &user.IsApproved, &user.RegistrationDate, &roots, &user.FilesOnly, &user.TOTPEnabled)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, err
 	}
+	user.AllowedRoots = splitRoots(roots)
 	return &user, nil
 }
 
 func getAllUsersDB() ([]User, error) {
-	rows, err := db.Query("SELECT id, username, password, is_admin, is_approved, registration_date FROM users ORDER BY registration_date DESC")
+	rows, err := db.Query("SELECT id, username, password, is_admin, is_approved, registration_date, allowed_roots, files_only, totp_enabled FROM users ORDER BY registration_date DESC")
 	if err != nil {
 		return nil, err
 	}
@@ -87,17 +223,21 @@ func getAllUsersDB() ([]User, error) {
 
 	var allUsers []User
 	for rows.Next() {
-		var user User
-		if err := rows.Scan(&user.ID, &user.Username, &user.Password, &user.IsAdmin, &user.IsApproved, &user.RegistrationDate); err != nil {
+		var (
+			user  User
+			roots string
+		)
+		if err := rows.Scan(&user.ID, &user.Username, &user.Password, &user.IsAdmin, &user.IsApproved, &user.RegistrationDate, &roots, &user.FilesOnly, &user.TOTPEnabled); err != nil {
 			return nil, err
 		}
+		user.AllowedRoots = splitRoots(roots)
 		allUsers = append(allUsers, user)
 	}
 	return allUsers, nil
 }
 
 func getPendingUsersDB() ([]User, error) {
-	rows, err := db.Query("SELECT id, username, password, is_admin, is_approved, registration_date FROM users WHERE is_approved = 0 ORDER BY registration_date ASC")
+	rows, err := db.Query("SELECT id, username, password, is_admin, is_approved, registration_date, allowed_roots, files_only, totp_enabled FROM users WHERE is_approved = 0 ORDER BY registration_date ASC")
 	if err != nil {
 		return nil, err
 	}
@@ -105,10 +245,14 @@ func getPendingUsersDB() ([]User, error) {
 
 	var pendingUsers []User
 	for rows.Next() {
-		var user User
-		if err := rows.Scan(&user.ID, &user.Username, &user.Password, &user.IsAdmin, &user.IsApproved, &user.RegistrationDate); err != nil {
+		var (
+			user  User
+			roots string
+		)
+		if err := rows.Scan(&user.ID, &user.Username, &user.Password, &user.IsAdmin, &user.IsApproved, &user.RegistrationDate, &roots, &user.FilesOnly, &user.TOTPEnabled); err != nil {
 			return nil, err
 		}
+		user.AllowedRoots = splitRoots(roots)
 		pendingUsers = append(pendingUsers, user)
 	}
 	return pendingUsers, nil
@@ -134,18 +278,171 @@ func updateUserPasswordDB(username, password string) error {
 	return err
 }
 
+func updateUserAllowedRootsDB(username string, roots []string) error {
+	_, err := db.Exec("UPDATE users SET allowed_roots = ? WHERE username = ?", joinRoots(roots), username)
+	return err
+}
+
+func updateUserFilesOnlyDB(username string, filesOnly bool) error {
+	_, err := db.Exec("UPDATE users SET files_only = ? WHERE username = ?", filesOnly, username)
+	return err
+}
+
+// getTOTPSecretDB returns the user's TOTP secret, still encrypted.
+func getTOTPSecretDB(userID int) (string, error) {
+	var secret string
+	err := db.QueryRow("SELECT totp_secret FROM users WHERE id = ?", userID).Scan(&secret)
+	return secret, err
+}
+
+// enableTOTPDB stores the user's encrypted TOTP secret and the hashes of
+// their recovery codes, replacing any earlier ones.
+func enableTOTPDB(userID int, secret string, codeHashes []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("UPDATE users SET totp_secret = ?, totp_enabled = 1 WHERE id = ?", secret, userID); err != nil {
+		return err
+	}
+	if err := replaceRecoveryCodesTx(tx, userID, codeHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func disableTOTPDB(userID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("UPDATE users SET totp_secret = '', totp_enabled = 0 WHERE id = ?", userID); err != nil {
+		return err
+	}
+	if err := replaceRecoveryCodesTx(tx, userID, nil); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func replaceRecoveryCodesDB(userID int, codeHashes []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := replaceRecoveryCodesTx(tx, userID, codeHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func replaceRecoveryCodesTx(tx *sql.Tx, userID int, codeHashes []string) error {
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	for _, h := range codeHashes {
+		if _, err := tx.Exec("INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)", userID, h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// useRecoveryCodeDB removes a recovery code, reporting whether the user had
+// it. Each code works once.
+func useRecoveryCodeDB(userID int, codeHash string) (bool, error) {
+	res, err := db.Exec("DELETE FROM recovery_codes WHERE user_id = ? AND code_hash = ?", userID, codeHash)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func countRecoveryCodesDB(userID int) (int, error) {
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM recovery_codes WHERE user_id = ?", userID).Scan(&n)
+	return n, err
+}
+
+// getSettingDB returns a server-wide setting changed from the admin panel,
+// or "" if it was never set.
+func getSettingDB(key string) (string, error) {
+	var value string
+	err := db.QueryRow("SELECT value FROM settings WHERE key = ?", key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return value, err
+}
+
+func setSettingDB(key, value string) error {
+	_, err := db.Exec("INSERT INTO settings (key, value) VALUES (?, ?) ON CONFLICT(key) DO UPDATE SET value = excluded.value", key, value)
+	return err
+}
+
 func deleteUserDB(username string) error {
 	_, err := db.Exec("DELETE FROM users WHERE username = ?", username)
 	return err
 }
 
-func createConnectionDB(userID int, name, host, user, password, key string) error {
-	_, err := db.Exec("INSERT INTO connections (user_id, name, host, user, password, key) VALUES (?, ?, ?, ?, ?, ?)", userID, name, host, user, password, key)
+// createConnectionDB stores conn for userID. Password and Key must already
+// be encrypted.
+func createConnectionDB(userID int, conn *SSHConnection) error {
+	_, err := db.Exec(`INSERT INTO connections (user_id, name, host, user, password, key, disable_health_check,
+        algorithm_preset, key_exchanges, ciphers, macs, host_key_algorithms, startup_command) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		userID, conn.Name, conn.Host, conn.User, conn.Password, conn.Key, conn.DisableHealthCheck,
+		conn.AlgorithmPreset, joinAlgorithms(conn.KeyExchanges), joinAlgorithms(conn.Ciphers), joinAlgorithms(conn.MACs), joinAlgorithms(conn.HostKeyAlgorithms),
+		conn.StartupCommand)
+	return err
+}
+
+func updateConnectionAlgorithmsDB(userID int, conn *SSHConnection) error {
+	_, err := db.Exec("UPDATE connections SET algorithm_preset = ?, key_exchanges = ?, ciphers = ?, macs = ?, host_key_algorithms = ? WHERE id = ? AND user_id = ?",
+		conn.AlgorithmPreset, joinAlgorithms(conn.KeyExchanges), joinAlgorithms(conn.Ciphers), joinAlgorithms(conn.MACs), joinAlgorithms(conn.HostKeyAlgorithms), conn.ID, userID)
 	return err
 }
 
+// Algorithm lists are stored comma-separated, the same way OpenSSH writes
+// them in ssh_config.
+func joinAlgorithms(names []string) string {
+	return strings.Join(names, ",")
+}
+
+func splitAlgorithms(value string) []string {
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Allowed roots are stored one per line, since paths may contain commas.
+func joinRoots(roots []string) string {
+	return strings.Join(roots, "\n")
+}
+
+func splitRoots(value string) []string {
+	var roots []string
+	for _, root := range strings.Split(value, "\n") {
+		if root = strings.TrimSpace(root); root != "" {
+			roots = append(roots, root)
+		}
+	}
+	return roots
+}
+
 func getUserConnectionsDB(userID int) ([]SSHConnection, error) {
-	rows, err := db.Query("SELECT id, name, host, user FROM connections WHERE user_id = ?", userID)
+	rows, err := db.Query(`SELECT c.id, c.name, c.host, c.user, c.disable_health_check,
+        c.algorithm_preset, c.key_exchanges, c.ciphers, c.macs, c.host_key_algorithms, c.allowed_roots, c.startup_command,
+        h.status, h.latency_ms, h.banner, h.previous_banner, h.banner_changed_at, h.last_error, h.checked_at
+        FROM connections c LEFT JOIN connection_health h ON h.connection_id = c.id
+        WHERE c.user_id = ?`, userID)
 	if err != nil {
 		return nil, err
 	}
@@ -153,24 +450,180 @@ func getUserConnectionsDB(userID int) ([]SSHConnection, error) {
 
 	var connections []SSHConnection
 	for rows.Next() {
-		var conn SSHConnection
-		if err := rows.Scan(&conn.ID, &conn.Name, &conn.Host, &conn.User); err != nil {
+		var (
+			conn            SSHConnection
+			algorithms      [4]string
+			roots           string
+			status          sql.NullString
+			latencyMs       sql.NullInt64
+			banner          sql.NullString
+			previousBanner  sql.NullString
+			bannerChangedAt sql.NullTime
+			lastError       sql.NullString
+			checkedAt       sql.NullTime
+		)
+		if err := rows.Scan(&conn.ID, &conn.Name, &conn.Host, &conn.User, &conn.DisableHealthCheck,
+			&conn.AlgorithmPreset, &algorithms[0], &algorithms[1], &algorithms[2], &algorithms[3], &roots, &conn.StartupCommand,
+			&status, &latencyMs, &banner, &previousBanner, &bannerChangedAt, &lastError, &checkedAt); err != nil {
 			return nil, err
 		}
+		conn.setAlgorithmColumns(algorithms)
+		conn.AllowedRoots = splitRoots(roots)
+		if status.Valid {
+			conn.Health = &ConnectionHealth{
+				Status:         status.String,
+				LatencyMs:      latencyMs.Int64,
+				Banner:         banner.String,
+				PreviousBanner: previousBanner.String,
+				Error:          lastError.String,
+				CheckedAt:      checkedAt.Time,
+			}
+			if bannerChangedAt.Valid {
+				conn.Health.BannerChangedAt = &bannerChangedAt.Time
+			}
+		}
 		connections = append(connections, conn)
 	}
 	return connections, nil
 }
 
+func setConnectionHealthCheckDB(userID int, connID string, disabled bool) error {
+	res, err := db.Exec("UPDATE connections SET disable_health_check = ? WHERE id = ? AND user_id = ?", disabled, connID, userID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return errors.New("connection not found or not owned by user")
+	}
+	return nil
+}
+
+func setConnectionStartupCommandDB(userID int, connID string, command string) error {
+	res, err := db.Exec("UPDATE connections SET startup_command = ? WHERE id = ? AND user_id = ?", command, connID, userID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return errors.New("connection not found or not owned by user")
+	}
+	return nil
+}
+
+// getHealthCheckTargetsDB returns every connection, across all users, that
+// has not opted out of background reachability checks.
+func getHealthCheckTargetsDB() ([]SSHConnection, error) {
+	rows, err := db.Query("SELECT id, host FROM connections WHERE disable_health_check = 0")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var targets []SSHConnection
+	for rows.Next() {
+		var conn SSHConnection
+		if err := rows.Scan(&conn.ID, &conn.Host); err != nil {
+			return nil, err
+		}
+		targets = append(targets, conn)
+	}
+	return targets, rows.Err()
+}
+
+// saveConnectionHealthDB records a probe result. When the SSH banner differs
+// from the one seen last time, the old banner and the time of the change are
+// kept so the UI can flag it.
+func saveConnectionHealthDB(connID int, h *ConnectionHealth) error {
+	_, err := db.Exec(`
+    INSERT INTO connection_health (connection_id, status, latency_ms, banner, last_error, checked_at)
+    VALUES (?, ?, ?, ?, ?, ?)
+    ON CONFLICT(connection_id) DO UPDATE SET
+        previous_banner = CASE WHEN excluded.banner != '' AND banner != '' AND excluded.banner != banner THEN banner ELSE previous_banner END,
+        banner_changed_at = CASE WHEN excluded.banner != '' AND banner != '' AND excluded.banner != banner THEN excluded.checked_at ELSE banner_changed_at END,
+        banner = CASE WHEN excluded.banner != '' THEN excluded.banner ELSE banner END,
+        status = excluded.status,
+        latency_ms = excluded.latency_ms,
+        last_error = excluded.last_error,
+        checked_at = excluded.checked_at`,
+		connID, h.Status, h.LatencyMs, h.Banner, h.Error, h.CheckedAt)
+	return err
+}
+
 func getConnectionByIDDB(userID int, connID string) (*SSHConnection, error) {
-	var conn SSHConnection
-	err := db.QueryRow("SELECT id, name, host, user, password, key FROM connections WHERE id = ? AND user_id = ?", connID, userID).Scan(&conn.ID, &conn.Name, &conn.Host, &conn.User, &conn.Password, &conn.Key)
+	var (
+		conn       SSHConnection
+		algorithms [4]string
+		roots      string
+	)
+	err := db.QueryRow(`SELECT id, name, host, user, password, key, disable_health_check,
+        algorithm_preset, key_exchanges, ciphers, macs, host_key_algorithms, allowed_roots, startup_command
+        FROM connections WHERE id = ? AND user_id = ?`, connID, userID).Scan(
+		&conn.ID, &conn.Name, &conn.Host, &conn.User, &conn.Password, &conn.Key, &conn.DisableHealthCheck,
+		&conn.AlgorithmPreset, &algorithms[0], &algorithms[1], &algorithms[2], &algorithms[3], &roots, &conn.StartupCommand)
 	if err != nil {
 		return nil, err
 	}
+	conn.setAlgorithmColumns(algorithms)
+	conn.AllowedRoots = splitRoots(roots)
 	return &conn, nil
 }
 
+func updateConnectionAllowedRootsDB(userID int, connID string, roots []string) error {
+	res, err := db.Exec("UPDATE connections SET allowed_roots = ? WHERE id = ? AND user_id = ?", joinRoots(roots), connID, userID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return errors.New("connection not found or not owned by user")
+	}
+	return nil
+}
+
+func addAuditEventDB(username string, connID int, action, path, detail string) error {
+	_, err := db.Exec("INSERT INTO audit_log (username, connection_id, action, path, detail) VALUES (?, ?, ?, ?, ?)",
+		username, connID, action, path, detail)
+	return err
+}
+
+// getAuditEventsDB returns the most recent audit events, newest first.
+func getAuditEventsDB(limit int) ([]AuditEvent, error) {
+	rows, err := db.Query("SELECT id, created_at, username, connection_id, action, path, detail FROM audit_log ORDER BY id DESC LIMIT ?", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []AuditEvent
+	for rows.Next() {
+		var e AuditEvent
+		if err := rows.Scan(&e.ID, &e.CreatedAt, &e.Username, &e.ConnectionID, &e.Action, &e.Path, &e.Detail); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// setAlgorithmColumns fills the algorithm lists from the key_exchanges,
+// ciphers, macs and host_key_algorithms columns, in that order.
+func (conn *SSHConnection) setAlgorithmColumns(columns [4]string) {
+	conn.KeyExchanges = splitAlgorithms(columns[0])
+	conn.Ciphers = splitAlgorithms(columns[1])
+	conn.MACs = splitAlgorithms(columns[2])
+	conn.HostKeyAlgorithms = splitAlgorithms(columns[3])
+}
+
 func deleteConnectionDB(userID int, connID string) error {
 	res, err := db.Exec("DELETE FROM connections WHERE id = ? AND user_id = ?", connID, userID)
 	if err != nil {
@@ -183,7 +636,8 @@ func deleteConnectionDB(userID int, connID string) error {
 	if rowsAffected == 0 {
 		return errors.New("connection not found or not owned by user")
 	}
-	return nil
+	_, err = db.Exec("DELETE FROM connection_health WHERE connection_id = ?", connID)
+	return err
 }
 
 func ensureAdminUserExists(adminPassword string) {
@@ -257,3 +711,43 @@ func loadUsersIntoMemory() {
 	}
 	log.Printf("Loaded %d users into memory cache.", len(users))
 }
+
+func addTransferUsageDB(userID int, day string, uploaded, downloaded int64) error {
+	_, err := db.Exec(`INSERT INTO transfer_usage (user_id, day, uploaded, downloaded) VALUES (?, ?, ?, ?)
+        ON CONFLICT(user_id, day) DO UPDATE SET
+        uploaded = uploaded + excluded.uploaded,
+        downloaded = downloaded + excluded.downloaded`,
+		userID, day, uploaded, downloaded)
+	return err
+}
+
+func getTransferUsageDB(userID int, day string) (*TransferUsage, error) {
+	usage := &TransferUsage{Day: day}
+	err := db.QueryRow("SELECT uploaded, downloaded FROM transfer_usage WHERE user_id = ? AND day = ?", userID, day).Scan(&usage.Uploaded, &usage.Downloaded)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// getTransferUsageSinceDB returns every user's usage per day from since
+// onwards, newest first.
+func getTransferUsageSinceDB(since string) ([]TransferUsage, error) {
+	rows, err := db.Query(`SELECT u.username, t.day, t.uploaded, t.downloaded
+        FROM transfer_usage t JOIN users u ON u.id = t.user_id
+        WHERE t.day >= ? ORDER BY t.day DESC, u.username`, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var usage []TransferUsage
+	for rows.Next() {
+		var u TransferUsage
+		if err := rows.Scan(&u.Username, &u.Day, &u.Uploaded, &u.Downloaded); err != nil {
+			return nil, err
+		}
+		usage = append(usage, u)
+	}
+	return usage, rows.Err()
+}
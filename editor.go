@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// maxEditSize caps the files the browser editor will open.
+const maxEditSize = 5 << 20
+
+// Codes reported with a failed read or write.
+const (
+	editCodeTooLarge = "too_large"
+	editCodeBinary   = "binary"
+	editCodeConflict = "conflict"
+)
+
+type editError struct {
+	Code    string
+	Message string
+}
+
+func (e *editError) Error() string { return e.Message }
+
+// remoteText is a text file as last seen by the editor. Hash identifies the
+// content the user started from, so a save can tell if someone else changed
+// the file in the meantime.
+type remoteText struct {
+	Path    string    `json:"path"`
+	Content string    `json:"content,omitempty"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Mode    string    `json:"mode"`
+	Hash    string    `json:"hash"`
+}
+
+func hashContent(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// handleFileRead sends a text file to the editor in a "read" message. It
+// counts as a download towards the user's limits and quota.
+func handleFileRead(ctx context.Context, ws *wsConn, sshClient *ssh.Client, jail *pathJail, account transferAccount, msg wsMessage) error {
+	sftpClient, err := sshPool.SFTP(sshClient)
+	if err != nil {
+		return sendEditResult(ws, "read", msg, nil, err)
+	}
+	p, err := resolveJailedPath(sftpClient, jail, "read", msg.Path)
+	if err != nil {
+		return sendEditResult(ws, "read", msg, nil, err)
+	}
+	text, err := readRemoteText(ctx, sftpClient, p, account)
+	return sendEditResult(ws, "read", msg, text, err)
+}
+
+// handleFileWrite saves the editor's content and replies with a "write"
+// message carrying the new hash. Unless Force is set, the save is refused
+// when the file no longer matches msg.Hash; an empty Hash means the file is
+// expected not to exist yet. Saves count as uploads towards the user's
+// limits and quota.
+func handleFileWrite(ctx context.Context, ws *wsConn, sshClient *ssh.Client, jail *pathJail, account transferAccount, msg wsMessage) error {
+	sftpClient, err := sshPool.SFTP(sshClient)
+	if err != nil {
+		return sendEditResult(ws, "write", msg, nil, err)
+	}
+	p, err := resolveJailedPath(sftpClient, jail, "write", msg.Path)
+	if err != nil {
+		return sendEditResult(ws, "write", msg, nil, err)
+	}
+	text, err := writeRemoteText(ctx, sftpClient, p, []byte(msg.Payload), msg.Hash, msg.Force, account)
+	return sendEditResult(ws, "write", msg, text, err)
+}
+
+// sendEditResult replies to a read or write and returns err.
+func sendEditResult(ws *wsConn, msgType string, msg wsMessage, text *remoteText, err error) error {
+	result := map[string]interface{}{
+		"id":   msg.ID,
+		"path": msg.Path,
+		"ok":   err == nil,
+	}
+	if text != nil {
+		result["file"] = text
+	}
+	if err != nil {
+		result["error"] = err.Error()
+		var editErr *editError
+		if errors.As(err, &editErr) {
+			result["code"] = editErr.Code
+		}
+	}
+	sendJSON(ws, msgType, result)
+	return err
+}
+
+// resolveJailedPath checks p against jail. An empty path is passed through
+// for readRemoteText and writeRemoteText to reject.
+func resolveJailedPath(c *sftp.Client, jail *pathJail, action, p string) (string, error) {
+	if p == "" {
+		return p, nil
+	}
+	return jail.Resolve(c, action, p)
+}
+
+// resolveEditPath follows symlinks so that saving replaces the file they
+// point to rather than the link itself. Not every server's realpath
+// resolves links, so they are read one at a time.
+func resolveEditPath(c *sftp.Client, p string) (string, error) {
+	for range maxSymlinkDepth {
+		info, err := c.Lstat(p)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			return p, nil
+		}
+		target, err := c.ReadLink(p)
+		if err != nil {
+			return "", err
+		}
+		if !path.IsAbs(target) {
+			target = path.Join(path.Dir(p), target)
+		}
+		p = target
+	}
+	return "", fmt.Errorf("too many levels of symbolic links: %s", p)
+}
+
+func readRemoteText(ctx context.Context, c *sftp.Client, p string, account transferAccount) (*remoteText, error) {
+	if p == "" {
+		return nil, errors.New("path is required")
+	}
+	p, err := resolveEditPath(c, p)
+	if err != nil {
+		return nil, err
+	}
+	info, err := c.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("%s is a directory", p)
+	}
+	if info.Size() > maxEditSize {
+		return nil, &editError{editCodeTooLarge, fmt.Sprintf("file is larger than %d MiB", maxEditSize>>20)}
+	}
+	if err := checkTransferSize(account.userID, info.Size(), maxDownloadSize); err != nil {
+		return nil, err
+	}
+
+	quota := account.quota()
+	data, err := readRemoteFile(ctx, c, p, account.limiter(downloadDirection), quota)
+	quota.close()
+	if err != nil {
+		return nil, err
+	}
+	if !utf8.Valid(data) || bytes.IndexByte(data, 0) >= 0 {
+		return nil, &editError{editCodeBinary, "file is not a text file"}
+	}
+	return &remoteText{
+		Path:    p,
+		Content: string(data),
+		Size:    int64(len(data)),
+		ModTime: info.ModTime(),
+		Mode:    fmt.Sprintf("%04o", info.Mode().Perm()),
+		Hash:    hashContent(data),
+	}, nil
+}
+
+// readRemoteFile reads at most maxEditSize+1 bytes of p, paced by limiter
+// and charged to quota when the data goes to the browser.
+func readRemoteFile(ctx context.Context, c *sftp.Client, p string, limiter *bandwidthLimiter, quota *quotaMeter) ([]byte, error) {
+	f, err := c.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(&meteredReader{r: io.LimitReader(f, maxEditSize+1), ctx: ctx, limiter: limiter, quota: quota})
+}
+
+// writeRemoteText saves content through a temporary file renamed into place,
+// so readers never see a half-written file. The previous content is kept
+// next to it as path.bak, and mode and ownership are carried over.
+func writeRemoteText(ctx context.Context, c *sftp.Client, p string, content []byte, expectedHash string, force bool, account transferAccount) (*remoteText, error) {
+	if p == "" {
+		return nil, errors.New("path is required")
+	}
+	if len(content) > maxEditSize {
+		return nil, &editError{editCodeTooLarge, fmt.Sprintf("content is larger than %d MiB", maxEditSize>>20)}
+	}
+	if err := checkTransferSize(account.userID, int64(len(content)), maxUploadSize); err != nil {
+		return nil, err
+	}
+	p, err := resolveEditPath(c, p)
+	if err != nil {
+		return nil, err
+	}
+
+	mode := os.FileMode(0644)
+	var current []byte
+	var stat *sftp.FileStat
+	info, err := c.Stat(p)
+	switch {
+	case err == nil:
+		if info.IsDir() {
+			return nil, fmt.Errorf("%s is a directory", p)
+		}
+		mode = info.Mode().Perm()
+		stat, _ = info.Sys().(*sftp.FileStat)
+		// The previous content is kept as the backup, so a file too large
+		// to read whole cannot be replaced, even by a forced save.
+		if info.Size() > maxEditSize {
+			return nil, &editError{editCodeTooLarge, fmt.Sprintf("file on the server is larger than %d MiB", maxEditSize>>20)}
+		}
+		if current, err = readRemoteFile(ctx, c, p, nil, nil); err != nil {
+			return nil, err
+		}
+		if len(current) > maxEditSize {
+			return nil, &editError{editCodeTooLarge, fmt.Sprintf("file on the server is larger than %d MiB", maxEditSize>>20)}
+		}
+		if !force && hashContent(current) != expectedHash {
+			return nil, &editError{editCodeConflict, "file was changed on the server since it was opened"}
+		}
+	case errors.Is(err, os.ErrNotExist):
+		if !force && expectedHash != "" {
+			return nil, &editError{editCodeConflict, "file was deleted on the server since it was opened"}
+		}
+	default:
+		return nil, err
+	}
+
+	tmpPath := tempSiblingPath(p)
+	quota := account.quota()
+	defer quota.close()
+	if err := quota.charge(int64(len(content)), 0); err != nil {
+		return nil, err
+	}
+	if err := account.limiter(uploadDirection).wait(ctx, len(content)); err != nil {
+		return nil, err
+	}
+	err = writeRemoteFile(c, tmpPath, content, mode)
+	if err != nil {
+		c.Remove(tmpPath)
+		return nil, err
+	}
+	if stat != nil {
+		// Only root can give files away; other users keep their own.
+		c.Chown(tmpPath, int(stat.UID), int(stat.GID))
+	}
+
+	if current != nil {
+		if err := writeRemoteBackup(c, p, current, mode); err != nil {
+			c.Remove(tmpPath)
+			return nil, fmt.Errorf("failed to write backup: %w", err)
+		}
+	}
+	if err := replaceRemote(c, tmpPath, p); err != nil {
+		c.Remove(tmpPath)
+		return nil, err
+	}
+
+	text := &remoteText{
+		Path: p,
+		Size: int64(len(content)),
+		Mode: fmt.Sprintf("%04o", mode),
+		Hash: hashContent(content),
+	}
+	if info, err := c.Stat(p); err == nil {
+		text.ModTime = info.ModTime()
+	}
+	return text, nil
+}
+
+// tempSiblingPath returns a hidden, unused name next to p.
+func tempSiblingPath(p string) string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return path.Join(path.Dir(p), fmt.Sprintf(".%s.%x.tmp", path.Base(p), suffix))
+}
+
+// writeRemoteBackup saves content as p.bak. It is written to a new file and
+// renamed into place, which replaces whatever p.bak was, so a symlink left
+// there cannot send the backup to a file outside the user's roots.
+func writeRemoteBackup(c *sftp.Client, p string, content []byte, mode os.FileMode) error {
+	tmpPath := tempSiblingPath(p + ".bak")
+	if err := writeRemoteFile(c, tmpPath, content, mode); err != nil {
+		c.Remove(tmpPath)
+		return err
+	}
+	if err := replaceRemote(c, tmpPath, p+".bak"); err != nil {
+		c.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// writeRemoteFile creates p, which must not exist yet, with content.
+func writeRemoteFile(c *sftp.Client, p string, content []byte, mode os.FileMode) error {
+	f, err := c.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return c.Chmod(p, mode)
+}
+
+// replaceRemote renames src over dst. Servers without the posix-rename
+// extension refuse to rename onto an existing file, so dst is removed first
+// for them.
+func replaceRemote(c *sftp.Client, src, dst string) error {
+	if err := c.PosixRename(src, dst); err == nil {
+		return nil
+	}
+	if err := c.Remove(dst); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return c.Rename(src, dst)
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/sftp"
+)
+
+// What to do when an uploaded or extracted file already exists.
+const (
+	conflictOverwrite = "overwrite"
+	conflictSkip      = "skip"
+	conflictRename    = "rename"
+)
+
+func validConflictPolicy(policy string) bool {
+	switch policy {
+	case "", conflictOverwrite, conflictSkip, conflictRename:
+		return true
+	}
+	return false
+}
+
+// resolveConflict decides where a new file at p is written. It returns the
+// path to use and the outcome: "" if nothing was there, otherwise
+// "overwritten", "renamed" or "skipped" (in which case nothing is written).
+func resolveConflict(c *sftp.Client, p, policy string) (string, string, error) {
+	return resolveConflictWith(func(p string) (bool, error) {
+		_, err := c.Lstat(p)
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return err == nil, err
+	}, p, policy)
+}
+
+// resolveConflictWith is resolveConflict for any way of telling whether a
+// path exists.
+func resolveConflictWith(exists func(string) (bool, error), p, policy string) (string, string, error) {
+	found, err := exists(p)
+	if err != nil {
+		return "", "", err
+	}
+	if !found {
+		return p, "", nil
+	}
+	switch policy {
+	case conflictSkip:
+		return p, "skipped", nil
+	case conflictRename:
+		ext := path.Ext(p)
+		base := strings.TrimSuffix(p, ext)
+		for i := 1; i < 1000; i++ {
+			candidate := fmt.Sprintf("%s (%d)%s", base, i, ext)
+			if found, err := exists(candidate); err == nil && !found {
+				return candidate, "renamed", nil
+			}
+		}
+		return "", "", fmt.Errorf("no free name for %s", p)
+	}
+	return p, "overwritten", nil
+}
+
+// relativeUploadPath checks a path sent by the browser, such as
+// "photos/2024/a.jpg" from a folder upload, and returns it cleaned. It must
+// stay inside the upload directory.
+func relativeUploadPath(p string) (string, error) {
+	p = strings.ReplaceAll(p, "\\", "/")
+	if p == "" || strings.HasPrefix(p, "/") {
+		return "", fmt.Errorf("invalid path %q", p)
+	}
+	for _, part := range strings.Split(p, "/") {
+		if part == "" || part == "." || part == ".." {
+			return "", fmt.Errorf("invalid path %q", p)
+		}
+	}
+	return p, nil
+}
+
+func isArchiveName(name string) bool {
+	name = strings.ToLower(name)
+	for _, ext := range []string{".zip", ".tar", ".tar.gz", ".tgz"} {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// extractSummary reports what happened to each entry of an archive.
+type extractSummary struct {
+	Written     int      `json:"written"`
+	Overwritten int      `json:"overwritten"`
+	Skipped     int      `json:"skipped"`
+	Renamed     int      `json:"renamed"`
+	Errors      []string `json:"errors,omitempty"`
+}
+
+func (s *extractSummary) record(outcome string) {
+	switch outcome {
+	case "overwritten":
+		s.Overwritten++
+	case "renamed":
+		s.Renamed++
+	case "skipped":
+		s.Skipped++
+		return
+	}
+	s.Written++
+}
+
+// extractRemoteArchive unpacks a zip or tar archive that is already on the
+// remote host into destDir, reading and writing over SFTP so the host needs
+// no unzip or tar. Entries that would land outside destDir, or outside the
+// jail through a symlink already in destDir, are refused. When progress is
+// set it is called with each entry before it is written, and an error from
+// it stops the extraction.
+func extractRemoteArchive(c *sftp.Client, jail *pathJail, archivePath, name, destDir, policy string, progress func(name string) error, meter *streamMeter) (*extractSummary, error) {
+	f, err := c.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	summary := &extractSummary{}
+	x := &extractor{c: c, jail: jail, destDir: destDir, policy: policy, summary: summary, progress: progress, meter: meter}
+
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		info, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		err = x.zip(meter.readerAt(f), info.Size())
+		return summary, err
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		gz, err := gzip.NewReader(meter.reader(f))
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		return summary, x.tar(gz)
+	case strings.HasSuffix(lower, ".tar"):
+		return summary, x.tar(meter.reader(f))
+	}
+	return nil, fmt.Errorf("unsupported archive %s", name)
+}
+
+type extractor struct {
+	c        *sftp.Client
+	jail     *pathJail
+	destDir  string
+	policy   string
+	summary  *extractSummary
+	progress func(name string) error
+	// meter, if set, charges what is read and written; stopped is the
+	// limit that ended the extraction.
+	meter   *streamMeter
+	stopped error
+}
+
+func (x *extractor) zip(r io.ReaderAt, size int64) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+	for _, entry := range zr.File {
+		if err := x.report(entry.Name); err != nil {
+			return err
+		}
+		if entry.FileInfo().IsDir() {
+			x.dir(entry.Name)
+			continue
+		}
+		if !entry.Mode().IsRegular() {
+			continue
+		}
+		rc, err := entry.Open()
+		if err != nil {
+			x.fail(entry.Name, err)
+			continue
+		}
+		x.file(entry.Name, rc, entry.Mode().Perm())
+		rc.Close()
+	}
+	return nil
+}
+
+func (x *extractor) tar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := x.report(header.Name); err != nil {
+			return err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			x.dir(header.Name)
+		case tar.TypeReg:
+			x.file(header.Name, tr, os.FileMode(header.Mode).Perm())
+		}
+	}
+}
+
+func (x *extractor) report(name string) error {
+	if x.stopped != nil {
+		return x.stopped
+	}
+	if x.progress == nil {
+		return nil
+	}
+	return x.progress(name)
+}
+
+// target maps an archive entry name to its remote path.
+func (x *extractor) target(name string) (string, error) {
+	rel, err := relativeUploadPath(strings.TrimSuffix(strings.TrimPrefix(name, "./"), "/"))
+	if err != nil {
+		return "", err
+	}
+	return x.jail.Resolve(x.c, "extract", path.Join(x.destDir, rel))
+}
+
+func (x *extractor) dir(name string) {
+	p, err := x.target(name)
+	if err == nil {
+		err = x.c.MkdirAll(p)
+	}
+	if err != nil {
+		x.fail(name, err)
+	}
+}
+
+func (x *extractor) file(name string, r io.Reader, mode os.FileMode) {
+	p, err := x.target(name)
+	if err != nil {
+		x.fail(name, err)
+		return
+	}
+	if err := x.c.MkdirAll(path.Dir(p)); err != nil {
+		x.fail(name, err)
+		return
+	}
+	p, outcome, err := resolveConflict(x.c, p, x.policy)
+	if err != nil {
+		x.fail(name, err)
+		return
+	}
+	if outcome == "skipped" {
+		x.summary.record(outcome)
+		return
+	}
+
+	out, err := x.c.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		x.fail(name, err)
+		return
+	}
+	_, err = io.Copy(x.meter.writer(out), r)
+	if limitError(err) {
+		x.stopped = err
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && mode != 0 {
+		err = x.c.Chmod(p, mode)
+	}
+	if err != nil {
+		x.fail(name, err)
+		return
+	}
+	x.summary.record(outcome)
+}
+
+func (x *extractor) fail(name string, err error) {
+	x.summary.Errors = append(x.summary.Errors, fmt.Sprintf("%s: %v", name, err))
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// errConfirmRequired is returned when deleting a non-empty directory
+// without the recursive flag; the browser asks the user and retries.
+var errConfirmRequired = errors.New("directory is not empty")
+
+// fileOperations maps WebSocket message types to remote file operations.
+// "copy", which can take long, runs as a queued job through
+// handleFileCopy instead.
+var fileOperations = map[string]func(*sftp.Client, wsMessage) error{
+	"rename":  renameRemote,
+	"delete":  deleteRemote,
+	"mkdir":   mkdirRemote,
+	"chmod":   chmodRemote,
+	"chown":   chownRemote,
+	"symlink": symlinkRemote,
+}
+
+// handleFileOperation runs one file operation and reports its outcome in a
+// "fileop" message that echoes the request's id, op and paths.
+func handleFileOperation(ws *wsConn, sshClient *ssh.Client, jail *pathJail, msg wsMessage) {
+	runFileOperation(ws, sshClient, jail, msg, fileOperations[msg.Type])
+}
+
+// handleFileCopy copies msg.Path to msg.Target as a queued job, reporting
+// progress to t, and replies like handleFileOperation.
+func handleFileCopy(ctx context.Context, t *transfer, ws *wsConn, sshClient *ssh.Client, jail *pathJail, msg wsMessage) error {
+	return runFileOperation(ws, sshClient, jail, msg, func(c *sftp.Client, msg wsMessage) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return copyRemote(ctx, t, c, msg)
+	})
+}
+
+func runFileOperation(ws *wsConn, sshClient *ssh.Client, jail *pathJail, msg wsMessage, op func(*sftp.Client, wsMessage) error) error {
+	result := map[string]interface{}{
+		"id":     msg.ID,
+		"op":     msg.Type,
+		"path":   msg.Path,
+		"target": msg.Target,
+		"ok":     false,
+	}
+
+	sftpClient, err := sshPool.SFTP(sshClient)
+	if err == nil {
+		if msg.Path == "" {
+			err = errors.New("path is required")
+		} else if msg, err = confineFileOperation(sftpClient, jail, msg); err == nil {
+			err = op(sftpClient, msg)
+		}
+	}
+	if err != nil {
+		result["error"] = err.Error()
+		if errors.Is(err, errConfirmRequired) {
+			result["code"] = "confirm_required"
+		}
+	} else {
+		result["ok"] = true
+	}
+	sendJSON(ws, "fileop", result)
+	return err
+}
+
+// confineFileOperation checks the paths of msg against jail and returns msg
+// with them cleaned. Operations on a directory entry itself, such as
+// deleting a symlink, only need the entry's directory to be allowed.
+func confineFileOperation(c *sftp.Client, jail *pathJail, msg wsMessage) (wsMessage, error) {
+	var err error
+	switch msg.Type {
+	case "rename", "delete":
+		if msg.Path, err = jail.ResolveEntry(c, msg.Type, msg.Path); err != nil {
+			return msg, err
+		}
+	case "symlink":
+		// Path is the link's content, which is checked whenever the link
+		// is followed, not a location that is written.
+	default:
+		if msg.Path, err = jail.Resolve(c, msg.Type, msg.Path); err != nil {
+			return msg, err
+		}
+	}
+	if msg.Target != "" {
+		switch msg.Type {
+		case "rename", "symlink":
+			msg.Target, err = jail.ResolveEntry(c, msg.Type, msg.Target)
+		default:
+			msg.Target, err = jail.Resolve(c, msg.Type, msg.Target)
+		}
+	}
+	return msg, err
+}
+
+func renameRemote(c *sftp.Client, msg wsMessage) error {
+	if msg.Target == "" {
+		return errors.New("target is required")
+	}
+	// Prefer the OpenSSH extension, which replaces an existing target like
+	// mv does; plain SFTP rename refuses to.
+	if err := c.PosixRename(msg.Path, msg.Target); err == nil {
+		return nil
+	}
+	return c.Rename(msg.Path, msg.Target)
+}
+
+func deleteRemote(c *sftp.Client, msg wsMessage) error {
+	info, err := c.Lstat(msg.Path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return c.Remove(msg.Path)
+	}
+	if !msg.Recursive {
+		entries, err := c.ReadDir(msg.Path)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			return fmt.Errorf("%s: %w", msg.Path, errConfirmRequired)
+		}
+		return c.RemoveDirectory(msg.Path)
+	}
+	return removeAllRemote(c, msg.Path)
+}
+
+// removeAllRemote deletes a tree without following symlinks, unlike
+// sftp.Client.RemoveAll which would descend into a linked directory.
+func removeAllRemote(c *sftp.Client, p string) error {
+	info, err := c.Lstat(p)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		entries, err := c.ReadDir(p)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := removeAllRemote(c, path.Join(p, entry.Name())); err != nil {
+				return err
+			}
+		}
+		return c.RemoveDirectory(p)
+	}
+	return c.Remove(p)
+}
+
+func mkdirRemote(c *sftp.Client, msg wsMessage) error {
+	return c.MkdirAll(msg.Path)
+}
+
+func chmodRemote(c *sftp.Client, msg wsMessage) error {
+	mode, err := strconv.ParseUint(msg.Mode, 8, 32)
+	if err != nil || mode > 07777 {
+		return fmt.Errorf("invalid mode %q", msg.Mode)
+	}
+	return c.Chmod(msg.Path, os.FileMode(mode))
+}
+
+func chownRemote(c *sftp.Client, msg wsMessage) error {
+	if msg.UID == nil && msg.GID == nil {
+		return errors.New("uid or gid is required")
+	}
+	// SFTP sets both at once, so keep whichever was not given.
+	uid, gid := -1, -1
+	if msg.UID != nil {
+		uid = *msg.UID
+	}
+	if msg.GID != nil {
+		gid = *msg.GID
+	}
+	if uid < 0 || gid < 0 {
+		info, err := c.Lstat(msg.Path)
+		if err != nil {
+			return err
+		}
+		stat, ok := info.Sys().(*sftp.FileStat)
+		if !ok {
+			return errors.New("server did not report current owner")
+		}
+		if uid < 0 {
+			uid = int(stat.UID)
+		}
+		if gid < 0 {
+			gid = int(stat.GID)
+		}
+	}
+	return c.Chown(msg.Path, uid, gid)
+}
+
+// symlinkRemote creates a link at Target pointing to Path.
+func symlinkRemote(c *sftp.Client, msg wsMessage) error {
+	if msg.Target == "" {
+		return errors.New("target is required")
+	}
+	return c.Symlink(msg.Path, msg.Target)
+}
+
+// copyRemote copies Path to Target through this server, since SFTP has no
+// server-side copy. Directories are copied recursively and modes are kept.
+// Copied bytes and files are counted in t.
+func copyRemote(ctx context.Context, t *transfer, c *sftp.Client, msg wsMessage) error {
+	if msg.Target == "" {
+		return errors.New("target is required")
+	}
+	src, dst := path.Clean(msg.Path), path.Clean(msg.Target)
+	if dst == src {
+		return errors.New("source and target are the same")
+	}
+	if strings.HasPrefix(dst, strings.TrimSuffix(src, "/")+"/") {
+		return errors.New("cannot copy a directory into itself")
+	}
+	info, err := c.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if err := t.measure(c, src, info); err != nil {
+		return err
+	}
+	t.notify()
+	return copyRemoteTree(ctx, t, c, msg.Path, msg.Target)
+}
+
+func copyRemoteTree(ctx context.Context, t *transfer, c *sftp.Client, src, dst string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	info, err := c.Lstat(src)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := c.ReadLink(src)
+		if err != nil {
+			return err
+		}
+		if err := c.Symlink(target, dst); err != nil {
+			return err
+		}
+		t.update(func(t *transfer) { t.FilesDone++ })
+		return nil
+	case info.IsDir():
+		if err := c.Mkdir(dst); err != nil {
+			return err
+		}
+		entries, err := c.ReadDir(src)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := copyRemoteTree(ctx, t, c, path.Join(src, entry.Name()), path.Join(dst, entry.Name())); err != nil {
+				return err
+			}
+		}
+		return c.Chmod(dst, info.Mode().Perm())
+	case !info.Mode().IsRegular():
+		// Devices, sockets and pipes cannot be copied over SFTP.
+		return nil
+	default:
+		return copyRemoteFile(ctx, t, c, src, dst, info.Mode().Perm())
+	}
+}
+
+func copyRemoteFile(ctx context.Context, t *transfer, c *sftp.Client, src, dst string, mode os.FileMode) error {
+	t.update(func(t *transfer) { t.Current = src })
+	in, err := c.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := c.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return err
+	}
+	// The data passes through this server both ways, as in copyFile.
+	quota := t.account.quota()
+	_, err = io.Copy(out, &transferReader{ctx: ctx, r: in, t: t, limiter: t.account.limiter(downloadDirection), quota: quota, direction: bothDirections})
+	quota.close()
+	if err != nil {
+		out.Close()
+		// Don't leave a truncated copy behind.
+		c.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	t.update(func(t *transfer) { t.FilesDone++ })
+	return c.Chmod(dst, mode)
+}
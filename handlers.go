@@ -4,6 +4,11 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/ssh"
 )
 
 func handleRoot(w http.ResponseWriter, r *http.Request) {
@@ -48,6 +53,14 @@ func handleConnections(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Invalid request", http.StatusBadRequest)
 			return
 		}
+		if err := validateAlgorithms(&conn); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(conn.StartupCommand) > maxStartupCommand {
+			http.Error(w, "Startup command is too long", http.StatusBadRequest)
+			return
+		}
 
 		// Encrypt sensitive information
 		encryptedPassword, err := encrypt([]byte(conn.Password))
@@ -61,13 +74,92 @@ func handleConnections(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		if err := createConnectionDB(user.ID, conn.Name, conn.Host, conn.User, hex.EncodeToString(encryptedPassword), hex.EncodeToString(encryptedKey)); err != nil {
+		conn.Password = hex.EncodeToString(encryptedPassword)
+		conn.Key = hex.EncodeToString(encryptedKey)
+		if err := createConnectionDB(user.ID, &conn); err != nil {
 			http.Error(w, "Failed to create connection", http.StatusInternalServerError)
 			return
 		}
 
 		w.WriteHeader(http.StatusCreated)
 
+	case http.MethodPatch:
+		connID := r.URL.Query().Get("id")
+		if connID == "" {
+			http.Error(w, "Connection ID required", http.StatusBadRequest)
+			return
+		}
+
+		var update struct {
+			DisableHealthCheck *bool     `json:"disable_health_check"`
+			AlgorithmPreset    *string   `json:"algorithm_preset"`
+			KeyExchanges       *[]string `json:"key_exchanges"`
+			Ciphers            *[]string `json:"ciphers"`
+			MACs               *[]string `json:"macs"`
+			HostKeyAlgorithms  *[]string `json:"host_key_algorithms"`
+			StartupCommand     *string   `json:"startup_command"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		if update.AlgorithmPreset != nil || update.KeyExchanges != nil || update.Ciphers != nil || update.MACs != nil || update.HostKeyAlgorithms != nil {
+			conn, err := getConnectionByIDDB(user.ID, connID)
+			if err != nil {
+				http.Error(w, "Connection not found", http.StatusNotFound)
+				return
+			}
+			if update.AlgorithmPreset != nil {
+				conn.AlgorithmPreset = *update.AlgorithmPreset
+			}
+			if update.KeyExchanges != nil {
+				conn.KeyExchanges = *update.KeyExchanges
+			}
+			if update.Ciphers != nil {
+				conn.Ciphers = *update.Ciphers
+			}
+			if update.MACs != nil {
+				conn.MACs = *update.MACs
+			}
+			if update.HostKeyAlgorithms != nil {
+				conn.HostKeyAlgorithms = *update.HostKeyAlgorithms
+			}
+			if err := validateAlgorithms(conn); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := updateConnectionAlgorithmsDB(user.ID, conn); err != nil {
+				http.Error(w, "Failed to update connection", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if update.DisableHealthCheck != nil {
+			if err := setConnectionHealthCheckDB(user.ID, connID, *update.DisableHealthCheck); err != nil {
+				http.Error(w, "Failed to update connection", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if update.StartupCommand != nil {
+			if len(*update.StartupCommand) > maxStartupCommand {
+				http.Error(w, "Startup command is too long", http.StatusBadRequest)
+				return
+			}
+			if err := setConnectionStartupCommandDB(user.ID, connID, *update.StartupCommand); err != nil {
+				http.Error(w, "Failed to update connection", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		// New tabs should pick up the changed settings.
+		if id, err := strconv.Atoi(connID); err == nil {
+			sshPool.Evict(user.ID, id)
+		}
+
+		w.WriteHeader(http.StatusOK)
+
 	case http.MethodDelete:
 		connID := r.URL.Query().Get("id")
 		if connID == "" {
@@ -79,6 +171,9 @@ func handleConnections(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Failed to delete connection", http.StatusInternalServerError)
 			return
 		}
+		if id, err := strconv.Atoi(connID); err == nil {
+			sshPool.Evict(user.ID, id)
+		}
 
 		w.WriteHeader(http.StatusOK)
 
@@ -87,13 +182,75 @@ func handleConnections(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleConnectionTest dials a saved connection and authenticates, then
+// reports the server version and the algorithms that were negotiated.
+func handleConnectionTest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := getUserByUsernameDB(getSessionUser(r))
+	if err != nil || user == nil {
+		http.Error(w, "User not found", http.StatusInternalServerError)
+		return
+	}
+
+	conn, err := getConnectionByIDDB(user.ID, r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Connection not found", http.StatusNotFound)
+		return
+	}
+
+	result := map[string]interface{}{"success": false}
+	start := time.Now()
+	client, err := dialSSH(conn)
+	if err != nil {
+		result["error"] = err.Error()
+	} else {
+		result["success"] = true
+		result["latency_ms"] = time.Since(start).Milliseconds()
+		result["server_version"] = string(client.ServerVersion())
+		result["algorithms"] = negotiatedAlgorithms(client)
+		client.Close()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// handleAlgorithms lists the algorithm presets and every algorithm name a
+// connection may select, for building the connection form.
+func handleAlgorithms(w http.ResponseWriter, r *http.Request) {
+	legacy := legacyAlgorithms()
+	insecure := ssh.InsecureAlgorithms()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"presets":             []string{algorithmPresetModern, algorithmPresetLegacy},
+		"key_exchanges":       legacy.KeyExchanges,
+		"ciphers":             legacy.Ciphers,
+		"macs":                legacy.MACs,
+		"host_key_algorithms": legacy.HostKeys,
+		"insecure":            slices.Concat(insecure.KeyExchanges, insecure.Ciphers, insecure.MACs, insecure.HostKeys),
+	})
+}
+
 func handleFeatures(w http.ResponseWriter, r *http.Request) {
 	features := map[string]bool{
 		"download":    !disableDownload && !disableFileBrowser,
 		"fileBrowser": !disableFileBrowser,
+		"healthCheck": healthInterval > 0,
+		"twoFactor":   !noAuth,
+	}
+	if user, err := getUserByUsernameDB(getSessionUser(r)); err == nil && user != nil {
+		features["filesOnly"] = user.FilesOnly
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(features)
 }
 
-
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -3,9 +3,11 @@ package main
 import (
 	"encoding/json"
 	"html/template"
+	"log"
 	"net/http"
+	"strconv"
 	"strings"
-	// "time" // No longer needed here
+	"time"
 )
 
 // handleAdmin is a lightweight handler for checking admin permissions.
@@ -43,6 +45,18 @@ func handleAdminPage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	auditEvents, err := getAuditEventsDB(200)
+	if err != nil {
+		http.Error(w, "Failed to load audit log", http.StatusInternalServerError)
+		return
+	}
+
+	usage, err := getTransferUsageSinceDB(usageDay(time.Now().AddDate(0, 0, -6)))
+	if err != nil {
+		http.Error(w, "Failed to load transfer usage", http.StatusInternalServerError)
+		return
+	}
+
 	const tmpl = `
 <!DOCTYPE html>
 <html lang="en">
@@ -292,6 +306,7 @@ func handleAdminPage(w http.ResponseWriter, r *http.Request) {
         .btn-danger { background-color: #dc3545; color: white; }
         .btn-warning { background-color: #ffc107; color: #212529; }
         .btn-info { background-color: #17a2b8; color: white; }
+        .btn-secondary { background-color: #6c757d; color: white; }
 
         #toast {
             position: fixed;
@@ -330,6 +345,15 @@ func handleAdminPage(w http.ResponseWriter, r *http.Request) {
                     <button class="tab-button" data-action="showTab" data-username="users">
                         User Management
                     </button>
+                    <button class="tab-button" data-action="showTab" data-username="audit">
+                        Audit Log
+                    </button>
+                    <button class="tab-button" data-action="showTab" data-username="usage">
+                        Transfer Usage
+                    </button>
+                    <button class="tab-button" data-action="showTab" data-username="security">
+                        Security
+                    </button>
                 </div>
                 
                 <div id="pending" class="tab-content">
@@ -429,6 +453,8 @@ func handleAdminPage(w http.ResponseWriter, r *http.Request) {
                     {{else}}
                         User
                     {{end}}
+                    {{if .FilesOnly}}(files only){{end}}
+                    {{if .TOTPEnabled}}(2FA){{end}}
                 </td>
                 <td>
                     {{if not .IsApproved}}
@@ -439,6 +465,15 @@ func handleAdminPage(w http.ResponseWriter, r *http.Request) {
                     {{else}}
                         <button class="btn btn-info btn-sm" data-action="makeAdmin" data-username="{{.Username}}">Make Admin</button>
                     {{end}}
+                    {{if .FilesOnly}}
+                        <button class="btn btn-info btn-sm" data-action="allowShell" data-username="{{.Username}}">Allow Shell</button>
+                    {{else}}
+                        <button class="btn btn-warning btn-sm" data-action="restrictToFiles" data-username="{{.Username}}" title="Only allow file-only sessions, without a shell">Files Only</button>
+                    {{end}}
+                    {{if .TOTPEnabled}}
+                        <button class="btn btn-warning btn-sm" data-action="resetTwoFactor" data-username="{{.Username}}" title="For users who lost their authenticator app and recovery codes">Reset 2FA</button>
+                    {{end}}
+                    <button class="btn btn-secondary btn-sm" data-action="editRoots" data-username="{{.Username}}" title="{{if .AllowedRoots}}Allowed: {{join .AllowedRoots ", "}}{{else}}Unrestricted{{end}}">File Roots</button>
                     <button class="btn btn-danger btn-sm" data-action="deleteUser" data-username="{{.Username}}">Delete</button>
                 </td>
             </tr>
@@ -448,6 +483,74 @@ func handleAdminPage(w http.ResponseWriter, r *http.Request) {
                         </table>
                     </div>
                 </div>
+
+                <div id="audit" class="tab-content" style="display: none;">
+                    <h2>Audit Log</h2>
+                    <p>File operations refused because they left the user's or connection's allowed roots.</p>
+                    <table class="user-table">
+                        <thead>
+                            <tr>
+                                <th>Time</th>
+                                <th>User</th>
+                                <th>Connection</th>
+                                <th>Action</th>
+                                <th>Detail</th>
+                            </tr>
+                        </thead>
+                        <tbody>
+                            {{range .AuditEvents}}
+            <tr>
+                <td>{{.CreatedAt.Format "Jan 02, 2006 15:04:05"}}</td>
+                <td>{{.Username}}</td>
+                <td>{{.ConnectionID}}</td>
+                <td>{{.Action}}</td>
+                <td>{{.Detail}}</td>
+            </tr>
+                            {{else}}
+            <tr><td colspan="5">No events.</td></tr>
+                            {{end}}
+                        </tbody>
+                    </table>
+                </div>
+
+                <div id="usage" class="tab-content" style="display: none;">
+                    <h2>Transfer Usage</h2>
+                    <p>Bytes uploaded and downloaded through the file browser over the last 7 days.{{if .Quota}} Daily quota: {{size .Quota}} per user.{{end}}</p>
+                    <table class="user-table">
+                        <thead>
+                            <tr>
+                                <th>Day</th>
+                                <th>User</th>
+                                <th>Uploaded</th>
+                                <th>Downloaded</th>
+                            </tr>
+                        </thead>
+                        <tbody>
+                            {{range .Usage}}
+            <tr>
+                <td>{{.Day}}</td>
+                <td>{{.Username}}</td>
+                <td>{{size .Uploaded}}</td>
+                <td>{{size .Downloaded}}</td>
+            </tr>
+                            {{else}}
+            <tr><td colspan="4">No transfers.</td></tr>
+                            {{end}}
+                        </tbody>
+                    </table>
+                </div>
+
+                <div id="security" class="tab-content" style="display: none;">
+                    <h2>Security</h2>
+                    <p>Users who must use two-factor authentication set it up the next time they log in. Sessions already open stay valid until they expire.</p>
+                    <label for="two-factor-policy">Require two-factor authentication for</label>
+                    <select id="two-factor-policy">
+                        <option value="off"{{if eq .TwoFactorPolicy "off"}} selected{{end}}>Nobody</option>
+                        <option value="admins"{{if eq .TwoFactorPolicy "admins"}} selected{{end}}>Admins</option>
+                        <option value="all"{{if eq .TwoFactorPolicy "all"}} selected{{end}}>All users</option>
+                    </select>
+                    <button class="btn btn-success btn-sm" data-action="saveTwoFactorPolicy" data-username="">Save</button>
+                </div>
             </div>
         </main>
     </div>
@@ -458,7 +561,7 @@ func handleAdminPage(w http.ResponseWriter, r *http.Request) {
 
 	// Combine templates
 	fullTmpl := tmpl + pendingUsersTmpl + tmplPart2 + allUsersTmpl + tmplPart3
-	t, err := template.New("admin").Parse(fullTmpl)
+	t, err := template.New("admin").Funcs(template.FuncMap{"join": strings.Join, "size": formatByteSize}).Parse(fullTmpl)
 	if err != nil {
 		http.Error(w, "Failed to parse admin template", http.StatusInternalServerError)
 		return
@@ -467,11 +570,20 @@ func handleAdminPage(w http.ResponseWriter, r *http.Request) {
 	data := struct {
 		PendingUsers []User
 		AllUsers     []User
-		Script       template.JS
+		AuditEvents  []AuditEvent
+		Usage        []TransferUsage
+		Quota        int64
+		// TwoFactorPolicy is who must use two-factor authentication.
+		TwoFactorPolicy string
+		Script          template.JS
 	}{
-		PendingUsers: pendingUsers,
-		AllUsers:     allUsers,
-		Script:       template.JS(adminGetMessageScript()),
+		PendingUsers:    pendingUsers,
+		AllUsers:        allUsers,
+		AuditEvents:     auditEvents,
+		Usage:           usage,
+		Quota:           int64(dailyTransferQuota),
+		TwoFactorPolicy: twoFactorPolicy(),
+		Script:          template.JS(adminGetMessageScript()),
 	}
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -531,6 +643,19 @@ func handleAdminUsers(w http.ResponseWriter, r *http.Request) {
 	username := strings.TrimPrefix(r.URL.Path, "/api/admin/users/")
 
 	switch r.Method {
+	case http.MethodGet: // User details, including file browser roots
+		user, err := getUserByUsernameDB(username)
+		if err != nil || user == nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		connections, err := getUserConnectionsDB(user.ID)
+		if err != nil {
+			http.Error(w, "Failed to load connections", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"user": user, "connections": connections})
+
 	case http.MethodPost: // Create user
 		var req struct {
 			Username   string `json:"username"`
@@ -559,7 +684,11 @@ func handleAdminUsers(w http.ResponseWriter, r *http.Request) {
 
 	case http.MethodPatch: // Update user (e.g., admin status)
 		var req struct {
-			Action string `json:"action"` // "make_admin", "revoke_admin", "approve"
+			Action string `json:"action"` // "make_admin", "revoke_admin", "approve", "set_roots", "files_only", "allow_shell", "reset_2fa"
+			// set_roots confines the user's file browser, or only that of
+			// ConnectionID if it is given. An empty list lifts the limit.
+			Roots        []string `json:"roots"`
+			ConnectionID string   `json:"connection_id"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			http.Error(w, "Invalid request body", http.StatusBadRequest)
@@ -580,6 +709,33 @@ func handleAdminUsers(w http.ResponseWriter, r *http.Request) {
 			loadUsersIntoMemory()
 			w.WriteHeader(http.StatusOK)
 			return
+		case "set_roots":
+			setAllowedRoots(w, username, req.ConnectionID, req.Roots)
+			return
+		case "files_only", "allow_shell":
+			if err := updateUserFilesOnlyDB(username, req.Action == "files_only"); err != nil {
+				http.Error(w, "Failed to update user", http.StatusInternalServerError)
+				return
+			}
+			loadUsersIntoMemory()
+			w.WriteHeader(http.StatusOK)
+			return
+		case "reset_2fa":
+			// For users who lost both their app and their recovery
+			// codes. They enroll again at their next login if the
+			// policy requires it.
+			user, err := getUserByUsernameDB(username)
+			if err != nil || user == nil {
+				http.Error(w, "User not found", http.StatusNotFound)
+				return
+			}
+			if err := disableTOTPDB(user.ID); err != nil {
+				http.Error(w, "Failed to reset two-factor authentication", http.StatusInternalServerError)
+				return
+			}
+			log.Printf("Admin %s reset two-factor authentication for user %s", currentUser.Username, username)
+			w.WriteHeader(http.StatusOK)
+			return
 		default:
 			http.Error(w, "Invalid action", http.StatusBadRequest)
 			return
@@ -597,6 +753,126 @@ func handleAdminUsers(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func setAllowedRoots(w http.ResponseWriter, username, connID string, roots []string) {
+	roots, err := parseAllowedRoots(roots)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	user, err := getUserByUsernameDB(username)
+	if err != nil || user == nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if connID == "" {
+		err = updateUserAllowedRootsDB(username, roots)
+	} else {
+		err = updateConnectionAllowedRootsDB(user.ID, connID, roots)
+	}
+	if err != nil {
+		http.Error(w, "Failed to update allowed roots: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	loadUsersIntoMemory()
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleAdminSettings reads and changes server-wide settings.
+//
+//	GET /api/admin/settings
+//	PUT /api/admin/settings {"require_2fa": "off" | "admins" | "all"}
+func handleAdminSettings(w http.ResponseWriter, r *http.Request) {
+	currentUser, err := getUserByUsernameDB(getSessionUser(r))
+	if err != nil || !currentUser.IsAdmin {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req struct {
+			Require2FA string `json:"require_2fa"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if !validTwoFactorPolicy(req.Require2FA) {
+			http.Error(w, "require_2fa must be off, admins or all", http.StatusBadRequest)
+			return
+		}
+		if err := setSettingDB(twoFactorSetting, req.Require2FA); err != nil {
+			http.Error(w, "Failed to save settings", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Admin %s set the two-factor policy to %s", currentUser.Username, req.Require2FA)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{twoFactorSetting: twoFactorPolicy()})
+}
+
+// handleAdminAudit lists recent audit events, such as file operations
+// refused because they left the allowed roots.
+//
+//	GET /api/admin/audit?limit=N
+func handleAdminAudit(w http.ResponseWriter, r *http.Request) {
+	currentUser, err := getUserByUsernameDB(getSessionUser(r))
+	if err != nil || !currentUser.IsAdmin {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit <= 0 || limit > 1000 {
+		limit = 200
+	}
+	events, err := getAuditEventsDB(limit)
+	if err != nil {
+		http.Error(w, "Failed to load audit log", http.StatusInternalServerError)
+		return
+	}
+	if events == nil {
+		events = []AuditEvent{}
+	}
+	writeJSON(w, http.StatusOK, events)
+}
+
+// handleAdminUsage lists every user's transfer usage per day, newest first.
+//
+//	GET /api/admin/usage?days=N
+func handleAdminUsage(w http.ResponseWriter, r *http.Request) {
+	currentUser, err := getUserByUsernameDB(getSessionUser(r))
+	if err != nil || !currentUser.IsAdmin {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	days, _ := strconv.Atoi(r.URL.Query().Get("days"))
+	if days <= 0 || days > 366 {
+		days = 30
+	}
+	usage, err := getTransferUsageSinceDB(usageDay(time.Now().AddDate(0, 0, 1-days)))
+	if err != nil {
+		http.Error(w, "Failed to load transfer usage", http.StatusInternalServerError)
+		return
+	}
+	if usage == nil {
+		usage = []TransferUsage{}
+	}
+	writeJSON(w, http.StatusOK, usage)
+}
+
 func adminGetMessageScript() string {
 	scriptContent := `
 <script>
@@ -649,6 +925,51 @@ func adminGetMessageScript() string {
         window.handleAdminAction('/api/admin/users/' + username, 'PATCH', { action: 'revoke_admin' }, 'Admin status revoked!');
     }
 
+    window.restrictToFiles = function(username) {
+        window.handleAdminAction('/api/admin/users/' + username, 'PATCH', { action: 'files_only' }, 'User limited to file-only sessions!');
+    }
+
+    window.allowShell = function(username) {
+        window.handleAdminAction('/api/admin/users/' + username, 'PATCH', { action: 'allow_shell' }, 'Shell access allowed!');
+    }
+
+    window.resetTwoFactor = function(username) {
+        if (!confirm('Turn off two-factor authentication for ' + username + '? Their recovery codes are deleted too.')) return;
+        window.handleAdminAction('/api/admin/users/' + username, 'PATCH', { action: 'reset_2fa' }, 'Two-factor authentication reset!');
+    }
+
+    window.saveTwoFactorPolicy = function() {
+        const policy = document.getElementById('two-factor-policy').value;
+        window.handleAdminAction('/api/admin/settings', 'PUT', { require_2fa: policy }, 'Two-factor policy saved!');
+    }
+
+    // editRoots sets the directories a user's file browser is confined to,
+    // either for all of their connections or for one of them.
+    window.editRoots = async function(username) {
+        const response = await fetch('/api/admin/users/' + username);
+        if (!response.ok) {
+            window.showToast('Error: ' + await response.text());
+            return;
+        }
+        const info = await response.json();
+        const connections = info.connections || [];
+        let choices = '(empty) All connections: ' + ((info.user.allowed_roots || []).join(', ') || 'unrestricted');
+        connections.forEach(c => {
+            choices += '\n' + c.id + ': ' + c.name + ' (' + c.user + '@' + c.host + '): ' + ((c.allowed_roots || []).join(', ') || 'unrestricted');
+        });
+        const connectionId = prompt('Restrict which connection of ' + username + '? Leave empty for all of them.\n' + choices, '');
+        if (connectionId === null) return;
+        const id = connectionId.split(':')[0].trim();
+        const current = id ? ((connections.find(c => String(c.id) === id) || {}).allowed_roots || []) : (info.user.allowed_roots || []);
+        const roots = prompt('Allowed directories, comma-separated. Leave empty to lift the restriction.', current.join(', '));
+        if (roots === null) return;
+        window.handleAdminAction('/api/admin/users/' + username, 'PATCH', {
+            action: 'set_roots',
+            connection_id: id,
+            roots: roots.split(',').map(r => r.trim()).filter(r => r)
+        }, 'File roots updated!');
+    }
+
     // Attach event listener only if the form exists
     const createUserForm = document.getElementById('create-user-form');
     if (createUserForm) {
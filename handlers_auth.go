@@ -1,9 +1,13 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
 	"log"
 	"net/http"
+	"time"
 )
 
 func handleLogin(w http.ResponseWriter, r *http.Request) {
@@ -50,24 +54,395 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		sessionID, err := createSession(username)
+		// Users with two-factor authentication, or who must set it up,
+		// only get a pre-auth token for the second step.
+		if user.TOTPEnabled || twoFactorRequired(user) {
+			token, err := createPreAuth(username)
+			if err != nil {
+				log.Printf("Failed to start second login step for user %s: %v", username, err)
+				http.Redirect(w, r, "/login?error=Internal error", http.StatusFound)
+				return
+			}
+			http.SetCookie(w, &http.Cookie{
+				Name:     preAuthCookieName,
+				Value:    token,
+				Path:     "/login",
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				MaxAge:   int(preAuthTTL.Seconds()),
+			})
+			http.Redirect(w, r, "/login/2fa", http.StatusFound)
+			return
+		}
+
+		if !startSession(w, r, username) {
+			return
+		}
+		http.Redirect(w, r, "/", http.StatusFound)
+	}
+}
+
+// startSession logs username in. On failure it redirects back to the login
+// page and returns false.
+func startSession(w http.ResponseWriter, r *http.Request, username string) bool {
+	sessionID, err := createSession(username)
+	if err != nil {
+		log.Printf("Failed to create session for user %s: %v", username, err)
+		http.Redirect(w, r, "/login?error=Internal error", http.StatusFound)
+		return false
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    sessionID,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		MaxAge:   86400, // 24 hours
+	})
+
+	log.Printf("User %s logged in successfully", username)
+	return true
+}
+
+// handleLoginSecondFactor is the second step of logging in, reached with the
+// pre-auth token set once the password was accepted. Enrolled users enter a
+// code from their authenticator app or a recovery code. Users whom the
+// admin's policy requires to use two-factor authentication, but who have
+// not set it up, enroll here first.
+//
+//	GET, POST /login/2fa
+func handleLoginSecondFactor(w http.ResponseWriter, r *http.Request) {
+	if noAuth {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	cookie, err := r.Cookie(preAuthCookieName)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	preAuthsMutex.Lock()
+	pending := getPreAuthLocked(cookie.Value)
+	var username, secret string
+	if pending != nil {
+		username = pending.username
+		if r.Method == http.MethodPost {
+			pending.attempts++
+		}
+	}
+	preAuthsMutex.Unlock()
+	if pending == nil {
+		clearPreAuthCookie(w)
+		http.Redirect(w, r, "/login?error=Your sign-in expired or had too many attempts. Please log in again.", http.StatusFound)
+		return
+	}
+
+	user, err := getUserByUsernameDB(username)
+	if err != nil || user == nil || !user.IsApproved {
+		deletePreAuth(cookie.Value)
+		clearPreAuthCookie(w)
+		http.Redirect(w, r, "/login?error=Invalid credentials", http.StatusFound)
+		return
+	}
+
+	if !user.TOTPEnabled {
+		// Enrolling: the secret is kept with the pre-auth token until the
+		// user proves their app has it.
+		preAuthsMutex.Lock()
+		if pending.secret == "" {
+			pending.secret, err = newTOTPSecret()
+		}
+		secret = pending.secret
+		preAuthsMutex.Unlock()
 		if err != nil {
-			log.Printf("Failed to create session for user %s: %v", username, err)
-			http.Redirect(w, r, "/login?error=Internal error", http.StatusFound)
+			http.Error(w, "Failed to create secret", http.StatusInternalServerError)
 			return
 		}
+	}
 
-		http.SetCookie(w, &http.Cookie{
-			Name:     sessionCookieName,
-			Value:    sessionID,
-			Path:     "/",
-			HttpOnly: true,
-			Secure:   r.TLS != nil,
-			MaxAge:   86400, // 24 hours
+	if r.Method != http.MethodPost {
+		renderSecondFactorPage(w, secondFactorPage{
+			Username: username,
+			Secret:   secret,
+			URI:      totpURI(username, secret),
+			Error:    r.URL.Query().Get("error"),
 		})
+		return
+	}
 
-		log.Printf("User %s logged in successfully", username)
-		http.Redirect(w, r, "/", http.StatusFound)
+	r.ParseForm()
+	code := r.FormValue("code")
+	var ok bool
+	if user.TOTPEnabled {
+		ok, err = checkSecondFactor(user, code)
+	} else {
+		ok = checkTOTP(user.ID, secret, code)
+	}
+	if errors.Is(err, errTooManyAttempts) {
+		log.Printf("Two-factor codes for user %s refused after too many failures", username)
+		http.Redirect(w, r, "/login/2fa?error=Too many wrong codes. Please wait 15 minutes and try again.", http.StatusFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to check second factor for user %s: %v", username, err)
+		http.Redirect(w, r, "/login/2fa?error=Internal error", http.StatusFound)
+		return
+	}
+	if !ok {
+		log.Printf("Invalid two-factor code for user %s", username)
+		http.Redirect(w, r, "/login/2fa?error=Invalid code", http.StatusFound)
+		return
+	}
+
+	var recoveryCodes []string
+	if !user.TOTPEnabled {
+		if recoveryCodes, err = enableTOTP(user.ID, secret); err != nil {
+			log.Printf("Failed to enable two-factor authentication for user %s: %v", username, err)
+			http.Redirect(w, r, "/login/2fa?error=Internal error", http.StatusFound)
+			return
+		}
+		log.Printf("User %s enabled two-factor authentication", username)
+	}
+	deletePreAuth(cookie.Value)
+	clearPreAuthCookie(w)
+	if !startSession(w, r, username) {
+		return
+	}
+	if recoveryCodes != nil {
+		renderSecondFactorPage(w, secondFactorPage{Username: username, RecoveryCodes: recoveryCodes})
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+func clearPreAuthCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: preAuthCookieName, Value: "", Path: "/login", MaxAge: -1})
+}
+
+type secondFactorPage struct {
+	Username string
+	// Secret and URI are set when enrolling.
+	Secret string
+	URI    string
+	Error  string
+	// RecoveryCodes are shown once, after enrolling.
+	RecoveryCodes []string
+}
+
+var secondFactorTemplate = template.Must(template.New("2fa").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Two-Factor Authentication - WebSSH</title>
+    <link rel="preconnect" href="https://fonts.googleapis.com">
+    <link rel="preconnect" href="https://fonts.gstatic.com" crossorigin>
+    <link href="https://fonts.googleapis.com/css2?family=Poppins:wght@400;500;600&display=swap" rel="stylesheet">
+    <link rel="stylesheet" href="/static/login.css">
+    <style>
+        .info-box {
+            background-color: #d1ecf1;
+            color: #0c5460;
+            border: 1px solid #bee5eb;
+            border-radius: 6px;
+            padding: 0.75rem;
+            margin-bottom: 1rem;
+            font-size: 0.9rem;
+            text-align: center;
+        }
+        .totp-qr { text-align: center; margin-bottom: 1rem; }
+        .totp-secret, .recovery-codes { font-family: monospace; word-break: break-all; text-align: center; }
+        .recovery-codes { columns: 2; margin-bottom: 1rem; }
+    </style>
+</head>
+<body>
+    <div class="login-container">
+        <div class="login-card">
+            <h1>Two-Factor Authentication</h1>
+{{if .RecoveryCodes}}
+            <div class="info-box">Two-factor authentication is now on. Write these recovery codes down and keep them safe: each one logs you in once if you lose your authenticator app. They are not shown again.</div>
+            <div class="recovery-codes">{{range .RecoveryCodes}}<div>{{.}}</div>{{end}}</div>
+            <a href="/" class="btn-login" style="display: block; text-align: center; text-decoration: none;">Continue</a>
+{{else}}
+    {{if .Secret}}
+            <div class="info-box">Your administrator requires two-factor authentication. Scan this code with an authenticator app, or enter the key by hand, then enter the code the app shows.</div>
+            <div id="totp-qr" class="totp-qr" data-otpauth="{{.URI}}"></div>
+            <p class="totp-secret">{{.Secret}}</p>
+    {{else}}
+            <p class="subtitle">Enter the code from your authenticator app for {{.Username}}, or one of your recovery codes.</p>
+    {{end}}
+            <form method="POST" action="/login/2fa">
+                <div class="input-group">
+                    <label for="code">Code</label>
+                    <input type="text" id="code" name="code" autocomplete="one-time-code" autofocus required>
+                </div>
+                <button type="submit" class="btn-login">Verify</button>
+            </form>
+            <div class="links">
+                <a href="/login">Back to Login</a>
+            </div>
+    {{if .Error}}
+            <div class="error-message" style="display: block;">{{.Error}}</div>
+    {{end}}
+{{end}}
+        </div>
+    </div>
+{{if .Secret}}
+    <script src="https://cdn.jsdelivr.net/npm/qrcode-generator/qrcode.js"></script>
+    <script>
+        const qrBox = document.getElementById('totp-qr');
+        if (qrBox && window.qrcode) {
+            const qr = qrcode(0, 'M');
+            qr.addData(qrBox.dataset.otpauth);
+            qr.make();
+            qrBox.innerHTML = qr.createImgTag(4, 8);
+        }
+    </script>
+{{end}}
+</body>
+</html>`))
+
+func renderSecondFactorPage(w http.ResponseWriter, page secondFactorPage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := secondFactorTemplate.Execute(w, page); err != nil {
+		log.Printf("Failed to render two-factor page: %v", err)
+	}
+}
+
+// handleTwoFactor lets a logged-in user manage their own two-factor
+// authentication.
+//
+//	GET  /api/2fa                                 status
+//	POST /api/2fa {"action": "begin"}             new secret to enroll
+//	POST /api/2fa {"action": "enable", "code"}    confirm it, returns recovery codes
+//	POST /api/2fa {"action": "recovery_codes", "code"}  replace the recovery codes
+//	POST /api/2fa {"action": "disable", "code"}
+func handleTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if noAuth {
+		http.Error(w, "Two-factor authentication needs login to be enabled", http.StatusNotFound)
+		return
+	}
+	user, err := getUserByUsernameDB(getSessionUser(r))
+	if err != nil || user == nil {
+		http.Error(w, "User not found", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		left, err := countRecoveryCodesDB(user.ID)
+		if err != nil {
+			http.Error(w, "Failed to load recovery codes", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"enabled":        user.TOTPEnabled,
+			"required":       twoFactorRequired(user),
+			"recovery_codes": left,
+		})
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Action string `json:"action"`
+		Code   string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	// A new authenticator replaces the current one only after the current
+	// one was turned off with a valid code.
+	if (req.Action == "begin" || req.Action == "enable") && user.TOTPEnabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	switch req.Action {
+	case "begin":
+		secret, err := newTOTPSecret()
+		if err != nil {
+			http.Error(w, "Failed to create secret", http.StatusInternalServerError)
+			return
+		}
+		pendingTOTPMutex.Lock()
+		pendingTOTP[user.ID] = pendingSecret{secret: secret, expires: time.Now().Add(pendingTOTPTTL)}
+		pendingTOTPMutex.Unlock()
+		writeJSON(w, http.StatusOK, map[string]string{"secret": secret, "uri": totpURI(user.Username, secret)})
+
+	case "enable":
+		pendingTOTPMutex.Lock()
+		pending, ok := pendingTOTP[user.ID]
+		pendingTOTPMutex.Unlock()
+		if !ok || time.Now().After(pending.expires) {
+			http.Error(w, "Start again: the setup expired", http.StatusBadRequest)
+			return
+		}
+		if !checkTOTP(user.ID, pending.secret, req.Code) {
+			http.Error(w, "Invalid code", http.StatusForbidden)
+			return
+		}
+		codes, err := enableTOTP(user.ID, pending.secret)
+		if err != nil {
+			http.Error(w, "Failed to enable two-factor authentication", http.StatusInternalServerError)
+			return
+		}
+		pendingTOTPMutex.Lock()
+		delete(pendingTOTP, user.ID)
+		pendingTOTPMutex.Unlock()
+		log.Printf("User %s enabled two-factor authentication", user.Username)
+		writeJSON(w, http.StatusOK, map[string][]string{"recovery_codes": codes})
+
+	case "recovery_codes", "disable":
+		if !user.TOTPEnabled {
+			http.Error(w, "Two-factor authentication is not enabled", http.StatusBadRequest)
+			return
+		}
+		if req.Action == "disable" && twoFactorRequired(user) {
+			http.Error(w, "Your administrator requires two-factor authentication", http.StatusForbidden)
+			return
+		}
+		ok, err := checkSecondFactor(user, req.Code)
+		if errors.Is(err, errTooManyAttempts) {
+			http.Error(w, "Too many wrong codes, try again later", http.StatusTooManyRequests)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to check code", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "Invalid code", http.StatusForbidden)
+			return
+		}
+		if req.Action == "disable" {
+			if err := disableTOTPDB(user.ID); err != nil {
+				http.Error(w, "Failed to disable two-factor authentication", http.StatusInternalServerError)
+				return
+			}
+			log.Printf("User %s disabled two-factor authentication", user.Username)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		codes, hashes, err := newRecoveryCodes()
+		if err == nil {
+			err = replaceRecoveryCodesDB(user.ID, hashes)
+		}
+		if err != nil {
+			http.Error(w, "Failed to create recovery codes", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string][]string{"recovery_codes": codes})
+
+	default:
+		http.Error(w, "Invalid action", http.StatusBadRequest)
 	}
 }
 
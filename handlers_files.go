@@ -0,0 +1,973 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	maxUploadChunkSize = 16 << 20
+	uploadExpiry       = 24 * time.Hour
+	// scpUploadIdle is how long an scp upload keeps its session open
+	// without a chunk arriving, since it ties up the transport.
+	scpUploadIdle = 10 * time.Minute
+)
+
+var errConnectionNotFound = errors.New("connection not found")
+
+// acquireConnectionSFTP looks up one of the user's saved connections and
+// returns the SFTP client of its pooled transport, along with the jail its
+// paths must be checked against. release must be called when the caller is
+// done with it.
+func acquireConnectionSFTP(userID int, connID string) (*sftp.Client, *pathJail, func(), error) {
+	details, jail, err := connectionDetails(userID, connID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	client, release, err := sshPool.Acquire(userID, details)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	sftpClient, err := sshPool.SFTP(client)
+	if err != nil {
+		release()
+		return nil, nil, nil, err
+	}
+	return sftpClient, jail, release, nil
+}
+
+// acquireConnectionSCP is acquireConnectionSFTP for hosts without SFTP,
+// where files are sent with scp. Paths cannot be checked against file roots
+// without SFTP, so users who have them are refused.
+func acquireConnectionSCP(userID int, connID string) (*ssh.Client, func(), error) {
+	details, jail, err := connectionDetails(userID, connID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if jail != nil {
+		return nil, nil, errSCPConfined
+	}
+	return sshPool.Acquire(userID, details)
+}
+
+func connectionDetails(userID int, connID string) (*SSHConnection, *pathJail, error) {
+	details, err := getConnectionByIDDB(userID, connID)
+	if err != nil {
+		return nil, nil, errConnectionNotFound
+	}
+	user, err := getUserByIDDB(userID)
+	if err != nil || user == nil {
+		return nil, nil, errConnectionNotFound
+	}
+	return details, newPathJail(user, details), nil
+}
+
+// pathErrorStatus is the HTTP status for a failed path check.
+func pathErrorStatus(err error) int {
+	if errors.Is(err, errPathNotAllowed) || errors.Is(err, errSCPConfined) {
+		return http.StatusForbidden
+	}
+	return http.StatusBadGateway
+}
+
+// chunkedUpload tracks a file being uploaded in pieces. Chunks must arrive
+// in order; after a dropped connection the browser asks for the current
+// offset and continues from there.
+type chunkedUpload struct {
+	ID       string
+	Path     string
+	Size     int64
+	Offset   int64
+	Conflict string // what resolveConflict did with an existing file
+	userID   int
+	connID   string
+	mutex    sync.Mutex
+	lastUsed time.Time
+
+	// Archives uploaded with extract set are unpacked into extractDir once
+	// complete, and then removed.
+	extract     bool
+	extractDir  string
+	archiveName string
+	policy      string
+	Summary     *extractSummary
+	jail        *pathJail
+
+	// The SHA-256 of the bytes written so far, and the one the client
+	// expects the finished file to have, if any.
+	hash     hash.Hash
+	expected string
+	SHA256   string
+
+	// On hosts without SFTP the file is sent with scp. Its session stays
+	// open between chunks and holds the transport until released, or
+	// until scpIdle fires with no chunk sent or waiting to be.
+	scp        *scpUpload
+	scpClient  *ssh.Client
+	scpRelease func()
+	scpIdle    *time.Timer
+	pending    int
+}
+
+var (
+	uploads      = make(map[string]*chunkedUpload)
+	uploadsMutex sync.Mutex
+)
+
+func getUpload(id string, userID int) *chunkedUpload {
+	uploadsMutex.Lock()
+	defer uploadsMutex.Unlock()
+	upload := uploads[id]
+	if upload == nil || upload.userID != userID {
+		return nil
+	}
+	return upload
+}
+
+func removeUpload(id string) {
+	uploadsMutex.Lock()
+	delete(uploads, id)
+	uploadsMutex.Unlock()
+}
+
+// expireUploadsLocked forgets uploads the browser has abandoned.
+func expireUploadsLocked() {
+	for id, upload := range uploads {
+		upload.mutex.Lock()
+		stale := time.Since(upload.lastUsed) > uploadExpiry
+		upload.mutex.Unlock()
+		if stale {
+			delete(uploads, id)
+			if upload.scp != nil {
+				go upload.abortSCP()
+			}
+		}
+	}
+}
+
+// handleUploads implements chunked uploads:
+//
+//	POST   /api/uploads          start an upload, returns its ID
+//	GET    /api/uploads/{id}     current offset, for resuming
+//	PUT    /api/uploads/{id}?offset=N  append a chunk
+//	DELETE /api/uploads/{id}     cancel and remove the partial file
+func handleUploads(w http.ResponseWriter, r *http.Request) {
+	if disableFileBrowser {
+		http.Error(w, "File browser is disabled", http.StatusForbidden)
+		return
+	}
+
+	user, err := getUserByUsernameDB(getSessionUser(r))
+	if err != nil || user == nil {
+		http.Error(w, "User not found", http.StatusInternalServerError)
+		return
+	}
+
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/uploads"), "/")
+	if id == "" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		startUpload(w, r, user)
+		return
+	}
+
+	upload := getUpload(id, user.ID)
+	if upload == nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		upload.mutex.Lock()
+		defer upload.mutex.Unlock()
+		writeUploadStatus(w, http.StatusOK, upload)
+	case http.MethodPut:
+		upload.mutex.Lock()
+		upload.pending++
+		upload.mutex.Unlock()
+		defer func() {
+			upload.mutex.Lock()
+			upload.pending--
+			upload.lastUsed = time.Now()
+			upload.mutex.Unlock()
+		}()
+		// Each chunk waits its turn in the user's transfer queue.
+		t := &transfer{Kind: transferUpload, Target: &transferEndpoint{upload.connID, upload.Path}, BytesTotal: r.ContentLength}
+		r, ok := queueRequestTransfer(w, r, user.ID, t)
+		if !ok {
+			return
+		}
+		out := &transferResponseWriter{ResponseWriter: w}
+		writeUploadChunk(out, r, upload, t)
+		err := out.result()
+		if out.status == http.StatusConflict {
+			// A resent chunk that was already written is not a failure.
+			err = nil
+		}
+		t.finish(r.Context(), err)
+	case http.MethodDelete:
+		removeUpload(upload.ID)
+		if upload.scp != nil {
+			upload.abortSCP()
+		} else if sftpClient, _, release, err := acquireConnectionSFTP(upload.userID, upload.connID); err == nil {
+			sftpClient.Remove(upload.Path)
+			release()
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+type uploadRequest struct {
+	ConnectionID string `json:"connection_id"`
+	Path         string `json:"path"`
+	Filename     string `json:"filename"`
+	RelativePath string `json:"relative_path"`
+	Size         int64  `json:"size"`
+	OnConflict   string `json:"on_conflict"`
+	Extract      bool   `json:"extract"`
+	SHA256       string `json:"sha256"`
+}
+
+// startUpload creates the remote file. RelativePath, used for folder
+// uploads, may contain directories, which are created as needed.
+func startUpload(w http.ResponseWriter, r *http.Request, user *User) {
+	var req uploadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Filename == "" || req.Size < 0 {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if strings.ContainsAny(req.Filename, "/\\") || req.Filename == "." || req.Filename == ".." {
+		http.Error(w, "Invalid filename", http.StatusBadRequest)
+		return
+	}
+	relPath := req.Filename
+	if req.RelativePath != "" {
+		var err error
+		if relPath, err = relativeUploadPath(req.RelativePath); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if !validConflictPolicy(req.OnConflict) {
+		http.Error(w, "Invalid conflict policy", http.StatusBadRequest)
+		return
+	}
+	if req.Extract && (!isArchiveName(req.Filename) || req.Size == 0) {
+		http.Error(w, "Only .zip, .tar, .tar.gz and .tgz files can be extracted", http.StatusBadRequest)
+		return
+	}
+	if err := checkTransferSize(user.ID, req.Size, maxUploadSize); err != nil {
+		http.Error(w, err.Error(), limitStatus(err))
+		return
+	}
+	expected, err := parseExpectedChecksum(req.SHA256)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sftpClient, jail, release, err := acquireConnectionSFTP(user.ID, req.ConnectionID)
+	if errors.Is(err, errSFTPUnavailable) {
+		startUploadSCP(w, user, req, relPath, expected)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to get SFTP client: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer release()
+
+	if req.Path == "" {
+		req.Path = jail.Home(sftpClient)
+	}
+	dstPath, err := jail.Resolve(sftpClient, "upload", path.Join(req.Path, relPath))
+	if err != nil {
+		http.Error(w, err.Error(), pathErrorStatus(err))
+		return
+	}
+	if err := sftpClient.MkdirAll(path.Dir(dstPath)); err != nil {
+		http.Error(w, "Failed to create remote directory: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	idBytes := make([]byte, 16)
+	rand.Read(idBytes)
+	upload := &chunkedUpload{
+		ID:       hex.EncodeToString(idBytes),
+		Path:     dstPath,
+		Size:     req.Size,
+		userID:   user.ID,
+		connID:   req.ConnectionID,
+		lastUsed: time.Now(),
+		policy:   req.OnConflict,
+		jail:     jail,
+		hash:     sha256.New(),
+		expected: expected,
+	}
+
+	if req.Extract {
+		// The archive itself goes to a hidden name next to its contents.
+		upload.extract = true
+		upload.extractDir = path.Dir(dstPath)
+		upload.archiveName = req.Filename
+		upload.Path = path.Join(upload.extractDir, ".webssh-upload-"+upload.ID+"-"+req.Filename)
+	} else {
+		var err error
+		upload.Path, upload.Conflict, err = resolveConflict(sftpClient, dstPath, req.OnConflict)
+		if err != nil {
+			http.Error(w, "Failed to check remote file: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		if upload.Conflict == "skipped" {
+			upload.Offset = upload.Size
+			writeUploadStatus(w, http.StatusOK, upload)
+			return
+		}
+	}
+
+	f, err := sftpClient.Create(upload.Path)
+	if err != nil {
+		http.Error(w, "Failed to create remote file: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	f.Close()
+
+	// Empty files are complete as soon as they are created.
+	if upload.Size == 0 {
+		upload.SHA256 = sumHex(upload.hash)
+		if err := verifyChecksum(upload.expected, upload.SHA256); err != nil {
+			sftpClient.Remove(upload.Path)
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+	} else {
+		uploadsMutex.Lock()
+		expireUploadsLocked()
+		uploads[upload.ID] = upload
+		uploadsMutex.Unlock()
+	}
+
+	writeUploadStatus(w, http.StatusCreated, upload)
+}
+
+// startUploadSCP is startUpload for hosts without SFTP. The scp session
+// that receives the file stays open while the chunks arrive, so the upload
+// can only resume while the server keeps it.
+func startUploadSCP(w http.ResponseWriter, user *User, req uploadRequest, relPath, expected string) {
+	if req.Extract {
+		http.Error(w, "Extracting uploads needs SFTP, which this host does not offer", http.StatusBadRequest)
+		return
+	}
+	client, release, err := acquireConnectionSCP(user.ID, req.ConnectionID)
+	if err != nil {
+		http.Error(w, "Failed to connect: "+err.Error(), pathErrorStatus(err))
+		return
+	}
+
+	dstPath := path.Join(scpPathArg(req.Path), relPath)
+	exists := func(p string) (bool, error) { return scpExists(client, p) }
+	idBytes := make([]byte, 16)
+	rand.Read(idBytes)
+	upload := &chunkedUpload{
+		ID:         hex.EncodeToString(idBytes),
+		Size:       req.Size,
+		userID:     user.ID,
+		connID:     req.ConnectionID,
+		lastUsed:   time.Now(),
+		policy:     req.OnConflict,
+		hash:       sha256.New(),
+		expected:   expected,
+		scpClient:  client,
+		scpRelease: release,
+	}
+	upload.Path, upload.Conflict, err = resolveConflictWith(exists, dstPath, req.OnConflict)
+	if err != nil {
+		release()
+		http.Error(w, "Failed to check remote file: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	if upload.Conflict == "skipped" {
+		release()
+		upload.Offset = upload.Size
+		writeUploadStatus(w, http.StatusOK, upload)
+		return
+	}
+
+	var subdirs []string
+	if dir := path.Dir(relPath); dir != "." {
+		subdirs = strings.Split(dir, "/")
+	}
+	upload.scp, err = startSCPUpload(client, scpPathArg(req.Path), subdirs, path.Base(upload.Path), upload.Size)
+	if err != nil {
+		release()
+		http.Error(w, "Failed to create remote file: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	if upload.Size == 0 {
+		if err := upload.finishSCP(); err != nil {
+			http.Error(w, "Failed to write remote file: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		upload.SHA256 = sumHex(upload.hash)
+		if err := verifyChecksum(upload.expected, upload.SHA256); err != nil {
+			removeRemoteFile(client, upload.Path)
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+	} else {
+		upload.scpIdle = time.AfterFunc(scpUploadIdle, upload.expireSCP)
+		uploadsMutex.Lock()
+		expireUploadsLocked()
+		uploads[upload.ID] = upload
+		uploadsMutex.Unlock()
+	}
+
+	writeUploadStatus(w, http.StatusCreated, upload)
+}
+
+// expireSCP aborts an scp upload the browser has stopped sending, and
+// otherwise checks again once it could next have been idle long enough.
+func (u *chunkedUpload) expireSCP() {
+	u.mutex.Lock()
+	wait := scpUploadIdle - time.Since(u.lastUsed)
+	if u.pending > 0 {
+		wait = scpUploadIdle
+	}
+	if wait > 0 {
+		u.scpIdle.Reset(wait)
+		u.mutex.Unlock()
+		return
+	}
+	u.mutex.Unlock()
+
+	uploadsMutex.Lock()
+	_, ok := uploads[u.ID]
+	delete(uploads, u.ID)
+	uploadsMutex.Unlock()
+	// Uploads already finished or cancelled have released the session.
+	if ok {
+		log.Printf("Upload %s to %s expired after %s without data", u.ID, u.Path, scpUploadIdle)
+		u.abortSCP()
+	}
+}
+
+func (u *chunkedUpload) stopSCPIdle() {
+	if u.scpIdle != nil {
+		u.scpIdle.Stop()
+	}
+}
+
+// finishSCP completes the file sent with scp and releases the transport.
+func (u *chunkedUpload) finishSCP() error {
+	u.stopSCPIdle()
+	defer u.scpRelease()
+	return u.scp.Close()
+}
+
+// abortSCP stops an scp upload and removes what was written.
+func (u *chunkedUpload) abortSCP() {
+	u.stopSCPIdle()
+	u.scp.abort()
+	removeRemoteFile(u.scpClient, u.Path)
+	u.scpRelease()
+}
+
+func writeUploadChunk(w http.ResponseWriter, r *http.Request, upload *chunkedUpload, t *transfer) {
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid offset", http.StatusBadRequest)
+		return
+	}
+
+	upload.mutex.Lock()
+	defer upload.mutex.Unlock()
+	upload.lastUsed = time.Now()
+
+	// The browser may resend a chunk whose acknowledgement it never saw.
+	if offset != upload.Offset {
+		writeUploadStatus(w, http.StatusConflict, upload)
+		return
+	}
+
+	if upload.scp != nil {
+		writeUploadChunkSCP(w, r, upload, offset, t)
+		return
+	}
+
+	sftpClient, _, release, err := acquireConnectionSFTP(upload.userID, upload.connID)
+	if err != nil {
+		http.Error(w, "Failed to get SFTP client: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer release()
+
+	f, err := sftpClient.OpenFile(upload.Path, os.O_WRONLY)
+	if err != nil {
+		http.Error(w, "Failed to open remote file: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		http.Error(w, "Failed to seek remote file: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	body := &transferReader{
+		ctx:       r.Context(),
+		r:         io.LimitReader(http.MaxBytesReader(w, r.Body, maxUploadChunkSize), upload.Size-offset),
+		t:         t,
+		limiter:   t.account.limiter(uploadDirection),
+		quota:     t.account.quota(),
+		direction: uploadDirection,
+	}
+	n, err := io.Copy(&hashingWriter{w: f, h: upload.hash}, body)
+	f.Close()
+	body.quota.close()
+	// Whatever reached the file counts, so a retry continues after it.
+	upload.Offset += n
+	if err != nil {
+		log.Printf("Upload %s to %s failed at offset %d: %v", upload.ID, upload.Path, upload.Offset, err)
+		http.Error(w, "Failed to write to remote file: "+err.Error(), limitStatus(err))
+		return
+	}
+
+	if upload.Offset >= upload.Size {
+		removeUpload(upload.ID)
+		upload.SHA256 = sumHex(upload.hash)
+		log.Printf("Upload %s to %s completed (%d bytes, sha256 %s)", upload.ID, upload.Path, upload.Size, upload.SHA256)
+		if err := verifyChecksum(upload.expected, upload.SHA256); err != nil {
+			// A corrupt file must not be mistaken for the real one.
+			sftpClient.Remove(upload.Path)
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if upload.extract {
+			summary, err := extractRemoteArchive(sftpClient, upload.jail, upload.Path, upload.archiveName, upload.extractDir, upload.policy, nil, nil)
+			sftpClient.Remove(upload.Path)
+			if err != nil {
+				http.Error(w, "Failed to extract archive: "+err.Error(), http.StatusBadGateway)
+				return
+			}
+			upload.Path = upload.extractDir
+			upload.Summary = summary
+		}
+	}
+	writeUploadStatus(w, http.StatusOK, upload)
+}
+
+// writeUploadChunkSCP is writeUploadChunk for uploads sent with scp, which
+// can only append to the open session.
+func writeUploadChunkSCP(w http.ResponseWriter, r *http.Request, upload *chunkedUpload, offset int64, t *transfer) {
+	body := &transferReader{
+		ctx:       r.Context(),
+		r:         io.LimitReader(http.MaxBytesReader(w, r.Body, maxUploadChunkSize), upload.Size-offset),
+		t:         t,
+		limiter:   t.account.limiter(uploadDirection),
+		quota:     t.account.quota(),
+		direction: uploadDirection,
+	}
+	n, err := io.Copy(&hashingWriter{w: upload.scp, h: upload.hash}, body)
+	body.quota.close()
+	upload.Offset += n
+	if err != nil {
+		log.Printf("Upload %s to %s failed at offset %d: %v", upload.ID, upload.Path, upload.Offset, err)
+		http.Error(w, "Failed to write to remote file: "+err.Error(), limitStatus(err))
+		return
+	}
+
+	if upload.Offset >= upload.Size {
+		removeUpload(upload.ID)
+		if err := upload.finishSCP(); err != nil {
+			http.Error(w, "Failed to write to remote file: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		upload.SHA256 = sumHex(upload.hash)
+		log.Printf("Upload %s to %s completed over scp (%d bytes, sha256 %s)", upload.ID, upload.Path, upload.Size, upload.SHA256)
+		if err := verifyChecksum(upload.expected, upload.SHA256); err != nil {
+			removeRemoteFile(upload.scpClient, upload.Path)
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	writeUploadStatus(w, http.StatusOK, upload)
+}
+
+func writeUploadStatus(w http.ResponseWriter, status int, upload *chunkedUpload) {
+	progress := 100.0
+	if upload.Size > 0 {
+		progress = float64(upload.Offset) * 100 / float64(upload.Size)
+	}
+	result := map[string]interface{}{
+		"id":       upload.ID,
+		"path":     upload.Path,
+		"size":     upload.Size,
+		"offset":   upload.Offset,
+		"progress": progress,
+		"done":     upload.Offset >= upload.Size,
+	}
+	if upload.Conflict != "" {
+		result["conflict"] = upload.Conflict
+	}
+	if upload.Summary != nil {
+		result["summary"] = upload.Summary
+	}
+	if upload.SHA256 != "" {
+		result["sha256"] = upload.SHA256
+	}
+	writeJSON(w, status, result)
+}
+
+// handleDownload streams a remote file to the browser. Range requests are
+// supported, so interrupted downloads of large files can resume. Directories
+// are sent as an archive, see downloadDirectory.
+//
+//	GET /api/download?id={connectionID}&path={remotePath}&expected={sha256}
+//
+// Files are listed with the user's transfers, where the SHA-256 of one sent
+// whole appears once it completes. With expected, a file whose SHA-256
+// differs is cut short before its last bytes and the download fails.
+func handleDownload(w http.ResponseWriter, r *http.Request) {
+	if disableFileBrowser || disableDownload {
+		http.Error(w, "Downloads are disabled", http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := getUserByUsernameDB(getSessionUser(r))
+	if err != nil || user == nil {
+		http.Error(w, "User not found", http.StatusInternalServerError)
+		return
+	}
+
+	remotePath := r.URL.Query().Get("path")
+	if remotePath == "" {
+		http.Error(w, "Path required", http.StatusBadRequest)
+		return
+	}
+	expected, err := parseExpectedChecksum(r.URL.Query().Get("expected"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sftpClient, jail, release, err := acquireConnectionSFTP(user.ID, r.URL.Query().Get("id"))
+	if errors.Is(err, errSFTPUnavailable) {
+		downloadSCP(w, r, user, remotePath, expected)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to get SFTP client: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer release()
+
+	if remotePath, err = jail.Resolve(sftpClient, "download", remotePath); err != nil {
+		http.Error(w, err.Error(), pathErrorStatus(err))
+		return
+	}
+
+	stat, err := sftpClient.Stat(remotePath)
+	if err != nil {
+		http.Error(w, "Failed to stat remote file: "+err.Error(), http.StatusNotFound)
+		return
+	}
+	account := newTransferAccount(r, user.ID)
+	if stat.IsDir() {
+		downloadDirectory(w, r, account, remotePath, func(aw archiveWriter, filter archiveFilter) ([]string, error) {
+			return writeDirectoryArchive(aw, sftpClient, path.Clean(remotePath), filter)
+		})
+		return
+	}
+	if err := checkTransferSize(user.ID, stat.Size(), maxDownloadSize); err != nil {
+		http.Error(w, err.Error(), limitStatus(err))
+		return
+	}
+
+	f, err := sftpClient.Open(remotePath)
+	if err != nil {
+		http.Error(w, "Failed to open remote file: "+err.Error(), http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(remotePath)}))
+	// ServeContent handles Range, If-Range and Content-Length.
+	if r.Method == http.MethodHead {
+		http.ServeContent(w, r, "", stat.ModTime(), f)
+		return
+	}
+	t := &transfer{
+		Kind:       transferDownload,
+		Source:     transferEndpoint{r.URL.Query().Get("id"), remotePath},
+		BytesTotal: stat.Size(),
+		FilesTotal: 1,
+		Expected:   expected,
+	}
+	r, ok := queueRequestTransfer(w, r, user.ID, t)
+	if !ok {
+		return
+	}
+	hashed := newDownloadBody(r.Context(), t, f, stat.Size())
+	quota := account.quota()
+	body := &meteredReadSeeker{&meteredReader{r: hashed, ctx: r.Context(), limiter: account.limiter(downloadDirection), quota: quota}, hashed}
+	out := &transferResponseWriter{ResponseWriter: w, t: t}
+	http.ServeContent(out, r, "", stat.ModTime(), body)
+	quota.close()
+	err = hashed.result()
+	if err == nil {
+		err = body.quotaErr
+	}
+	if err == nil {
+		err = out.result()
+	}
+	t.finish(r.Context(), err)
+}
+
+// downloadBody is a file on its way to the browser. When it is read from
+// the start to the end in one pass, it is hashed through a TeeReader and the
+// checksum recorded with its transfer; a Range request leaves no checksum.
+// The last bytes of a file that does not match the expected hash are held
+// back, so the browser sees the download fail instead of complete.
+type downloadBody struct {
+	ctx     context.Context
+	t       *transfer
+	src     io.Reader
+	size    int64
+	h       hash.Hash
+	r       io.Reader // src, teed into h while hashing
+	hashing bool
+	pos     int64
+	err     error
+}
+
+func newDownloadBody(ctx context.Context, t *transfer, src io.Reader, size int64) *downloadBody {
+	b := &downloadBody{ctx: ctx, t: t, src: src, size: size, h: sha256.New()}
+	b.r = io.TeeReader(src, b.h)
+	b.hashing = true
+	return b
+}
+
+func (b *downloadBody) Read(p []byte) (int, error) {
+	if err := b.ctx.Err(); err != nil {
+		b.err = err
+		return 0, err
+	}
+	n, err := b.r.Read(p)
+	b.pos += int64(n)
+	if b.hashing && b.pos == b.size && b.t.Expected != "" {
+		if mismatch := verifyChecksum(b.t.Expected, sumHex(b.h)); mismatch != nil {
+			b.err = mismatch
+			return 0, mismatch
+		}
+	}
+	if err != nil && err != io.EOF && b.err == nil {
+		b.err = err
+	}
+	return n, err
+}
+
+// Seek is used by ServeContent to find the size and to serve ranges.
+// Hashing starts over whenever the file is read from the start again.
+func (b *downloadBody) Seek(offset int64, whence int) (int64, error) {
+	pos, err := b.src.(io.Seeker).Seek(offset, whence)
+	if err != nil {
+		return pos, err
+	}
+	b.pos = pos
+	b.h.Reset()
+	b.hashing = pos == 0
+	if b.hashing {
+		b.r = io.TeeReader(b.src, b.h)
+	} else {
+		b.r = b.src
+	}
+	return pos, nil
+}
+
+// result records the checksum of a whole file with the transfer and
+// returns why the download failed, if it did.
+func (b *downloadBody) result() error {
+	if b.err != nil {
+		return b.err
+	}
+	if !b.hashing || b.pos != b.size {
+		return nil
+	}
+	sum := sumHex(b.h)
+	b.t.update(func(t *transfer) { t.SHA256 = sum })
+	return verifyChecksum(b.t.Expected, sum)
+}
+
+// downloadDirectory streams a directory as a zip or tar.gz archive, built
+// while it is sent.
+//
+//	GET /api/download?id=...&path=...&format=zip|tar.gz&include=GLOB&exclude=GLOB
+//
+// include and exclude may be repeated.
+//
+// The archive's size is only known once it is sent, so it is cut off when
+// it reaches the download size limit or the rest of the user's quota. write
+// adds the directory's entries to the archive and closes it.
+func downloadDirectory(w http.ResponseWriter, r *http.Request, account transferAccount, dir string, write func(archiveWriter, archiveFilter) ([]string, error)) {
+	query := r.URL.Query()
+	format := query.Get("format")
+	filter := archiveFilter{Include: query["include"], Exclude: query["exclude"]}
+	if err := filter.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	t := &transfer{Kind: transferDownload, Source: transferEndpoint{query.Get("id"), dir}}
+	r, ok := queueRequestTransfer(w, r, account.userID, t)
+	if !ok {
+		return
+	}
+	tw := &transferResponseWriter{ResponseWriter: w, t: t}
+	w = tw
+	defer func() { t.finish(r.Context(), tw.result()) }()
+
+	// The quota is checked once the archive leaves the queue, since other
+	// transfers may have used it up in the meantime.
+	limit, err := capTransfer(account.userID, maxDownloadSize)
+	if err != nil {
+		http.Error(w, "Failed to check transfer quota: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if limit.bytes == 0 {
+		http.Error(w, errQuotaExceeded.Error(), http.StatusTooManyRequests)
+		return
+	}
+	quota := account.quota()
+	defer quota.close()
+	out := &meteredWriter{w: w, ctx: r.Context(), limiter: account.limiter(downloadDirection), cap: limit, quota: quota, direction: downloadDirection}
+
+	aw, err := newArchiveWriter(out, format)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name := path.Base(path.Clean(dir))
+	if name == "/" {
+		name = "root"
+	}
+	if format == archiveTarGz {
+		w.Header().Set("Content-Type", "application/gzip")
+		name += ".tar.gz"
+	} else {
+		w.Header().Set("Content-Type", "application/zip")
+		name += ".zip"
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+
+	failures, err := write(aw, filter)
+	if err != nil {
+		log.Printf("Archive of %s aborted: %v", dir, err)
+		tw.err = err
+	} else if len(failures) > 0 {
+		log.Printf("Archive of %s skipped %d unreadable entries", dir, len(failures))
+	}
+}
+
+// downloadSCP is handleDownload for hosts without SFTP. scp only tells
+// whether a path is a file or a directory once it sends it, so it is always
+// asked to recurse, and directories are sent as an archive. Ranges are not
+// supported.
+func downloadSCP(w http.ResponseWriter, r *http.Request, user *User, remotePath, expected string) {
+	client, release, err := acquireConnectionSCP(user.ID, r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Failed to connect: "+err.Error(), pathErrorStatus(err))
+		return
+	}
+	defer release()
+
+	d, err := startSCPDownload(client, remotePath, true)
+	if err != nil {
+		http.Error(w, "Failed to start scp: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer d.close()
+	entry, err := d.next()
+	if err != nil {
+		status := http.StatusBadGateway
+		if errors.As(err, new(*scpError)) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, "Failed to read remote file: "+err.Error(), status)
+		return
+	}
+	account := newTransferAccount(r, user.ID)
+	if entry.isDir {
+		downloadDirectory(w, r, account, remotePath, func(aw archiveWriter, filter archiveFilter) ([]string, error) {
+			return writeSCPArchive(aw, d, entry, filter)
+		})
+		return
+	}
+	if err := checkTransferSize(user.ID, entry.size, maxDownloadSize); err != nil {
+		http.Error(w, err.Error(), limitStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": entry.name}))
+	w.Header().Set("Content-Length", strconv.FormatInt(entry.size, 10))
+	w.Header().Set("Last-Modified", entry.modTime.UTC().Format(http.TimeFormat))
+	if r.Method == http.MethodHead {
+		return
+	}
+	t := &transfer{
+		Kind:       transferDownload,
+		Source:     transferEndpoint{r.URL.Query().Get("id"), remotePath},
+		BytesTotal: entry.size,
+		FilesTotal: 1,
+		Expected:   expected,
+	}
+	r, ok := queueRequestTransfer(w, r, user.ID, t)
+	if !ok {
+		return
+	}
+	hashed := newDownloadBody(r.Context(), t, d.file(), entry.size)
+	quota := account.quota()
+	body := &meteredReader{r: hashed, ctx: r.Context(), limiter: account.limiter(downloadDirection), quota: quota}
+	_, err = io.Copy(&transferResponseWriter{ResponseWriter: w, t: t}, body)
+	if err == nil {
+		err = d.endFile()
+	}
+	quota.close()
+	// A mismatch reaches io.Copy wrapped in the write error.
+	if resultErr := hashed.result(); resultErr != nil {
+		err = resultErr
+	}
+	if err != nil {
+		log.Printf("Download of %s over scp failed: %v", remotePath, err)
+	}
+	t.finish(r.Context(), err)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	healthProbeTimeout = 5 * time.Second
+	maxBannerLength    = 255 // RFC 4253 section 4.2
+)
+
+// runHealthChecker probes every saved connection at the given interval until
+// the process exits. It never authenticates: it only opens a TCP connection
+// and reads the SSH identification banner.
+func runHealthChecker(interval time.Duration, concurrency int) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	log.Printf("Health checker enabled (interval: %s, concurrency: %d)", interval, concurrency)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		checkAllConnections(concurrency)
+		<-ticker.C
+	}
+}
+
+func checkAllConnections(concurrency int) {
+	targets, err := getHealthCheckTargetsDB()
+	if err != nil {
+		log.Printf("Health checker: failed to load connections: %v", err)
+		return
+	}
+
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, target := range targets {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(target SSHConnection) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			health := probeHost(target.Host)
+			if err := saveConnectionHealthDB(target.ID, health); err != nil {
+				log.Printf("Health checker: failed to save result for connection %d: %v", target.ID, err)
+			}
+		}(target)
+	}
+	wg.Wait()
+}
+
+// probeHost connects to host and reads its SSH banner. Latency is the time
+// taken to establish the TCP connection.
+func probeHost(host string) *ConnectionHealth {
+	health := &ConnectionHealth{Status: "down", CheckedAt: time.Now()}
+
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", sshAddress(host), healthProbeTimeout)
+	if err != nil {
+		health.Error = err.Error()
+		return health
+	}
+	defer conn.Close()
+	health.LatencyMs = time.Since(start).Milliseconds()
+
+	conn.SetReadDeadline(time.Now().Add(healthProbeTimeout))
+	reader := bufio.NewReaderSize(conn, maxBannerLength+2)
+	// Servers may send other lines before the identification string. Each
+	// is read into the fixed buffer, so an endless line fails instead of
+	// growing in memory.
+	for {
+		slice, err := reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			health.Error = "no SSH banner received: line too long"
+			return health
+		}
+		if err != nil {
+			health.Error = "no SSH banner received: " + err.Error()
+			return health
+		}
+		line := strings.TrimRight(string(slice), "\r\n")
+		if strings.HasPrefix(line, "SSH-") {
+			health.Status = "up"
+			health.Banner = line
+			return health
+		}
+	}
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Transfer limits, set by flags. Zero means unlimited.
+var (
+	maxUploadSize      byteSize
+	maxDownloadSize    byteSize
+	dailyTransferQuota byteSize
+	// bandwidthLimit applies to each browser session, separately for
+	// uploads and downloads.
+	bandwidthLimit byteSize
+)
+
+var (
+	errTooLarge      = errors.New("file exceeds the size limit")
+	errQuotaExceeded = errors.New("daily transfer quota exceeded")
+)
+
+// byteSize is a flag value in bytes that accepts suffixes such as 512K,
+// 100M or 20G (powers of 1024).
+type byteSize int64
+
+func (b *byteSize) String() string {
+	return formatByteSize(int64(*b))
+}
+
+func (b *byteSize) Set(input string) error {
+	value := strings.ToUpper(strings.TrimSpace(input))
+	multiplier := int64(1)
+	for i, suffix := range []string{"K", "M", "G", "T"} {
+		if trimmed, ok := strings.CutSuffix(strings.TrimSuffix(value, "B"), suffix); ok {
+			value = trimmed
+			multiplier = 1 << (10 * (i + 1))
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSuffix(value, "B"), 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q", input)
+	}
+	if n > math.MaxInt64/multiplier {
+		return fmt.Errorf("size %q is too large", input)
+	}
+	*b = byteSize(n * multiplier)
+	return nil
+}
+
+// formatByteSize writes n in the largest unit it reaches, such as 20G or
+// 1.5M.
+func formatByteSize(n int64) string {
+	for i, suffix := range []string{"T", "G", "M", "K"} {
+		unit := int64(1) << (10 * (4 - i))
+		if n < unit {
+			continue
+		}
+		if n%unit == 0 {
+			return fmt.Sprintf("%d%s", n/unit, suffix)
+		}
+		return fmt.Sprintf("%.1f%s", float64(n)/float64(unit), suffix)
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+// limitStatus is the HTTP status for a transfer refused by a limit.
+func limitStatus(err error) int {
+	switch {
+	case errors.Is(err, errTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, errQuotaExceeded):
+		return http.StatusTooManyRequests
+	}
+	return http.StatusBadGateway
+}
+
+// checkTransferSize refuses a transfer of size bytes that is larger than max
+// or than what is left of the user's quota for today.
+func checkTransferSize(userID int, size int64, max byteSize) error {
+	if max > 0 && size > int64(max) {
+		return fmt.Errorf("%w of %s", errTooLarge, max.String())
+	}
+	remaining, err := remainingQuota(userID)
+	if err != nil {
+		return err
+	}
+	if remaining >= 0 && size > remaining {
+		return fmt.Errorf("%w (%s left today)", errQuotaExceeded, formatByteSize(remaining))
+	}
+	return nil
+}
+
+// remainingQuota returns how many bytes the user may still transfer today,
+// or -1 without a quota. Bytes held by running transfers are not
+// available.
+func remainingQuota(userID int) (int64, error) {
+	if dailyTransferQuota <= 0 {
+		return -1, nil
+	}
+	quotaMutex.Lock()
+	defer quotaMutex.Unlock()
+	return remainingQuotaLocked(userID)
+}
+
+func remainingQuotaLocked(userID int) (int64, error) {
+	usage, err := getTransferUsageDB(userID, usageDay(time.Now()))
+	if err != nil {
+		return 0, err
+	}
+	return max(int64(dailyTransferQuota)-usage.Uploaded-usage.Downloaded-quotaHeld[userID], 0), nil
+}
+
+// quotaBlock is how much of the quota a running transfer takes at a time.
+const quotaBlock = 1 << 20
+
+var (
+	// quotaHeld is how many bytes of each user's quota running transfers
+	// have taken but not yet recorded.
+	quotaHeld  = make(map[int]int64)
+	quotaMutex sync.Mutex
+)
+
+// quotaMeter charges a stream's bytes to the user's daily quota as they
+// pass, so transfers running side by side cannot together go over it. It
+// takes the quota a block at a time; close records the bytes moved and
+// gives back the rest.
+type quotaMeter struct {
+	userID     int
+	uploaded   int64
+	downloaded int64
+	held       int64 // taken from quotaHeld, including what was used
+}
+
+func newQuotaMeter(userID int) *quotaMeter {
+	return &quotaMeter{userID: userID}
+}
+
+// charge counts bytes uploaded and downloaded, or fails without counting
+// them once they would go over the quota.
+func (q *quotaMeter) charge(uploaded, downloaded int64) error {
+	if q == nil || uploaded+downloaded <= 0 {
+		return nil
+	}
+	if dailyTransferQuota > 0 {
+		used := q.uploaded + q.downloaded + uploaded + downloaded
+		if used > q.held {
+			quotaMutex.Lock()
+			remaining, err := remainingQuotaLocked(q.userID)
+			if err != nil {
+				quotaMutex.Unlock()
+				return err
+			}
+			need := used - q.held
+			if need > remaining {
+				quotaMutex.Unlock()
+				return fmt.Errorf("%w (%s left today)", errQuotaExceeded, formatByteSize(remaining))
+			}
+			take := min(max(need, quotaBlock), remaining)
+			quotaHeld[q.userID] += take
+			q.held += take
+			quotaMutex.Unlock()
+		}
+	}
+	q.uploaded += uploaded
+	q.downloaded += downloaded
+	return nil
+}
+
+// chargeDirection charges n bytes moved in direction.
+func (q *quotaMeter) chargeDirection(direction int, n int64) error {
+	switch direction {
+	case uploadDirection:
+		return q.charge(n, 0)
+	case downloadDirection:
+		return q.charge(0, n)
+	}
+	return q.charge(n, n)
+}
+
+// close records what was charged and gives back the rest of the quota
+// taken.
+func (q *quotaMeter) close() {
+	if q == nil {
+		return
+	}
+	quotaMutex.Lock()
+	defer quotaMutex.Unlock()
+	recordTransferUsage(q.userID, q.uploaded, q.downloaded)
+	if q.held > 0 {
+		quotaHeld[q.userID] -= q.held
+		if quotaHeld[q.userID] <= 0 {
+			delete(quotaHeld, q.userID)
+		}
+	}
+	q.uploaded, q.downloaded, q.held = 0, 0, 0
+}
+
+// transferCap is the most bytes a transfer of unknown size, such as an
+// archive, may move: the size limit or the rest of the quota, whichever is
+// smaller. Bytes is -1 without a cap; reason is the error to report when
+// it is reached.
+type transferCap struct {
+	bytes  int64
+	reason error
+}
+
+func capTransfer(userID int, max byteSize) (transferCap, error) {
+	remaining, err := remainingQuota(userID)
+	if err != nil {
+		return transferCap{}, err
+	}
+	if max > 0 && (remaining < 0 || int64(max) < remaining) {
+		return transferCap{int64(max), errTooLarge}, nil
+	}
+	return transferCap{remaining, errQuotaExceeded}, nil
+}
+
+func usageDay(t time.Time) string {
+	return t.Format("2006-01-02")
+}
+
+// recordTransferUsage adds bytes moved by the user to today's usage.
+func recordTransferUsage(userID int, uploaded, downloaded int64) {
+	if uploaded == 0 && downloaded == 0 {
+		return
+	}
+	if err := addTransferUsageDB(userID, usageDay(time.Now()), uploaded, downloaded); err != nil {
+		log.Printf("Failed to record transfer usage for user %d: %v", userID, err)
+	}
+}
+
+// bandwidthLimiter paces a stream of bytes to rate bytes per second. Up to
+// a second's worth may be sent at once after a pause.
+type bandwidthLimiter struct {
+	rate     int64
+	mutex    sync.Mutex
+	next     time.Time // when the bytes granted so far are paid for
+	lastUsed time.Time
+}
+
+func (l *bandwidthLimiter) wait(ctx context.Context, n int) error {
+	if l == nil || l.rate <= 0 || n <= 0 {
+		return nil
+	}
+	l.mutex.Lock()
+	now := time.Now()
+	l.lastUsed = now
+	if earliest := now.Add(-time.Second); l.next.Before(earliest) {
+		l.next = earliest
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	delay := l.next.Sub(now)
+	l.mutex.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// sessionLimiters holds the upload and download limiters of each browser
+// session. Idle ones are dropped after an hour.
+var (
+	sessionLimiters      = make(map[string]*[2]*bandwidthLimiter)
+	sessionLimitersMutex sync.Mutex
+)
+
+const (
+	uploadDirection   = 0
+	downloadDirection = 1
+	// bothDirections is for data passing through this server from one
+	// host to another, which counts as uploaded and downloaded.
+	bothDirections = 2
+)
+
+// sessionKey identifies the browser session of r for bandwidth limits.
+func sessionKey(r *http.Request) string {
+	if cookie, err := r.Cookie(sessionCookieName); err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+	return "user:" + getSessionUser(r)
+}
+
+// sessionLimiter returns the limiter for one direction of a session, or nil
+// without a bandwidth limit.
+func sessionLimiter(key string, direction int) *bandwidthLimiter {
+	if bandwidthLimit <= 0 {
+		return nil
+	}
+	sessionLimitersMutex.Lock()
+	defer sessionLimitersMutex.Unlock()
+	for k, pair := range sessionLimiters {
+		if idle(pair[0]) && idle(pair[1]) {
+			delete(sessionLimiters, k)
+		}
+	}
+	pair := sessionLimiters[key]
+	if pair == nil {
+		pair = &[2]*bandwidthLimiter{}
+		for i := range pair {
+			pair[i] = &bandwidthLimiter{rate: int64(bandwidthLimit), lastUsed: time.Now()}
+		}
+		sessionLimiters[key] = pair
+	}
+	return pair[direction]
+}
+
+func idle(l *bandwidthLimiter) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return time.Since(l.lastUsed) > time.Hour
+}
+
+// meteredReader counts the bytes read through it, charges them to quota as
+// downloaded and paces them with limiter. quotaErr is kept for readers such
+// as http.ServeContent that do not report why reading stopped.
+type meteredReader struct {
+	r        io.Reader
+	ctx      context.Context
+	limiter  *bandwidthLimiter
+	quota    *quotaMeter
+	n        int64
+	quotaErr error
+}
+
+func (m *meteredReader) Read(p []byte) (int, error) {
+	n, err := m.r.Read(p)
+	if quotaErr := m.quota.charge(0, int64(n)); quotaErr != nil {
+		m.quotaErr = quotaErr
+		return 0, quotaErr
+	}
+	m.n += int64(n)
+	if waitErr := m.limiter.wait(m.ctx, n); waitErr != nil && err == nil {
+		err = waitErr
+	}
+	return n, err
+}
+
+// meteredReadSeeker is meteredReader for http.ServeContent, which seeks to
+// find the size and to serve ranges.
+type meteredReadSeeker struct {
+	*meteredReader
+	s io.Seeker
+}
+
+func (m *meteredReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	return m.s.Seek(offset, whence)
+}
+
+// meteredWriter is the writing counterpart of meteredReader for streams
+// whose size is not known in advance. It fails once cap is reached. What
+// is written is charged to quota in direction.
+type meteredWriter struct {
+	w         io.Writer
+	ctx       context.Context
+	limiter   *bandwidthLimiter
+	cap       transferCap
+	quota     *quotaMeter
+	direction int
+	n         int64
+}
+
+func (m *meteredWriter) Write(p []byte) (int, error) {
+	if m.cap.bytes >= 0 && m.n+int64(len(p)) > m.cap.bytes {
+		return 0, fmt.Errorf("stopped after %s: %w", formatByteSize(m.cap.bytes), m.cap.reason)
+	}
+	if err := m.quota.chargeDirection(m.direction, int64(len(p))); err != nil {
+		return 0, err
+	}
+	if err := m.limiter.wait(m.ctx, len(p)); err != nil {
+		return 0, err
+	}
+	n, err := m.w.Write(p)
+	m.n += int64(n)
+	return n, err
+}
+
+// meteredReaderAt is meteredReader for readers such as zip archives that
+// read at offsets.
+type meteredReaderAt struct {
+	r       io.ReaderAt
+	ctx     context.Context
+	limiter *bandwidthLimiter
+	quota   *quotaMeter
+}
+
+func (m *meteredReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := m.r.ReadAt(p, off)
+	if quotaErr := m.quota.charge(0, int64(n)); quotaErr != nil {
+		return 0, quotaErr
+	}
+	if waitErr := m.limiter.wait(m.ctx, n); waitErr != nil && (err == nil || err == io.EOF) {
+		err = waitErr
+	}
+	return n, err
+}
+
+// streamMeter meters a job that reads from and writes back to a host
+// through this server, such as compressing over SFTP: what is read counts
+// as downloaded and what is written as uploaded. A nil streamMeter leaves
+// streams as they are.
+type streamMeter struct {
+	ctx     context.Context
+	account transferAccount
+	quota   *quotaMeter
+}
+
+func newStreamMeter(ctx context.Context, account transferAccount) *streamMeter {
+	return &streamMeter{ctx: ctx, account: account, quota: account.quota()}
+}
+
+func (m *streamMeter) reader(r io.Reader) io.Reader {
+	if m == nil {
+		return r
+	}
+	return &meteredReader{r: r, ctx: m.ctx, limiter: m.account.limiter(downloadDirection), quota: m.quota}
+}
+
+func (m *streamMeter) readerAt(r io.ReaderAt) io.ReaderAt {
+	if m == nil {
+		return r
+	}
+	return &meteredReaderAt{r: r, ctx: m.ctx, limiter: m.account.limiter(downloadDirection), quota: m.quota}
+}
+
+func (m *streamMeter) writer(w io.Writer) io.Writer {
+	if m == nil {
+		return w
+	}
+	return &meteredWriter{w: w, ctx: m.ctx, limiter: m.account.limiter(uploadDirection), cap: transferCap{bytes: -1}, quota: m.quota, direction: uploadDirection}
+}
+
+// close records what was moved.
+func (m *streamMeter) close() {
+	if m != nil {
+		m.quota.close()
+	}
+}
+
+// limitError reports whether err is a size limit or the quota stopping a
+// transfer, which should end it rather than skip one file.
+func limitError(err error) bool {
+	return errors.Is(err, errTooLarge) || errors.Is(err, errQuotaExceeded)
+}
+
+// transferAccount is whose quota and bandwidth a transfer uses: the user,
+// and the browser session the limits are paced by.
+type transferAccount struct {
+	userID  int
+	session string
+}
+
+func newTransferAccount(r *http.Request, userID int) transferAccount {
+	return transferAccount{userID: userID, session: sessionKey(r)}
+}
+
+func (a transferAccount) limiter(direction int) *bandwidthLimiter {
+	return sessionLimiter(a.session, direction)
+}
+
+// quota returns a meter for one stream's bytes, which must be closed once
+// the stream ends.
+func (a transferAccount) quota() *quotaMeter {
+	return newQuotaMeter(a.userID)
+}
+
+// handleUsage reports the current user's transfer usage for today and the
+// limits that apply to it.
+//
+//	GET /api/usage
+func handleUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, err := getUserByUsernameDB(getSessionUser(r))
+	if err != nil || user == nil {
+		http.Error(w, "User not found", http.StatusUnauthorized)
+		return
+	}
+	usage, err := getTransferUsageDB(user.ID, usageDay(time.Now()))
+	if err != nil {
+		http.Error(w, "Failed to load usage", http.StatusInternalServerError)
+		return
+	}
+	remaining, err := remainingQuota(user.ID)
+	if err != nil {
+		http.Error(w, "Failed to load usage", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"day":               usage.Day,
+		"uploaded":          usage.Uploaded,
+		"downloaded":        usage.Downloaded,
+		"quota":             int64(dailyTransferQuota),
+		"remaining":         remaining,
+		"max_upload_size":   int64(maxUploadSize),
+		"max_download_size": int64(maxDownloadSize),
+		"bandwidth_limit":   int64(bandwidthLimit),
+	})
+}
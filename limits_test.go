@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestByteSizeSet(t *testing.T) {
+	tests := []struct {
+		input string
+		want  byteSize
+		ok    bool
+	}{
+		{"0", 0, true},
+		{"1234", 1234, true},
+		{"512K", 512 << 10, true},
+		{"100m", 100 << 20, true},
+		{"20G", 20 << 30, true},
+		{"2T", 2 << 40, true},
+		{"10MB", 10 << 20, true},
+		{"10kb", 10 << 10, true},
+		{"64B", 64, true},
+		{" 1G ", 1 << 30, true},
+		{"", 0, false},
+		{"-1", 0, false},
+		{"1.5G", 0, false},
+		{"ten", 0, false},
+		{"10X", 0, false},
+		{"K", 0, false},
+		{"9223372036854775807", 1<<63 - 1, true},
+		{"8388608T", 0, false},
+	}
+	for _, tt := range tests {
+		var b byteSize
+		err := b.Set(tt.input)
+		if (err == nil) != tt.ok || b != tt.want {
+			t.Errorf("Set(%q) = %d, %v; want %d, ok %v", tt.input, b, err, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/sftp"
+)
+
+const (
+	defaultListLimit = 500
+	maxListLimit     = 5000
+)
+
+// listOptions controls which part of a directory a "list" request returns.
+type listOptions struct {
+	Sort       string // name, size, mtime or type
+	Desc       bool
+	Filter     string // case-insensitive substring of the name
+	ShowHidden bool
+	Offset     int
+	Limit      int
+}
+
+func listOptionsFromMessage(msg wsMessage) listOptions {
+	opts := listOptions{
+		Sort:       msg.Sort,
+		Desc:       msg.Order == "desc",
+		Filter:     strings.ToLower(msg.Filter),
+		ShowHidden: msg.ShowHidden == nil || *msg.ShowHidden,
+		Offset:     max(msg.Offset, 0),
+		Limit:      msg.Limit,
+	}
+	if opts.Limit <= 0 {
+		opts.Limit = defaultListLimit
+	}
+	opts.Limit = min(opts.Limit, maxListLimit)
+	return opts
+}
+
+// selectEntries filters and sorts a directory and returns the requested
+// page together with the number of entries that matched.
+func selectEntries(files []os.FileInfo, opts listOptions) ([]os.FileInfo, int) {
+	matched := files[:0]
+	for _, f := range files {
+		if !opts.ShowHidden && strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		if opts.Filter != "" && !strings.Contains(strings.ToLower(f.Name()), opts.Filter) {
+			continue
+		}
+		matched = append(matched, f)
+	}
+
+	less := func(a, b os.FileInfo) int {
+		switch opts.Sort {
+		case "size":
+			return cmpInt64(a.Size(), b.Size())
+		case "mtime":
+			return cmpInt64(a.ModTime().UnixNano(), b.ModTime().UnixNano())
+		case "type":
+			return strings.Compare(strings.ToLower(path.Ext(a.Name())), strings.ToLower(path.Ext(b.Name())))
+		}
+		return 0
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		a, b := matched[i], matched[j]
+		// Directories always come first, whatever the order.
+		if a.IsDir() != b.IsDir() {
+			return a.IsDir()
+		}
+		c := less(a, b)
+		if c == 0 {
+			c = strings.Compare(strings.ToLower(a.Name()), strings.ToLower(b.Name()))
+		}
+		if opts.Desc {
+			return c > 0
+		}
+		return c < 0
+	})
+
+	total := len(matched)
+	start := min(opts.Offset, total)
+	end := min(start+opts.Limit, total)
+	return matched[start:end], total
+}
+
+func cmpInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// newFileEntry describes one directory entry. Symlinks are followed to
+// report their target and whether it is a directory, so the browser can
+// navigate through them.
+func newFileEntry(c *sftp.Client, dir string, f os.FileInfo, owners *ownerNames) FileEntry {
+	entry := FileEntry{
+		Name:    f.Name(),
+		Size:    f.Size(),
+		IsDir:   f.IsDir(),
+		Mode:    modeString(f.Mode()),
+		ModTime: f.ModTime(),
+		Hidden:  strings.HasPrefix(f.Name(), "."),
+	}
+	if stat, ok := f.Sys().(*sftp.FileStat); ok {
+		entry.UID = stat.UID
+		entry.GID = stat.GID
+		entry.Owner, entry.Group = owners.lookup(stat.UID, stat.GID)
+	}
+	if f.Mode()&os.ModeSymlink != 0 {
+		full := path.Join(dir, f.Name())
+		entry.IsLink = true
+		entry.LinkTarget, _ = c.ReadLink(full)
+		if target, err := c.Stat(full); err == nil {
+			entry.IsDir = target.IsDir()
+		}
+	}
+	return entry
+}
+
+// modeString formats a mode the way ls -l does.
+func modeString(mode os.FileMode) string {
+	var b [10]byte
+	switch {
+	case mode&os.ModeDir != 0:
+		b[0] = 'd'
+	case mode&os.ModeSymlink != 0:
+		b[0] = 'l'
+	case mode&os.ModeNamedPipe != 0:
+		b[0] = 'p'
+	case mode&os.ModeSocket != 0:
+		b[0] = 's'
+	case mode&os.ModeCharDevice != 0:
+		b[0] = 'c'
+	case mode&os.ModeDevice != 0:
+		b[0] = 'b'
+	default:
+		b[0] = '-'
+	}
+	const rwx = "rwxrwxrwx"
+	for i := 0; i < 9; i++ {
+		if mode&(1<<uint(8-i)) != 0 {
+			b[i+1] = rwx[i]
+		} else {
+			b[i+1] = '-'
+		}
+	}
+	special := func(i int, set bool, c byte) {
+		if !set {
+			return
+		}
+		if b[i] == '-' {
+			c -= 'a' - 'A'
+		}
+		b[i] = c
+	}
+	special(3, mode&os.ModeSetuid != 0, 's')
+	special(6, mode&os.ModeSetgid != 0, 's')
+	special(9, mode&os.ModeSticky != 0, 't')
+	return string(b[:])
+}
+
+// ownerNames maps the remote host's uids and gids to names. SFTP only
+// reports numbers, so the names are read once per transport from
+// /etc/passwd and /etc/group; ids from other sources such as LDAP stay
+// numeric.
+type ownerNames struct {
+	once   sync.Once
+	users  map[uint32]string
+	groups map[uint32]string
+}
+
+func (o *ownerNames) load(c *sftp.Client) {
+	if o == nil {
+		return
+	}
+	o.once.Do(func() {
+		o.users = readIDNames(c, "/etc/passwd")
+		o.groups = readIDNames(c, "/etc/group")
+	})
+}
+
+func (o *ownerNames) lookup(uid, gid uint32) (string, string) {
+	if o == nil {
+		return "", ""
+	}
+	return o.users[uid], o.groups[gid]
+}
+
+// readIDNames parses name:password:id lines, the common prefix of passwd
+// and group files.
+func readIDNames(c *sftp.Client, file string) map[uint32]string {
+	names := make(map[uint32]string)
+	f, err := c.Open(file)
+	if err != nil {
+		return names
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(io.LimitReader(f, 4<<20))
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ":", 4)
+		if len(fields) < 3 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		id, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			continue
+		}
+		if _, seen := names[uint32(id)]; !seen {
+			names[uint32(id)] = fields[0]
+		}
+	}
+	return names
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeFileInfo is a directory entry for tests.
+type fakeFileInfo struct {
+	name  string
+	size  int64
+	mtime time.Time
+	dir   bool
+}
+
+func (f fakeFileInfo) Name() string       { return f.name }
+func (f fakeFileInfo) Size() int64        { return f.size }
+func (f fakeFileInfo) ModTime() time.Time { return f.mtime }
+func (f fakeFileInfo) IsDir() bool        { return f.dir }
+func (f fakeFileInfo) Sys() interface{}   { return nil }
+
+func (f fakeFileInfo) Mode() os.FileMode {
+	if f.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+func TestSelectEntries(t *testing.T) {
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	entries := func() []os.FileInfo {
+		return []os.FileInfo{
+			fakeFileInfo{name: "b.txt", size: 30, mtime: day.Add(2 * time.Hour)},
+			fakeFileInfo{name: "A.log", size: 10, mtime: day.Add(3 * time.Hour)},
+			fakeFileInfo{name: "src", dir: true, mtime: day},
+			fakeFileInfo{name: ".hidden", size: 5, mtime: day.Add(time.Hour)},
+			fakeFileInfo{name: "c.TXT", size: 20, mtime: day.Add(4 * time.Hour)},
+			fakeFileInfo{name: ".git", dir: true, mtime: day},
+		}
+	}
+
+	tests := []struct {
+		name  string
+		opts  listOptions
+		want  []string
+		total int
+	}{
+		{
+			name:  "by name, directories first",
+			opts:  listOptions{ShowHidden: true, Limit: 10},
+			want:  []string{".git", "src", ".hidden", "A.log", "b.txt", "c.TXT"},
+			total: 6,
+		},
+		{
+			name:  "hidden files left out",
+			opts:  listOptions{Limit: 10},
+			want:  []string{"src", "A.log", "b.txt", "c.TXT"},
+			total: 4,
+		},
+		{
+			name:  "descending keeps directories first",
+			opts:  listOptions{Desc: true, Limit: 10},
+			want:  []string{"src", "c.TXT", "b.txt", "A.log"},
+			total: 4,
+		},
+		{
+			name:  "by size",
+			opts:  listOptions{Sort: "size", Limit: 10},
+			want:  []string{"src", "A.log", "c.TXT", "b.txt"},
+			total: 4,
+		},
+		{
+			name:  "by time, newest first",
+			opts:  listOptions{Sort: "mtime", Desc: true, Limit: 10},
+			want:  []string{"src", "c.TXT", "A.log", "b.txt"},
+			total: 4,
+		},
+		{
+			name:  "by type ignores case",
+			opts:  listOptions{Sort: "type", Limit: 10},
+			want:  []string{"src", "A.log", "b.txt", "c.TXT"},
+			total: 4,
+		},
+		{
+			name:  "filter is a substring of the name",
+			opts:  listOptions{Filter: "txt", Limit: 10},
+			want:  []string{"b.txt", "c.TXT"},
+			total: 2,
+		},
+		{
+			name:  "page",
+			opts:  listOptions{Offset: 1, Limit: 2},
+			want:  []string{"A.log", "b.txt"},
+			total: 4,
+		},
+		{
+			name:  "offset past the end",
+			opts:  listOptions{Offset: 10, Limit: 2},
+			want:  []string{},
+			total: 4,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, total := selectEntries(entries(), tt.opts)
+			names := make([]string, len(page))
+			for i, f := range page {
+				names[i] = f.Name()
+			}
+			if !reflect.DeepEqual(names, tt.want) || total != tt.total {
+				t.Errorf("selectEntries() = %v, %d; want %v, %d", names, total, tt.want, tt.total)
+			}
+		})
+	}
+}
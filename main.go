@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"os"
 	"sync"
+	"time"
 )
 
 //go:embed all:static
@@ -21,6 +22,7 @@ var (
 	singleUser         bool
 	disableDownload    bool
 	disableFileBrowser bool
+	healthInterval     time.Duration
 	sessionStore       = make(map[string]string)
 	sessionMutex       sync.RWMutex
 
@@ -39,6 +41,8 @@ func main() {
 		enableTLS bool
 		certFile  string
 		keyFile   string
+
+		healthConcurrency int
 	)
 
 	flag.BoolVar(&noAuth, "no-auth", false, "Disable authentication")
@@ -48,7 +52,18 @@ func main() {
 	flag.StringVar(&keyFile, "key-file", "", "Path to TLS key file")
 	flag.BoolVar(&disableDownload, "disable-download", false, "Disable only the file download functionality")
 	flag.BoolVar(&disableFileBrowser, "disable-file-browser", false, "Disable the entire file browser (upload, download, list)")
+	flag.DurationVar(&healthInterval, "health-interval", 0, "Interval between background reachability checks of saved hosts (0 disables them)")
+	flag.IntVar(&healthConcurrency, "health-concurrency", 8, "Maximum number of hosts probed at the same time by the health checker")
+	flag.IntVar(&transferConcurrency, "transfer-concurrency", 2, "Maximum number of transfers, downloads, copies and archive jobs each user runs at the same time, and separately of upload chunks; others wait in a queue")
+	flag.DurationVar(&sshPool.idleTimeout, "ssh-idle-timeout", 2*time.Minute, "How long a shared SSH connection is kept open after its last tab or transfer ends (0 closes it immediately)")
+	flag.Var(&maxUploadSize, "max-upload-size", "Largest file that can be uploaded, e.g. 500M or 2G (0 means unlimited)")
+	flag.Var(&maxDownloadSize, "max-download-size", "Largest file or directory archive that can be downloaded (0 means unlimited)")
+	flag.Var(&dailyTransferQuota, "daily-transfer-quota", "Bytes each user may upload and download per day, combined (0 means unlimited)")
+	flag.Var(&bandwidthLimit, "bandwidth-limit", "Bytes per second each browser session may upload, and separately download (0 means unlimited)")
 	flag.Parse()
+	if transferConcurrency < 1 {
+		log.Fatal("FATAL: --transfer-concurrency must be at least 1.")
+	}
 
 	log.Printf("Starting WebSSH application...")
 
@@ -95,11 +110,16 @@ func main() {
 
 	loadUsersIntoMemory()
 
+	if healthInterval > 0 {
+		go runHealthChecker(healthInterval, healthConcurrency)
+	}
+
 	staticFS, _ := fs.Sub(staticFiles, "static")
 	staticServer := http.FileServer(http.FS(staticFS))
 
 	// Authentication routes
 	http.HandleFunc("/login", handleLogin)
+	http.HandleFunc("/login/2fa", handleLoginSecondFactor)
 	http.HandleFunc("/register", handleRegister)
 	http.Handle("/logout", authMiddleware(http.HandlerFunc(handleLogout)))
 
@@ -108,13 +128,28 @@ func main() {
 	http.Handle("/admin/page", authMiddleware(http.HandlerFunc(handleAdminPage)))
 	http.Handle("/api/admin/approve", authMiddleware(http.HandlerFunc(handleAdminApprove)))
 	http.Handle("/api/admin/users/", authMiddleware(http.HandlerFunc(handleAdminUsers)))
+	http.Handle("/api/admin/audit", authMiddleware(http.HandlerFunc(handleAdminAudit)))
+	http.Handle("/api/admin/usage", authMiddleware(http.HandlerFunc(handleAdminUsage)))
+	http.Handle("/api/admin/settings", authMiddleware(http.HandlerFunc(handleAdminSettings)))
 
 	// Core application routes
 	http.Handle("/static/", http.StripPrefix("/static/", staticServer))
 	http.Handle("/", authMiddleware(http.HandlerFunc(handleRoot)))
 	http.Handle("/api/connections", authMiddleware(http.HandlerFunc(handleConnections)))
+	http.Handle("/api/connections/test", authMiddleware(http.HandlerFunc(handleConnectionTest)))
+	http.Handle("/api/algorithms", authMiddleware(http.HandlerFunc(handleAlgorithms)))
 	http.Handle("/ws", authMiddleware(http.HandlerFunc(handleWebSocket)))
+	http.Handle("/api/uploads", authMiddleware(http.HandlerFunc(handleUploads)))
+	http.Handle("/api/uploads/", authMiddleware(http.HandlerFunc(handleUploads)))
+	http.Handle("/api/download", authMiddleware(http.HandlerFunc(handleDownload)))
+	http.Handle("/api/preview", authMiddleware(http.HandlerFunc(handlePreview)))
+	http.Handle("/api/transfers", authMiddleware(http.HandlerFunc(handleTransfers)))
+	http.Handle("/api/transfers/", authMiddleware(http.HandlerFunc(handleTransfers)))
 	http.Handle("/api/features", authMiddleware(http.HandlerFunc(handleFeatures)))
+	http.Handle("/api/usage", authMiddleware(http.HandlerFunc(handleUsage)))
+	http.Handle("/api/2fa", authMiddleware(http.HandlerFunc(handleTwoFactor)))
+	// WebDAV clients authenticate themselves, see davAuthenticate.
+	http.HandleFunc(davPrefix, handleWebDAV)
 
 	if enableTLS {
 		log.Println("Server started with TLS on :8443")
@@ -9,6 +9,14 @@ type User struct {
 	IsAdmin          bool      `json:"is_admin"`
 	IsApproved       bool      `json:"is_approved"`
 	RegistrationDate time.Time `json:"registration_date"`
+	// AllowedRoots confines the user's file browser; empty means anywhere.
+	AllowedRoots []string `json:"allowed_roots,omitempty"`
+	// FilesOnly limits the user to file-only sessions, which open the
+	// SFTP subsystem without a shell or PTY.
+	FilesOnly bool `json:"files_only"`
+	// TOTPEnabled is set once the user has enrolled an authenticator app;
+	// logging in then also needs a code from it.
+	TOTPEnabled bool `json:"totp_enabled"`
 }
 
 type SSHConnection struct {
@@ -18,19 +26,104 @@ type SSHConnection struct {
 	User     string `json:"user"`
 	Password string `json:"password,omitempty"`
 	Key      string `json:"key,omitempty"`
+
+	// StartupCommand is typed into the shell whenever a terminal connects
+	// or reconnects, e.g. to change directory or attach to tmux.
+	StartupCommand string `json:"startup_command,omitempty"`
+
+	DisableHealthCheck bool              `json:"disable_health_check"`
+	Health             *ConnectionHealth `json:"health,omitempty"`
+
+	// Algorithm overrides for hosts that only speak older algorithms. Empty
+	// lists fall back to the preset, then to the x/crypto/ssh defaults.
+	AlgorithmPreset   string   `json:"algorithm_preset,omitempty"`
+	KeyExchanges      []string `json:"key_exchanges,omitempty"`
+	Ciphers           []string `json:"ciphers,omitempty"`
+	MACs              []string `json:"macs,omitempty"`
+	HostKeyAlgorithms []string `json:"host_key_algorithms,omitempty"`
+
+	// AllowedRoots is set by an admin and confines the file browser on
+	// this connection, on top of the user's own roots.
+	AllowedRoots []string `json:"allowed_roots,omitempty"`
+}
+
+// AuditEvent records a refused file operation.
+type AuditEvent struct {
+	ID           int       `json:"id"`
+	CreatedAt    time.Time `json:"created_at"`
+	Username     string    `json:"username"`
+	ConnectionID int       `json:"connection_id"`
+	Action       string    `json:"action"`
+	Path         string    `json:"path"`
+	Detail       string    `json:"detail"`
+}
+
+// TransferUsage is how many bytes a user uploaded and downloaded on one day.
+type TransferUsage struct {
+	Username   string `json:"username,omitempty"`
+	Day        string `json:"day"`
+	Uploaded   int64  `json:"uploaded"`
+	Downloaded int64  `json:"downloaded"`
+}
+
+type ConnectionHealth struct {
+	Status          string     `json:"status"` // "up" or "down"
+	LatencyMs       int64      `json:"latency_ms"`
+	Banner          string     `json:"banner,omitempty"`
+	PreviousBanner  string     `json:"previous_banner,omitempty"`
+	BannerChangedAt *time.Time `json:"banner_changed_at,omitempty"`
+	Error           string     `json:"error,omitempty"`
+	CheckedAt       time.Time  `json:"checked_at"`
 }
 
 type wsMessage struct {
-	Type     string `json:"type"`
-	Payload  string `json:"payload,omitempty"`
-	Filename string `json:"filename,omitempty"`
-	Path     string `json:"path,omitempty"`
-	Cols     int    `json:"cols,omitempty"`
-	Rows     int    `json:"rows,omitempty"`
+	Type    string `json:"type"`
+	Code    string `json:"code,omitempty"`
+	Payload string `json:"payload,omitempty"`
+	Path    string `json:"path,omitempty"`
+	Cols    int    `json:"cols,omitempty"`
+	Rows    int    `json:"rows,omitempty"`
+
+	// File operations: ID is echoed back in the result, Target is the
+	// destination of rename, copy and symlink, Mode is octal for chmod.
+	ID        string `json:"id,omitempty"`
+	Target    string `json:"target,omitempty"`
+	Mode      string `json:"mode,omitempty"`
+	UID       *int   `json:"uid,omitempty"`
+	GID       *int   `json:"gid,omitempty"`
+	Recursive bool   `json:"recursive,omitempty"`
+
+	// Editor saves: Hash is the content the edit started from, Force
+	// overwrites even if the file has changed since. For checksums, Hash
+	// is the SHA-256 the file should have.
+	Hash  string `json:"hash,omitempty"`
+	Force bool   `json:"force,omitempty"`
+
+	// Listings: Sort is name, size, mtime or type and Order asc or desc.
+	// Hidden entries are included unless ShowHidden is false.
+	Sort       string `json:"sort,omitempty"`
+	Order      string `json:"order,omitempty"`
+	Filter     string `json:"filter,omitempty"`
+	ShowHidden *bool  `json:"showHidden,omitempty"`
+	Offset     int    `json:"offset,omitempty"`
+	Limit      int    `json:"limit,omitempty"`
+
+	// Extracting archives: what to do with files that already exist
+	// (overwrite, skip or rename).
+	OnConflict string `json:"onConflict,omitempty"`
 }
 
 type FileEntry struct {
-	Name  string `json:"name"`
-	Size  int64  `json:"size"`
-	IsDir bool   `json:"isDir"`
+	Name       string    `json:"name"`
+	Size       int64     `json:"size"`
+	IsDir      bool      `json:"isDir"`
+	Mode       string    `json:"mode"`
+	ModTime    time.Time `json:"mtime"`
+	UID        uint32    `json:"uid"`
+	GID        uint32    `json:"gid"`
+	Owner      string    `json:"owner,omitempty"`
+	Group      string    `json:"group,omitempty"`
+	IsLink     bool      `json:"isLink,omitempty"`
+	LinkTarget string    `json:"linkTarget,omitempty"`
+	Hidden     bool      `json:"hidden,omitempty"`
 }
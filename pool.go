@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	keepaliveInterval = 15 * time.Second
+	keepaliveTimeout  = 15 * time.Second
+)
+
+// sshPool shares one SSH transport per user and saved connection, in the
+// spirit of OpenSSH's ControlMaster. Terminal tabs, SFTP and exec calls open
+// their own channels on it.
+var sshPool = &sshClientPool{
+	entries:  make(map[string]*pooledClient),
+	byClient: make(map[*ssh.Client]*pooledClient),
+}
+
+type pooledClient struct {
+	key   string
+	ready chan struct{} // closed once dialing has finished
+	// client and err are set before ready is closed.
+	client *ssh.Client
+	err    error
+	// lost is closed once the transport has died, after lostErr is set.
+	lost    chan struct{}
+	lostErr error
+
+	refs      int
+	evicted   bool
+	idleTimer *time.Timer
+	sftp      sftpClientManager
+	owners    ownerNames
+}
+
+type sshClientPool struct {
+	mutex    sync.Mutex
+	entries  map[string]*pooledClient
+	byClient map[*ssh.Client]*pooledClient
+	// idleTimeout is how long a transport with no users is kept open.
+	idleTimeout time.Duration
+}
+
+func poolKey(userID, connID int) string {
+	return fmt.Sprintf("%d:%d", userID, connID)
+}
+
+// Acquire returns the shared transport for a user's saved connection,
+// dialing it if there is none. Concurrent callers wait for the same dial.
+// The returned release function must be called once the caller no longer
+// needs the transport; calling it more than once is harmless.
+func (p *sshClientPool) Acquire(userID int, details *SSHConnection) (*ssh.Client, func(), error) {
+	key := poolKey(userID, details.ID)
+
+	p.mutex.Lock()
+	entry := p.entries[key]
+	if entry == nil {
+		entry = &pooledClient{key: key, ready: make(chan struct{}), lost: make(chan struct{})}
+		p.entries[key] = entry
+		go p.dial(entry, details)
+	}
+	entry.refs++
+	if entry.idleTimer != nil {
+		entry.idleTimer.Stop()
+		entry.idleTimer = nil
+	}
+	p.mutex.Unlock()
+
+	<-entry.ready
+	if entry.err != nil {
+		p.release(entry)
+		return nil, nil, entry.err
+	}
+
+	var once sync.Once
+	return entry.client, func() { once.Do(func() { p.release(entry) }) }, nil
+}
+
+func (p *sshClientPool) dial(entry *pooledClient, details *SSHConnection) {
+	client, err := dialSSH(details)
+
+	p.mutex.Lock()
+	entry.client, entry.err = client, err
+	if err != nil {
+		// Let the next Acquire try again.
+		p.removeLocked(entry)
+	} else {
+		p.byClient[client] = entry
+	}
+	p.mutex.Unlock()
+	close(entry.ready)
+
+	if err == nil {
+		go p.watch(entry)
+	}
+}
+
+// watch keeps the transport alive and drops it from the pool when it dies.
+func (p *sshClientPool) watch(entry *pooledClient) {
+	stop := make(chan struct{})
+	go keepalive(entry.client, stop)
+	entry.lostErr = entry.client.Wait()
+	close(stop)
+	close(entry.lost)
+
+	p.mutex.Lock()
+	p.removeLocked(entry)
+	delete(p.byClient, entry.client)
+	p.mutex.Unlock()
+	entry.sftp.Close()
+}
+
+func (p *sshClientPool) removeLocked(entry *pooledClient) {
+	if p.entries[entry.key] == entry {
+		delete(p.entries, entry.key)
+	}
+}
+
+func (p *sshClientPool) release(entry *pooledClient) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	entry.refs--
+	if entry.refs > 0 || entry.client == nil {
+		return
+	}
+	if entry.evicted || p.entries[entry.key] != entry || p.idleTimeout <= 0 {
+		p.removeLocked(entry)
+		go p.closeEntry(entry)
+		return
+	}
+	entry.idleTimer = time.AfterFunc(p.idleTimeout, func() {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		if entry.refs == 0 {
+			p.removeLocked(entry)
+			go p.closeEntry(entry)
+		}
+	})
+}
+
+func (p *sshClientPool) closeEntry(entry *pooledClient) {
+	entry.sftp.Close()
+	entry.client.Close()
+}
+
+// Evict stops handing out the current transport for a connection, e.g.
+// after its settings changed. Users of the old transport keep it until they
+// release it.
+func (p *sshClientPool) Evict(userID, connID int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	entry := p.entries[poolKey(userID, connID)]
+	if entry == nil {
+		return
+	}
+	p.removeLocked(entry)
+	entry.evicted = true
+	if entry.refs == 0 && entry.client != nil {
+		if entry.idleTimer != nil {
+			entry.idleTimer.Stop()
+		}
+		go p.closeEntry(entry)
+	}
+}
+
+// Lost returns a channel that is closed once client's transport has died,
+// and a function that then returns the error it ended with. Waiting on it
+// needs no goroutine of its own, unlike client.Wait.
+func (p *sshClientPool) Lost(client *ssh.Client) (<-chan struct{}, func() error) {
+	p.mutex.Lock()
+	entry := p.byClient[client]
+	p.mutex.Unlock()
+	if entry == nil {
+		lost := make(chan struct{})
+		close(lost)
+		return lost, func() error { return nil }
+	}
+	return entry.lost, func() error { return entry.lostErr }
+}
+
+// SFTP returns the SFTP client shared by everyone using the transport.
+func (p *sshClientPool) SFTP(client *ssh.Client) (*sftp.Client, error) {
+	p.mutex.Lock()
+	entry := p.byClient[client]
+	p.mutex.Unlock()
+	if entry == nil {
+		return nil, errors.New("SSH connection is closed")
+	}
+	return entry.sftp.Get(client)
+}
+
+// Owners returns the cache of the remote host's user and group names, or
+// nil if the transport is no longer pooled.
+func (p *sshClientPool) Owners(client *ssh.Client) *ownerNames {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if entry := p.byClient[client]; entry != nil {
+		return &entry.owners
+	}
+	return nil
+}
+
+// keepalive closes the client when the server stops answering, so that a
+// silently dropped network is noticed instead of hanging forever.
+func keepalive(client *ssh.Client, stop <-chan struct{}) {
+	ticker := time.NewTicker(keepaliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		if err := pingTransport(client, keepaliveTimeout); err != nil {
+			client.Close()
+			return
+		}
+	}
+}
+
+// pingTransport sends a keepalive request and waits up to timeout for the
+// server to answer. Any answer, even a refusal, means the transport is alive.
+func pingTransport(client *ssh.Client, timeout time.Duration) error {
+	reply := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		reply <- err
+	}()
+	select {
+	case err := <-reply:
+		return err
+	case <-time.After(timeout):
+		return errors.New("keepalive timed out")
+	}
+}
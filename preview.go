@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+const (
+	// defaultPreviewText is how much of a text file is shown unless the
+	// request asks for more, up to maxPreviewSize.
+	defaultPreviewText = 256 << 10
+	// maxPreviewSize caps a preview. Images and PDFs cannot be shown in
+	// part, so larger ones are not previewed at all.
+	maxPreviewSize = 10 << 20
+	// sniffLen is how much http.DetectContentType looks at.
+	sniffLen = 512
+)
+
+// Kinds of preview, reported in the X-Preview-Kind header.
+const (
+	previewText  = "text"
+	previewImage = "image"
+	previewPDF   = "pdf"
+)
+
+// previewImageTypes are the image types browsers display. SVG is included:
+// it is only shown through <img>, which does not run its scripts, and the
+// response is sandboxed in case it is opened directly.
+var previewImageTypes = map[string]bool{
+	"image/png":                true,
+	"image/jpeg":               true,
+	"image/gif":                true,
+	"image/webp":               true,
+	"image/bmp":                true,
+	"image/x-icon":             true,
+	"image/vnd.microsoft.icon": true,
+	"image/svg+xml":            true,
+}
+
+// handlePreview sends the start of a remote file for display in the
+// browser. Text is converted to UTF-8; images and PDFs are sent as they are
+// if they fit in maxPreviewSize. Other types are refused with 415.
+//
+//	GET /api/preview?id=...&path=...&bytes=N
+//
+// The response carries X-Preview-Kind (text, image or pdf), X-Preview-Type
+// (the detected MIME type), X-File-Size and, for text, X-Preview-Encoding
+// and X-Preview-Truncated.
+func handlePreview(w http.ResponseWriter, r *http.Request) {
+	if disableFileBrowser || disableDownload {
+		http.Error(w, "Downloads are disabled", http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := getUserByUsernameDB(getSessionUser(r))
+	if err != nil || user == nil {
+		http.Error(w, "User not found", http.StatusInternalServerError)
+		return
+	}
+	query := r.URL.Query()
+	remotePath := query.Get("path")
+	if remotePath == "" {
+		http.Error(w, "Path required", http.StatusBadRequest)
+		return
+	}
+	textLimit := int64(defaultPreviewText)
+	if value := query.Get("bytes"); value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid byte count", http.StatusBadRequest)
+			return
+		}
+		textLimit = min(n, maxPreviewSize)
+	}
+
+	sftpClient, jail, release, err := acquireConnectionSFTP(user.ID, query.Get("id"))
+	if err != nil {
+		http.Error(w, "Failed to get SFTP client: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer release()
+
+	if remotePath, err = jail.Resolve(sftpClient, "preview", remotePath); err != nil {
+		http.Error(w, err.Error(), pathErrorStatus(err))
+		return
+	}
+	f, err := sftpClient.Open(remotePath)
+	if err != nil {
+		http.Error(w, "Failed to open remote file: "+err.Error(), http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		http.Error(w, "Failed to stat remote file: "+err.Error(), http.StatusNotFound)
+		return
+	}
+	if !stat.Mode().IsRegular() {
+		http.Error(w, "Only regular files can be previewed", http.StatusBadRequest)
+		return
+	}
+
+	account := newTransferAccount(r, user.ID)
+	quota := account.quota()
+	defer quota.close()
+	p := &remotePreview{size: stat.Size(), r: &meteredReader{r: f, ctx: r.Context(), limiter: account.limiter(downloadDirection), quota: quota}}
+
+	head, err := p.read(sniffLen)
+	if err != nil {
+		http.Error(w, "Failed to read remote file: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	mimeType, kind := detectPreviewType(remotePath, head)
+	if kind == "" {
+		http.Error(w, "No preview for "+mimeType, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	limit := textLimit
+	if kind != previewText {
+		limit = maxPreviewSize
+	} else if maxDownloadSize > 0 {
+		limit = min(limit, int64(maxDownloadSize))
+	}
+	if kind != previewText && stat.Size() > limit {
+		http.Error(w, "File is too large to preview; download it instead", http.StatusRequestEntityTooLarge)
+		return
+	}
+	// The preview is a download of its own, so the same limits apply;
+	// text is only shortened to fit the size limit.
+	if err := checkTransferSize(user.ID, min(stat.Size(), limit), maxDownloadSize); err != nil {
+		http.Error(w, err.Error(), limitStatus(err))
+		return
+	}
+	data, err := p.read(limit)
+	if err != nil {
+		http.Error(w, "Failed to read remote file: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	truncated := int64(len(data)) < stat.Size()
+
+	contentType := mimeType
+	header := w.Header()
+	if kind == previewText {
+		encoding, text, ok := decodePreviewText(data, truncated)
+		if !ok {
+			http.Error(w, "No preview for "+mimeType, http.StatusUnsupportedMediaType)
+			return
+		}
+		data = []byte(text)
+		contentType = "text/plain; charset=utf-8"
+		header.Set("X-Preview-Encoding", encoding)
+		header.Set("X-Preview-Truncated", strconv.FormatBool(truncated))
+	}
+	if kind != previewPDF {
+		// Browsers refuse to show PDFs in a sandbox; everything else is
+		// kept from running scripts if the URL is opened directly.
+		header.Set("Content-Security-Policy", "sandbox")
+	}
+	header.Set("Content-Type", contentType)
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": path.Base(remotePath)}))
+	header.Set("Cache-Control", "no-store")
+	header.Set("X-Preview-Kind", kind)
+	header.Set("X-Preview-Type", mimeType)
+	header.Set("X-File-Size", strconv.FormatInt(stat.Size(), 10))
+	header.Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+// remotePreview reads the start of a remote file, keeping what it has read
+// so the bytes sniffed are not fetched twice.
+type remotePreview struct {
+	size int64
+	r    *meteredReader
+	buf  []byte
+}
+
+// read returns the first n bytes of the file, or all of it if shorter.
+func (p *remotePreview) read(n int64) ([]byte, error) {
+	n = min(n, p.size)
+	if int64(len(p.buf)) < n {
+		more := make([]byte, n-int64(len(p.buf)))
+		m, err := io.ReadFull(p.r, more)
+		p.buf = append(p.buf, more[:m]...)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return nil, err
+		}
+	}
+	return p.buf[:min(n, int64(len(p.buf)))], nil
+}
+
+// detectPreviewType sniffs the MIME type of a file from its first bytes,
+// falling back to its extension for types that cannot be sniffed, such as
+// SVG or JSON. It returns "" as the kind when there is no preview for it.
+func detectPreviewType(name string, head []byte) (string, string) {
+	mimeType := http.DetectContentType(head)
+	if byExt := mime.TypeByExtension(path.Ext(name)); byExt != "" {
+		generic := mimeType == "application/octet-stream" || strings.HasPrefix(mimeType, "text/plain") || strings.HasPrefix(mimeType, "text/xml")
+		if generic {
+			mimeType = byExt
+		}
+	}
+	base, _, _ := mime.ParseMediaType(mimeType)
+	switch {
+	case previewImageTypes[base]:
+		return base, previewImage
+	case base == "application/pdf":
+		return base, previewPDF
+	case strings.HasPrefix(base, "text/"), base == "application/json", base == "application/xml",
+		base == "application/javascript", base == "application/x-sh", base == "application/octet-stream":
+		// Unknown data may still be text in an encoding the sniffer does
+		// not know; decodePreviewText decides.
+		return mimeType, previewText
+	}
+	return mimeType, ""
+}
+
+// decodePreviewText detects the encoding of data and returns it converted
+// to UTF-8. Byte order marks are honoured; without one, UTF-8 and then
+// UTF-16 are tried, and text in neither is read as ISO-8859-1 unless it
+// contains control characters that no text file would. When truncated is
+// set, a character cut off at the end is dropped.
+func decodePreviewText(data []byte, truncated bool) (string, string, bool) {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xEF, 0xBB, 0xBF}):
+		data = data[3:]
+	case bytes.HasPrefix(data, []byte{0xFF, 0xFE}):
+		return "utf-16le", decodeUTF16(data[2:], false), true
+	case bytes.HasPrefix(data, []byte{0xFE, 0xFF}):
+		return "utf-16be", decodeUTF16(data[2:], true), true
+	}
+
+	if truncated {
+		// Drop a multi-byte character cut off by the read limit.
+		for i := 0; i < utf8.UTFMax && i < len(data); i++ {
+			if utf8.RuneStart(data[len(data)-1-i]) {
+				if !utf8.FullRune(data[len(data)-1-i:]) {
+					data = data[:len(data)-1-i]
+				}
+				break
+			}
+		}
+	}
+	if utf8.Valid(data) && !hasBinaryControls(data) {
+		return "utf-8", string(data), true
+	}
+	if bigEndian, ok := looksUTF16(data); ok {
+		if bigEndian {
+			return "utf-16be", decodeUTF16(data, true), true
+		}
+		return "utf-16le", decodeUTF16(data, false), true
+	}
+	if hasBinaryControls(data) {
+		return "", "", false
+	}
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+	return "iso-8859-1", string(runes), true
+}
+
+// hasBinaryControls reports control characters other than the whitespace,
+// form feed and escape found in text files and terminal logs.
+func hasBinaryControls(data []byte) bool {
+	for _, b := range data {
+		if b < 0x20 && b != '\t' && b != '\n' && b != '\r' && b != '\f' && b != 0x1b {
+			return true
+		}
+	}
+	return false
+}
+
+// looksUTF16 guesses whether data is UTF-16 without a byte order mark:
+// mostly-ASCII text in UTF-16 has a zero in every other byte.
+func looksUTF16(data []byte) (bool, bool) {
+	if len(data) < 4 {
+		return false, false
+	}
+	var evenZeros, oddZeros int
+	for i, b := range data {
+		if b != 0 {
+			continue
+		}
+		if i%2 == 0 {
+			evenZeros++
+		} else {
+			oddZeros++
+		}
+	}
+	half := len(data) / 2
+	switch {
+	case oddZeros > half*3/4 && evenZeros == 0:
+		return false, true
+	case evenZeros > half*3/4 && oddZeros == 0:
+		return true, true
+	}
+	return false, false
+}
+
+func decodeUTF16(data []byte, bigEndian bool) string {
+	units := make([]uint16, len(data)/2)
+	for i := range units {
+		if bigEndian {
+			units[i] = uint16(data[2*i])<<8 | uint16(data[2*i+1])
+		} else {
+			units[i] = uint16(data[2*i+1])<<8 | uint16(data[2*i])
+		}
+	}
+	return string(utf16.Decode(units))
+}
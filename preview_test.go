@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestDecodePreviewText(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      string
+		truncated bool
+		encoding  string
+		text      string
+		ok        bool
+	}{
+		{"ascii", "hello\nworld\n", false, "utf-8", "hello\nworld\n", true},
+		{"utf-8", "caf\xc3\xa9", false, "utf-8", "café", true},
+		{"utf-8 with bom", "\xef\xbb\xbfhi", false, "utf-8", "hi", true},
+		{"terminal colours", "\x1b[31mred\x1b[0m\r\n", false, "utf-8", "\x1b[31mred\x1b[0m\r\n", true},
+		{"utf-16le with bom", "\xff\xfeh\x00i\x00", false, "utf-16le", "hi", true},
+		{"utf-16be with bom", "\xfe\xff\x00h\x00i", false, "utf-16be", "hi", true},
+		{"utf-16le without bom", "h\x00e\x00l\x00l\x00o\x00", false, "utf-16le", "hello", true},
+		{"utf-16be without bom", "\x00h\x00e\x00l\x00l\x00o", false, "utf-16be", "hello", true},
+		{"latin-1", "caf\xe9", false, "iso-8859-1", "café", true},
+		{"cut character dropped", "caf\xc3", true, "utf-8", "caf", true},
+		{"cut four-byte character dropped", "ok \xf0\x9f\x98", true, "utf-8", "ok ", true},
+		{"whole character kept", "caf\xc3\xa9", true, "utf-8", "café", true},
+		{"incomplete without truncation", "caf\xc3", false, "iso-8859-1", "cafÃ", true},
+		{"binary", "\x00\x01\x02\x03\x04\x05\x06\x07", false, "", "", false},
+		{"latin-1 with controls", "caf\xe9\x01", false, "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoding, text, ok := decodePreviewText([]byte(tt.data), tt.truncated)
+			if encoding != tt.encoding || text != tt.text || ok != tt.ok {
+				t.Errorf("decodePreviewText(%q, %v) = %q, %q, %v; want %q, %q, %v",
+					tt.data, tt.truncated, encoding, text, ok, tt.encoding, tt.text, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Uploads and downloads fall back to the SCP protocol on hosts that do not
+// offer the SFTP subsystem, such as embedded devices and dropbear builds
+// without sftp-server. The remote scp program is run in sink mode
+// ("scp -t") to receive files and in source mode ("scp -f") to send them.
+
+var (
+	errSFTPUnavailable = errors.New("SFTP is not available on this host")
+	errSCPConfined     = errors.New("file roots cannot be enforced on hosts without SFTP")
+)
+
+const (
+	maxSCPStderr = 4096
+	// maxSCPLine bounds a protocol line, which holds at most a file name
+	// and a few numbers.
+	maxSCPLine = 8192
+)
+
+// scpError is an error reported by the remote scp. Warnings concern a
+// single file, and a recursive transfer goes on after them.
+type scpError struct {
+	msg     string
+	warning bool
+}
+
+func (e *scpError) Error() string {
+	return strings.TrimPrefix(e.msg, "scp: ")
+}
+
+// scpSession is one run of the remote scp program.
+type scpSession struct {
+	session *ssh.Session
+	in      io.WriteCloser
+	out     *bufio.Reader
+	stderr  *limitedTail
+}
+
+func startSCP(client *ssh.Client, args, p string) (*scpSession, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	in, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	out, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	stderr := &limitedTail{max: maxSCPStderr}
+	session.Stderr = stderr
+	if err := session.Start("scp " + args + " " + shellQuote(scpPathArg(p))); err != nil {
+		session.Close()
+		return nil, fmt.Errorf("failed to start scp: %w", err)
+	}
+	return &scpSession{session: session, in: in, out: bufio.NewReader(out), stderr: stderr}, nil
+}
+
+// scpPathArg keeps a path from being taken for an option, since older scp
+// builds do not understand "--". An empty path is the home directory.
+func scpPathArg(p string) string {
+	if p == "" {
+		return "."
+	}
+	if strings.HasPrefix(p, "-") {
+		return "./" + p
+	}
+	return p
+}
+
+// readResponse reads the status byte that answers each step: zero for
+// success, or 1 (warning) or 2 (fatal error) followed by a message.
+func (s *scpSession) readResponse() error {
+	b, err := s.out.ReadByte()
+	if err != nil {
+		return s.failure(err)
+	}
+	switch b {
+	case 0:
+		return nil
+	case 1, 2:
+		line, err := s.readLine()
+		if err != nil {
+			return s.failure(err)
+		}
+		return &scpError{msg: line, warning: b == 1}
+	}
+	return fmt.Errorf("unexpected scp response %q", b)
+}
+
+func (s *scpSession) readLine() (string, error) {
+	var line []byte
+	for {
+		chunk, err := s.out.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > maxSCPLine {
+			return "", errors.New("scp protocol line too long")
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSuffix(string(line), "\n"), nil
+	}
+}
+
+func (s *scpSession) sendOK() error {
+	_, err := s.in.Write([]byte{0})
+	return err
+}
+
+// failure explains a session that stopped talking, usually because scp is
+// not installed or refused to start.
+func (s *scpSession) failure(err error) error {
+	if err == io.EOF {
+		s.session.Wait()
+		if msg := strings.TrimSpace(s.stderr.String()); msg != "" {
+			return fmt.Errorf("scp failed: %s", msg)
+		}
+		return errors.New("scp ended unexpectedly; the host may not have scp installed")
+	}
+	return err
+}
+
+// close ends a finished transfer and waits for scp to exit.
+func (s *scpSession) close() error {
+	s.in.Close()
+	err := s.session.Wait()
+	s.session.Close()
+	if err != nil {
+		if msg := strings.TrimSpace(s.stderr.String()); msg != "" {
+			return fmt.Errorf("scp failed: %s", msg)
+		}
+	}
+	return err
+}
+
+func (s *scpSession) abort() {
+	s.session.Close()
+}
+
+// scpUpload sends one file of a known size to the remote scp in sink mode.
+// Directories between dir and the file are created on the way, as
+// "scp -r" does.
+type scpUpload struct {
+	s         *scpSession
+	remaining int64
+	dirs      int
+}
+
+func startSCPUpload(client *ssh.Client, dir string, subdirs []string, name string, size int64) (*scpUpload, error) {
+	for _, n := range append(subdirs, name) {
+		if strings.ContainsAny(n, "\n\r") {
+			return nil, fmt.Errorf("scp cannot send the name %q", n)
+		}
+	}
+	s, err := startSCP(client, "-r -t", dir)
+	if err != nil {
+		return nil, err
+	}
+	u := &scpUpload{s: s, remaining: size, dirs: len(subdirs)}
+	if err := s.readResponse(); err != nil {
+		s.abort()
+		return nil, err
+	}
+	for _, d := range subdirs {
+		if err := u.send(fmt.Sprintf("D0755 0 %s\n", d)); err != nil {
+			return nil, err
+		}
+	}
+	if err := u.send(fmt.Sprintf("C0644 %d %s\n", size, name)); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// send writes a protocol record and waits for it to be accepted.
+func (u *scpUpload) send(record string) error {
+	if _, err := io.WriteString(u.s.in, record); err != nil {
+		u.s.abort()
+		return err
+	}
+	if err := u.s.readResponse(); err != nil {
+		u.s.abort()
+		return err
+	}
+	return nil
+}
+
+func (u *scpUpload) Write(p []byte) (int, error) {
+	if int64(len(p)) > u.remaining {
+		return 0, errors.New("more data than the size given to scp")
+	}
+	n, err := u.s.in.Write(p)
+	u.remaining -= int64(n)
+	return n, err
+}
+
+// Close completes the file once all of it has been written, and reports
+// whether scp stored it.
+func (u *scpUpload) Close() error {
+	if u.remaining > 0 {
+		u.s.abort()
+		return fmt.Errorf("upload ended %d bytes short", u.remaining)
+	}
+	if err := u.send("\x00"); err != nil {
+		return err
+	}
+	for i := 0; i < u.dirs; i++ {
+		if err := u.send("E\n"); err != nil {
+			return err
+		}
+	}
+	return u.s.close()
+}
+
+func (u *scpUpload) abort() {
+	u.s.abort()
+}
+
+// scpEntry is a record sent by scp in source mode: a file, a directory, or
+// the end of the current directory.
+type scpEntry struct {
+	name    string
+	mode    os.FileMode
+	size    int64
+	modTime time.Time
+	isDir   bool
+	end     bool
+}
+
+func (e *scpEntry) info() os.FileInfo {
+	return &scpFileInfo{e}
+}
+
+type scpFileInfo struct{ e *scpEntry }
+
+func (i *scpFileInfo) Name() string { return i.e.name }
+func (i *scpFileInfo) Size() int64  { return i.e.size }
+func (i *scpFileInfo) Mode() os.FileMode {
+	if i.e.isDir {
+		return i.e.mode | os.ModeDir
+	}
+	return i.e.mode
+}
+func (i *scpFileInfo) ModTime() time.Time { return i.e.modTime }
+func (i *scpFileInfo) IsDir() bool        { return i.e.isDir }
+func (i *scpFileInfo) Sys() interface{}   { return nil }
+
+// scpDownload receives files from the remote scp in source mode. With
+// recursive set, directories arrive as a "D" record, their contents and an
+// "E" record.
+type scpDownload struct {
+	s       *scpSession
+	started bool
+	modTime time.Time
+	// body is the unread data of the file last returned by next.
+	body    io.Reader
+	pending bool
+}
+
+func startSCPDownload(client *ssh.Client, p string, recursive bool) (*scpDownload, error) {
+	args := "-p -f"
+	if recursive {
+		args = "-r -p -f"
+	}
+	s, err := startSCP(client, args, p)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.sendOK(); err != nil {
+		s.abort()
+		return nil, err
+	}
+	return &scpDownload{s: s}, nil
+}
+
+// next returns the next record, or io.EOF once scp has sent everything.
+// Problems with single files are returned as warning *scpErrors, after
+// which next can be called again. The data of a file that is not read
+// is skipped.
+func (d *scpDownload) next() (*scpEntry, error) {
+	if d.pending {
+		if _, err := io.Copy(io.Discard, d.body); err != nil {
+			return nil, err
+		}
+		if err := d.endFile(); err != nil {
+			return nil, err
+		}
+	}
+	for {
+		b, err := d.s.out.ReadByte()
+		if err == io.EOF && d.started {
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, d.s.failure(err)
+		}
+		d.started = true
+		line, err := d.s.readLine()
+		if err != nil {
+			return nil, d.s.failure(err)
+		}
+		switch b {
+		case 1, 2:
+			return nil, &scpError{msg: line, warning: b == 1}
+		case 'T':
+			fields := strings.Fields(line)
+			if len(fields) != 4 {
+				return nil, fmt.Errorf("invalid scp time record %q", line)
+			}
+			sec, err := strconv.ParseInt(fields[0], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid scp time record %q", line)
+			}
+			d.modTime = time.Unix(sec, 0)
+		case 'E':
+			if err := d.s.sendOK(); err != nil {
+				return nil, err
+			}
+			return &scpEntry{end: true}, nil
+		case 'C', 'D':
+			entry, err := parseSCPRecord(b, line)
+			if err != nil {
+				return nil, err
+			}
+			entry.modTime, d.modTime = d.modTime, time.Time{}
+			if entry.modTime.IsZero() {
+				entry.modTime = time.Now()
+			}
+			if !entry.isDir {
+				d.body = io.LimitReader(d.s.out, entry.size)
+				d.pending = true
+			}
+			if err := d.s.sendOK(); err != nil {
+				return nil, err
+			}
+			return entry, nil
+		default:
+			return nil, fmt.Errorf("unexpected scp record %q", string(b)+line)
+		}
+		if err := d.s.sendOK(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// parseSCPRecord parses "C0644 1234 name" or "D0755 0 name", without the
+// leading letter.
+func parseSCPRecord(kind byte, line string) (*scpEntry, error) {
+	fields := strings.SplitN(line, " ", 3)
+	if len(fields) != 3 || fields[2] == "" || strings.Contains(fields[2], "/") || fields[2] == ".." {
+		return nil, fmt.Errorf("invalid scp record %q", string(kind)+line)
+	}
+	mode, err := strconv.ParseUint(fields[0], 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid scp record %q", string(kind)+line)
+	}
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || size < 0 {
+		return nil, fmt.Errorf("invalid scp record %q", string(kind)+line)
+	}
+	return &scpEntry{name: fields[2], mode: os.FileMode(mode) & os.ModePerm, size: size, isDir: kind == 'D'}, nil
+}
+
+// file is the data of the file last returned by next. Once all of it is
+// read, endFile must be called before the next record.
+func (d *scpDownload) file() io.Reader {
+	return d.body
+}
+
+// endFile reads scp's status for the file just read, which reports errors
+// reading it on the host, and acknowledges it.
+func (d *scpDownload) endFile() error {
+	d.pending = false
+	err := d.s.readResponse()
+	if sendErr := d.s.sendOK(); err == nil {
+		err = sendErr
+	}
+	return err
+}
+
+func (d *scpDownload) close() {
+	d.s.abort()
+}
+
+// scpExists tells whether p exists by asking scp to send it. The session is
+// closed after the first answer, before any data is read.
+func scpExists(client *ssh.Client, p string) (bool, error) {
+	d, err := startSCPDownload(client, p, false)
+	if err != nil {
+		return false, err
+	}
+	defer d.close()
+	_, err = d.next()
+	var scpErr *scpError
+	if errors.As(err, &scpErr) {
+		// Anything but a missing file, such as a directory or an
+		// unreadable file, is something that would be overwritten.
+		return !strings.Contains(scpErr.msg, "No such file or directory"), nil
+	}
+	return err == nil, err
+}
+
+// removeRemoteFile deletes p with rm, for hosts without SFTP.
+func removeRemoteFile(client *ssh.Client, p string) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	return session.Run("rm -f " + shellQuote(scpPathArg(p)))
+}
@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestParseSCPRecord(t *testing.T) {
+	tests := []struct {
+		kind byte
+		line string
+		want *scpEntry
+	}{
+		{'C', "0644 1234 notes.txt", &scpEntry{name: "notes.txt", mode: 0644, size: 1234}},
+		{'C', "0755 0 run.sh", &scpEntry{name: "run.sh", mode: 0755}},
+		{'C', "0600 5 name with spaces", &scpEntry{name: "name with spaces", mode: 0600, size: 5}},
+		{'D', "0755 0 logs", &scpEntry{name: "logs", mode: 0755, isDir: true}},
+		{'C', "4755 10 setuid", &scpEntry{name: "setuid", mode: 0755, size: 10}},
+		{'C', "0644 1234", nil},
+		{'C', "0644 1234 ", nil},
+		{'C', "0644 1234 ../escape", nil},
+		{'C', "0644 1234 dir/file", nil},
+		{'D', "0755 0 ..", nil},
+		{'C', "0689 1 bad-mode", nil},
+		{'C', "0644 -1 negative", nil},
+		{'C', "0644 1k size", nil},
+		{'C', "", nil},
+	}
+	for _, tt := range tests {
+		got, err := parseSCPRecord(tt.kind, tt.line)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("parseSCPRecord(%q) = %+v, want an error", string(tt.kind)+tt.line, got)
+			}
+			continue
+		}
+		if err != nil || *got != *tt.want {
+			t.Errorf("parseSCPRecord(%q) = %+v, %v; want %+v", string(tt.kind)+tt.line, got, err, tt.want)
+		}
+	}
+}
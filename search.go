@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	defaultSearchDepth   = 10
+	maxSearchDepth       = 64
+	defaultSearchTimeout = time.Minute
+	maxSearchTimeout     = 10 * time.Minute
+	maxSearchResults     = 1000
+	// Results are sent in batches of this size, or at this interval while
+	// a slow walk has found fewer.
+	searchBatchSize     = 100
+	searchFlushInterval = 500 * time.Millisecond
+	// grepBatchSize is how many candidate files one grep call checks.
+	grepBatchSize = 200
+)
+
+// searchQuery is the JSON payload of a "search" message. Empty fields do
+// not restrict the search.
+type searchQuery struct {
+	Name           string `json:"name"` // glob matched against the base name
+	MinSize        *int64 `json:"minSize"`
+	MaxSize        *int64 `json:"maxSize"`
+	ModifiedAfter  string `json:"modifiedAfter"`  // RFC 3339 or YYYY-MM-DD
+	ModifiedBefore string `json:"modifiedBefore"` // RFC 3339 or YYYY-MM-DD
+	Depth          int    `json:"depth"`
+	TimeoutSeconds int    `json:"timeoutSeconds"`
+	// Content, if set, keeps only regular files containing this text. It
+	// runs grep on the host and needs exec access.
+	Content string `json:"content"`
+
+	after, before time.Time
+}
+
+type searchResult struct {
+	Path string `json:"path"`
+	FileEntry
+}
+
+// operationSet tracks long-running operations on one WebSocket, such as
+// searches, tails and archives, so they can be cancelled by ID, and all of
+// them when the socket closes. With a limit, at most that many run at once.
+type operationSet struct {
+	mutex   sync.Mutex
+	cancels map[string]context.CancelFunc
+	limit   int
+}
+
+// newOperationSet returns a set of at most limit operations, or any number
+// when limit is 0.
+func newOperationSet(limit int) *operationSet {
+	return &operationSet{cancels: make(map[string]context.CancelFunc), limit: limit}
+}
+
+// add tracks an operation, cancelling any other with the same ID, which it
+// replaces. It returns false, tracking nothing, when the set is full.
+func (s *operationSet) add(id string, cancel context.CancelFunc) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	old := s.cancels[id]
+	if old == nil && s.limit > 0 && len(s.cancels) >= s.limit {
+		return false
+	}
+	if old != nil {
+		old()
+	}
+	s.cancels[id] = cancel
+	return true
+}
+
+func (s *operationSet) remove(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.cancels, id)
+}
+
+func (s *operationSet) Cancel(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if cancel := s.cancels[id]; cancel != nil {
+		cancel()
+	}
+}
+
+func (s *operationSet) CancelAll() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, cancel := range s.cancels {
+		cancel()
+	}
+}
+
+func parseSearchQuery(payload string) (*searchQuery, error) {
+	q := &searchQuery{}
+	if payload != "" {
+		if err := json.Unmarshal([]byte(payload), q); err != nil {
+			return nil, fmt.Errorf("invalid search: %v", err)
+		}
+	}
+	if q.Name != "" {
+		if _, err := path.Match(q.Name, ""); err != nil {
+			return nil, fmt.Errorf("invalid name pattern %q", q.Name)
+		}
+	}
+	var err error
+	if q.after, err = parseSearchTime(q.ModifiedAfter); err != nil {
+		return nil, err
+	}
+	if q.before, err = parseSearchTime(q.ModifiedBefore); err != nil {
+		return nil, err
+	}
+	if q.Depth <= 0 {
+		q.Depth = defaultSearchDepth
+	}
+	q.Depth = min(q.Depth, maxSearchDepth)
+	return q, nil
+}
+
+func parseSearchTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q", value)
+}
+
+func (q *searchQuery) timeout() time.Duration {
+	if q.TimeoutSeconds <= 0 {
+		return defaultSearchTimeout
+	}
+	return min(time.Duration(q.TimeoutSeconds)*time.Second, maxSearchTimeout)
+}
+
+func (q *searchQuery) matches(name string, size int64, mtime time.Time, isDir bool) bool {
+	if q.Name != "" {
+		if ok, _ := path.Match(q.Name, name); !ok {
+			return false
+		}
+	}
+	if (q.MinSize != nil || q.MaxSize != nil || q.Content != "") && isDir {
+		return false
+	}
+	if q.MinSize != nil && size < *q.MinSize {
+		return false
+	}
+	if q.MaxSize != nil && size > *q.MaxSize {
+		return false
+	}
+	if !q.after.IsZero() && mtime.Before(q.after) {
+		return false
+	}
+	if !q.before.IsZero() && !mtime.Before(q.before) {
+		return false
+	}
+	return true
+}
+
+// fileSearch walks one subtree and streams matches to the browser in
+// "search" messages. The last message has done set.
+type fileSearch struct {
+	ws        *wsConn
+	id        string
+	root      string
+	query     *searchQuery
+	sshClient *ssh.Client
+	sftp      *sftp.Client
+	owners    *ownerNames
+
+	mutex     sync.Mutex
+	batch     []searchResult
+	count     int
+	truncated bool
+}
+
+// handleFileSearch runs the search in msg until it finishes, times out or
+// ctx is cancelled, which are all reported to the browser.
+func handleFileSearch(ctx context.Context, ws *wsConn, sshClient *ssh.Client, jail *pathJail, msg wsMessage) error {
+	done := map[string]interface{}{"id": msg.ID, "done": true}
+
+	if msg.ID == "" {
+		err := errors.New("id is required")
+		done["error"] = err.Error()
+		sendJSON(ws, "search", done)
+		return err
+	}
+	query, err := parseSearchQuery(msg.Payload)
+	if err != nil {
+		done["error"] = err.Error()
+		sendJSON(ws, "search", done)
+		return err
+	}
+	if ctx.Err() != nil {
+		done["cancelled"] = true
+		sendJSON(ws, "search", done)
+		return nil
+	}
+	sftpClient, err := sshPool.SFTP(sshClient)
+	if err != nil {
+		done["error"] = err.Error()
+		sendJSON(ws, "search", done)
+		return err
+	}
+
+	root := msg.Path
+	if root == "" {
+		root = jail.Home(sftpClient)
+	}
+	// The walk does not follow symlinks, so checking the root is enough.
+	if root, err = jail.Resolve(sftpClient, "search", root); err != nil {
+		done["error"] = err.Error()
+		sendJSON(ws, "search", done)
+		return err
+	}
+	// Hosts forced into internal-sftp accept the command but run no grep,
+	// which would look like nothing matched.
+	if query.Content != "" && !remoteCommandExists(sshClient, "grep") {
+		err := errors.New("content search unavailable: grep cannot be run on this host")
+		done["error"] = err.Error()
+		sendJSON(ws, "search", done)
+		return err
+	}
+	s := &fileSearch{
+		ws:        ws,
+		id:        msg.ID,
+		root:      root,
+		query:     query,
+		sshClient: sshClient,
+		sftp:      sftpClient,
+		owners:    sshPool.Owners(sshClient),
+	}
+	s.owners.load(sftpClient)
+
+	ctx, cancel := context.WithTimeout(ctx, query.timeout())
+	defer cancel()
+
+	stopFlush, flushStopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		s.flushPeriodically(stopFlush)
+		close(flushStopped)
+	}()
+	err = s.walk(ctx)
+	close(stopFlush)
+	<-flushStopped
+	s.flush()
+
+	done["count"] = s.count
+	done["truncated"] = s.truncated
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		done["timedOut"] = true
+	case errors.Is(ctx.Err(), context.Canceled):
+		done["cancelled"] = true
+	case err != nil:
+		done["error"] = err.Error()
+	}
+	sendJSON(ws, "search", done)
+	// Stopping a search is not a failure.
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+func (s *fileSearch) walk(ctx context.Context) error {
+	var candidates []searchResult
+	walker := s.sftp.Walk(s.root)
+	for walker.Step() {
+		if ctx.Err() != nil || s.full() {
+			return nil
+		}
+		if walker.Err() != nil {
+			// Unreadable directories are skipped, like find does.
+			continue
+		}
+		p := walker.Path()
+		info := walker.Stat()
+		if p != s.root && info.IsDir() && searchDepth(s.root, p) >= s.query.Depth {
+			walker.SkipDir()
+		}
+		if p == s.root || !s.query.matches(info.Name(), info.Size(), info.ModTime(), info.IsDir()) {
+			continue
+		}
+
+		result := searchResult{Path: p, FileEntry: newFileEntry(s.sftp, path.Dir(p), info, s.owners)}
+		if s.query.Content == "" {
+			s.add(result)
+			continue
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		candidates = append(candidates, result)
+		if len(candidates) >= grepBatchSize {
+			if err := s.grep(ctx, candidates); err != nil {
+				return err
+			}
+			candidates = candidates[:0]
+		}
+	}
+	if len(candidates) > 0 && ctx.Err() == nil {
+		return s.grep(ctx, candidates)
+	}
+	return nil
+}
+
+func searchDepth(root, p string) int {
+	rel := strings.TrimPrefix(strings.TrimPrefix(p, root), "/")
+	return strings.Count(rel, "/") + 1
+}
+
+// grep keeps the candidates that contain the query's text.
+func (s *fileSearch) grep(ctx context.Context, candidates []searchResult) error {
+	paths := make([]string, len(candidates))
+	for i, c := range candidates {
+		paths[i] = c.Path
+	}
+	matched, err := grepFiles(ctx, s.sshClient, s.query.Content, paths)
+	if err != nil {
+		return err
+	}
+	for _, c := range candidates {
+		if matched[c.Path] {
+			s.add(c)
+		}
+	}
+	return nil
+}
+
+// grepFiles runs grep on the remote host and returns the paths of the
+// files containing text. Binary files are skipped. The caller checks that
+// the host has grep.
+func grepFiles(ctx context.Context, client *ssh.Client, text string, paths []string) (map[string]bool, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("content search unavailable: %v", err)
+	}
+	defer session.Close()
+	go func() {
+		<-ctx.Done()
+		session.Close()
+	}()
+
+	quoted := make([]string, len(paths))
+	for i, p := range paths {
+		quoted[i] = shellQuote(p)
+	}
+	cmd := "grep -l -F -I -e " + shellQuote(text) + " -- " + strings.Join(quoted, " ")
+
+	var stdout bytes.Buffer
+	session.Stdout = &stdout
+	err = session.Run(cmd)
+	var exitErr *ssh.ExitError
+	if err != nil && ctx.Err() == nil {
+		// 1 means nothing matched and 2 that some files were unreadable;
+		// anything else means grep could not run at all.
+		if !errors.As(err, &exitErr) || exitErr.ExitStatus() > 2 {
+			return nil, fmt.Errorf("content search unavailable: %v", err)
+		}
+	}
+
+	matched := make(map[string]bool)
+	scanner := bufio.NewScanner(&stdout)
+	for scanner.Scan() {
+		matched[scanner.Text()] = true
+	}
+	return matched, nil
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func (s *fileSearch) add(result searchResult) {
+	s.mutex.Lock()
+	if s.count >= maxSearchResults {
+		s.truncated = true
+		s.mutex.Unlock()
+		return
+	}
+	s.count++
+	s.batch = append(s.batch, result)
+	full := len(s.batch) >= searchBatchSize
+	s.mutex.Unlock()
+	if full {
+		s.flush()
+	}
+}
+
+func (s *fileSearch) full() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.count >= maxSearchResults {
+		s.truncated = true
+		return true
+	}
+	return false
+}
+
+func (s *fileSearch) flushPeriodically(stop <-chan struct{}) {
+	ticker := time.NewTicker(searchFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			s.flush()
+		}
+	}
+}
+
+func (s *fileSearch) flush() {
+	s.mutex.Lock()
+	batch := s.batch
+	s.batch = nil
+	s.mutex.Unlock()
+	if len(batch) > 0 {
+		sendJSON(s.ws, "search", map[string]interface{}{"id": s.id, "results": batch})
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/hex"
+	"log"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// newSSHClientConfig builds the client configuration for a saved connection,
+// decrypting its stored password and private key.
+func newSSHClientConfig(details *SSHConnection) *ssh.ClientConfig {
+	encryptedPasswordBytes, _ := hex.DecodeString(details.Password)
+	decryptedPassword, err := decrypt(encryptedPasswordBytes)
+	if err != nil {
+		log.Printf("Failed to decrypt password for conn %d: %v", details.ID, err)
+	}
+
+	encryptedKeyBytes, _ := hex.DecodeString(details.Key)
+	decryptedKey, _ := decrypt(encryptedKeyBytes)
+
+	var authMethods []ssh.AuthMethod
+	if len(decryptedPassword) > 0 {
+		authMethods = append(authMethods, ssh.Password(string(decryptedPassword)))
+	}
+	if len(decryptedKey) > 0 {
+		signer, err := ssh.ParsePrivateKey(decryptedKey)
+		if err == nil {
+			authMethods = append(authMethods, ssh.PublicKeys(signer))
+		} else {
+			log.Printf("Failed to parse private key: %v", err)
+		}
+	}
+
+	config := &ssh.ClientConfig{
+		User:            details.User,
+		Auth:            authMethods,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         10 * time.Second,
+	}
+	applyAlgorithms(config, details)
+	return config
+}
+
+// sshAddress returns the connection's host with the default port appended
+// when none is given.
+func sshAddress(host string) string {
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		return net.JoinHostPort(host, "22")
+	}
+	return host
+}
+
+func dialSSH(details *SSHConnection) (*ssh.Client, error) {
+	return ssh.Dial("tcp", sshAddress(details.Host), newSSHClientConfig(details))
+}
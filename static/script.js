@@ -4,12 +4,18 @@ document.addEventListener('DOMContentLoaded', () => {
     const terminalView = document.getElementById('terminal-view');
     const tabsContainer = document.getElementById('tabs-container');
     const terminalWrapper = document.getElementById('terminal-wrapper');
+    const tailPanel = document.getElementById('tail-panel');
+    const tailPanelClose = document.getElementById('tail-panel-close');
+    const tailList = document.getElementById('tail-list');
     const connectionsList = document.getElementById('connections-list');
     const saveButton = document.getElementById('save-connection');
     const adminBtn = document.getElementById('admin-btn');
     // Tab controls
     const fileUploadInput = document.getElementById('file-upload-input');
+    const folderUploadInput = document.getElementById('folder-upload-input');
     const fileBrowserBtn = document.getElementById('file-browser-btn');
+    const transfersBtn = document.getElementById('transfers-btn');
+    const tailBtn = document.getElementById('tail-btn');
     // File Browser Modal
     const fileBrowserModal = document.getElementById('file-browser-modal');
     const fbPathInput = document.getElementById('fb-path-input');
@@ -17,7 +23,45 @@ document.addEventListener('DOMContentLoaded', () => {
     const fbRefreshBtn = document.getElementById('fb-refresh-btn');
     const newTabBtn = document.getElementById('new-tab-btn');
     const fbUploadBtn = document.getElementById('fb-upload-btn');
+    const fbUploadFolderBtn = document.getElementById('fb-upload-folder-btn');
+    const fbConflictSelect = document.getElementById('fb-conflict-select');
+    const fbExtractInput = document.getElementById('fb-extract-input');
+    const fbArchiveFormatSelect = document.getElementById('fb-archive-format-select');
+    const fbMkdirBtn = document.getElementById('fb-mkdir-btn');
+    const fbSymlinkBtn = document.getElementById('fb-symlink-btn');
     const fileBrowserList = document.getElementById('file-browser-list');
+    const fbFilterInput = document.getElementById('fb-filter-input');
+    const fbSortSelect = document.getElementById('fb-sort-select');
+    const fbOrderBtn = document.getElementById('fb-order-btn');
+    const fbHiddenInput = document.getElementById('fb-hidden-input');
+    const fbPager = document.getElementById('fb-pager');
+    const fbUsage = document.getElementById('fb-usage');
+    const fbArchives = document.getElementById('fb-archives');
+    const fbSearchBtn = document.getElementById('fb-search-btn');
+    const fbWebdavBtn = document.getElementById('fb-webdav-btn');
+    const fbSearchPanel = document.getElementById('fb-search-panel');
+    const fbSearchStartBtn = document.getElementById('fb-search-start-btn');
+    const fbSearchCancelBtn = document.getElementById('fb-search-cancel-btn');
+    const fbSearchStatus = document.getElementById('fb-search-status');
+    const fbSearchResults = document.getElementById('fb-search-results');
+    // Editor Modal
+    const editorModal = document.getElementById('editor-modal');
+    const editorTitle = document.getElementById('editor-title');
+    const editorInfo = document.getElementById('editor-info');
+    const editorContent = document.getElementById('editor-content');
+    const editorSaveBtn = document.getElementById('editor-save-btn');
+    // Preview Modal
+    const previewModal = document.getElementById('preview-modal');
+    const previewTitle = document.getElementById('preview-title');
+    const previewInfo = document.getElementById('preview-info');
+    const previewContent = document.getElementById('preview-content');
+    // Transfers Modal
+    const transfersModal = document.getElementById('transfers-modal');
+    const transfersList = document.getElementById('transfers-list');
+    // Two-Factor Modal
+    const twoFactorBtn = document.getElementById('two-factor-btn');
+    const twoFactorModal = document.getElementById('two-factor-modal');
+    const twoFactorBody = document.getElementById('two-factor-body');
     // Admin Panel Modal
     const adminPanelModal = document.getElementById('admin-panel-modal');
     const adminPanelBody = document.getElementById('admin-panel-body');
@@ -27,14 +71,25 @@ document.addEventListener('DOMContentLoaded', () => {
     const userInput = document.getElementById('user');
     const passwordInput = document.getElementById('password');
     const keyInput = document.getElementById('key');
+    const startupCommandInput = document.getElementById('startup-command');
+    const disableHealthCheckInput = document.getElementById('disable-health-check');
+    const algorithmPresetInput = document.getElementById('algorithm-preset');
+    const keyExchangesInput = document.getElementById('key-exchanges');
+    const ciphersInput = document.getElementById('ciphers');
+    const macsInput = document.getElementById('macs');
+    const hostKeyAlgorithmsInput = document.getElementById('host-key-algorithms');
 
     // State Management
     let tabs = [];
     let activeTabId = null;
     let nextTabId = 1;
     let connections = [];
-    let features = { download: true, fileBrowser: true }; // Default features
+    let features = { download: true, fileBrowser: true, healthCheck: false }; // Default features
     let currentRemotePath = '';
+    // Sorting, filtering and paging are done by the server.
+    const FILE_LIST_PAGE_SIZE = 200;
+    let fileListOffset = 0;
+    let fileListOrder = 'asc';
 
     // Xterm.js custom theme
     const termTheme = {
@@ -62,7 +117,9 @@ document.addEventListener('DOMContentLoaded', () => {
 
     // --- Tab Management ---
 
-    function createNewTab(connection) {
+    // createNewTab opens a terminal tab, or with mode 'files' a file-only
+    // session without a shell for hosts that only allow SFTP.
+    function createNewTab(connection, mode = 'shell') {
         const tabId = nextTabId++;
         
         const tabEl = document.createElement('div');
@@ -70,7 +127,7 @@ document.addEventListener('DOMContentLoaded', () => {
         tabEl.className = 'tab';
         tabEl.dataset.tabId = tabId;
         tabEl.innerHTML = `
-            <span>${connection.name}</span>
+            <span>${connection.name}${mode === 'files' ? ' (files)' : ''}</span>
             <span class="close-tab" data-tab-id="${tabId}">×</span>
         `;
         tabsContainer.insertBefore(tabEl, tabsContainer.querySelector('.tab-controls'));
@@ -91,6 +148,7 @@ document.addEventListener('DOMContentLoaded', () => {
         const newTab = {
             id: tabId,
             connection: connection,
+            mode: mode,
             element: tabEl,
             termContainer: termContainer,
             term: term,
@@ -164,6 +222,21 @@ document.addEventListener('DOMContentLoaded', () => {
         }
     }
 
+    // handleSessionMode learns whether the server gave the tab a shell. A
+    // file-only session has no terminal, so the file browser is opened.
+    function handleSessionMode(tab, session) {
+        if (session.mode !== 'files') return;
+        if (tab.mode !== 'files') {
+            tab.mode = 'files';
+            tab.element.querySelector('span').textContent += ' (files)';
+        }
+        const reason = session.forced ? 'Your account is limited to file access' : 'File-only session';
+        tab.term.write(`\x1b[36m${reason}: no shell is started on ${tab.connection.host}. Use the file browser to work with files.\x1b[0m\r\n`);
+        if (tab.id === activeTabId) {
+            openFileBrowser();
+        }
+    }
+
     // --- WebSocket and Terminal Logic ---
 
     function fitTerminal(tab) {
@@ -180,12 +253,13 @@ document.addEventListener('DOMContentLoaded', () => {
 
     function connect(tab) {
         const protocol = location.protocol === 'https:' ? 'wss:' : 'ws:';
-        const socket = new WebSocket(`${protocol}//${location.host}/ws?id=${tab.connection.id}`);
+        const socket = new WebSocket(`${protocol}//${location.host}/ws?id=${tab.connection.id}&mode=${tab.mode}`);
         tab.socket = socket;
 
         socket.onopen = () => {
             fitTerminal(tab);
             tab.onDataDisposable = tab.term.onData(data => {
+                if (tab.mode === 'files') return;
                 socket.send(JSON.stringify({ type: 'data', payload: data }));
             });
         };
@@ -198,6 +272,9 @@ document.addEventListener('DOMContentLoaded', () => {
                         case 'stdout':
                             tab.term.write(msg.payload);
                             break;
+                        case 'session':
+                            handleSessionMode(tab, JSON.parse(msg.payload));
+                            break;
                         case 'status':
                             tab.term.write(msg.payload);
                             if (socket.readyState === WebSocket.OPEN) {
@@ -211,14 +288,72 @@ document.addEventListener('DOMContentLoaded', () => {
                         case 'list':
                             renderFileList(JSON.parse(msg.payload));
                             break;
-                        case 'download':
-                            handleFileDownload(JSON.parse(msg.payload));
+                        case 'fileop':
+                            handleFileOperationResult(JSON.parse(msg.payload));
+                            break;
+                        case 'read':
+                            handleEditorRead(JSON.parse(msg.payload));
+                            break;
+                        case 'write':
+                            handleEditorWrite(JSON.parse(msg.payload));
+                            break;
+                        case 'search':
+                            handleSearchResults(JSON.parse(msg.payload));
+                            break;
+                        case 'transfer':
+                            handleTransferUpdate(JSON.parse(msg.payload));
+                            break;
+                        case 'checksum':
+                            handleChecksumResult(tab, JSON.parse(msg.payload));
+                            break;
+                        case 'tail':
+                            handleTailMessage(JSON.parse(msg.payload));
+                            break;
+                        case 'archive':
+                            handleArchiveMessage(JSON.parse(msg.payload));
                             break;
+                        case 'reconnecting': {
+                            const info = JSON.parse(msg.payload);
+                            tab.term.write(`\r\n\x1b[33mConnection lost (${info.reason}). Reconnecting in ${(info.delayMs / 1000).toFixed(1)}s (attempt ${info.attempt}/${info.maxAttempts})...\x1b[0m\r\n`);
+                            break;
+                        }
+                        case 'reconnected':
+                            tab.term.write('\r\n\x1b[32mReconnected.\x1b[0m\r\n');
+                            fitTerminal(tab);
+                            break;
+                        case 'disconnected': {
+                            const info = JSON.parse(msg.payload);
+                            tab.term.write(`\r\n\x1b[31mCould not reconnect: ${info.reason}\x1b[0m\r\n`);
+                            break;
+                        }
+                        case 'exit': {
+                            const info = JSON.parse(msg.payload);
+                            let text;
+                            if (info.reason === 'signal') {
+                                text = `Remote shell killed by signal ${info.signal}`;
+                            } else if (info.reason === 'exited') {
+                                text = `Remote shell exited with code ${info.code}`;
+                            } else if (info.reason === 'exit_status_missing') {
+                                text = 'Remote shell ended without reporting an exit status';
+                            } else {
+                                text = `Remote session ended: ${info.message}`;
+                            }
+                            if (info.message && info.reason !== 'session_error') {
+                                text += ` (${info.message})`;
+                            }
+                            const color = info.code === 0 ? '32' : '33';
+                            tab.term.write(`\r\n\x1b[${color}m${text}.\x1b[0m\r\n`);
+                            break;
+                        }
                         case 'error':
                             // Display error in terminal and as an alert
                             const errorMsg = `\r\n\x1b[31mSERVER ERROR: ${msg.payload}\x1b[0m\r\n`;
                             tab.term.write(errorMsg);
-                            alert(`Server Error: ${msg.payload}`);
+                            // Session setup failures carry a code and are
+                            // already shown in the terminal.
+                            if (!msg.code) {
+                                alert(`Server Error: ${msg.payload}`);
+                            }
                             break;
                         default:
                             console.warn("Unknown message type received:", msg.type);
@@ -233,6 +368,8 @@ document.addEventListener('DOMContentLoaded', () => {
 
         socket.onclose = () => {
             tab.term.write('\r\n\x1b[31mConnection closed.\x1b[0m\r\n');
+            endTabTails(tab, 'connection closed');
+            endTabArchives(tab);
         };
 
         socket.onerror = (err) => {
@@ -243,9 +380,16 @@ document.addEventListener('DOMContentLoaded', () => {
 
     // --- File Upload ---
     
-    function handleFileUpload(event) {
-        const file = event.target.files[0];
-        if (!file) return;
+    const UPLOAD_CHUNK_SIZE = 1024 * 1024;
+    const UPLOAD_MAX_RETRIES = 5;
+
+    // handleFileUpload uploads the chosen files one after another. Files from
+    // a folder upload carry their path relative to the chosen folder, and the
+    // server recreates those directories.
+    async function handleFileUpload(event) {
+        const files = Array.from(event.target.files);
+        event.target.value = '';
+        if (files.length === 0) return;
 
         const activeTab = tabs.find(t => t.id === activeTabId);
         if (!activeTab || !activeTab.socket || activeTab.socket.readyState !== WebSocket.OPEN) {
@@ -253,40 +397,108 @@ document.addEventListener('DOMContentLoaded', () => {
             return;
         }
 
-        const reader = new FileReader();
-        reader.onload = (e) => {
-            const base64Content = e.target.result.split(',')[1];
-            activeTab.socket.send(JSON.stringify({
-                type: 'upload',
-                filename: file.name,
-                payload: base64Content,
-                path: currentRemotePath, // Send current remote path
-            }));
-            activeTab.term.write(`\r\n\x1b[33mUploading ${file.name}...\x1b[0m\r\n`);
-        };
-        reader.onerror = (e) => {
-            console.error("File reading error:", e);
-            activeTab.term.write(`\r\n\x1b[31mError reading file: ${file.name}\x1b[0m\r\n`);
-        };
-        reader.readAsDataURL(file);
-        fileUploadInput.value = '';
-    }
+        const remotePath = currentRemotePath;
+        const policy = fbConflictSelect.value;
+        const extract = fbExtractInput.checked;
+        const summary = { uploaded: 0, overwritten: 0, renamed: 0, skipped: 0, extracted: 0, failed: 0 };
+        for (const file of files) {
+            const name = file.webkitRelativePath || file.name;
+            activeTab.term.write(`\r\n\x1b[33mUploading ${name}...\x1b[0m\r\n`);
+            try {
+                const response = await fetch('/api/uploads', {
+                    method: 'POST',
+                    headers: { 'Content-Type': 'application/json' },
+                    body: JSON.stringify({
+                        connection_id: String(activeTab.connection.id),
+                        path: remotePath,
+                        filename: file.name,
+                        relative_path: file.webkitRelativePath || '',
+                        size: file.size,
+                        on_conflict: policy,
+                        extract: extract && isArchive(file.name) && file.size > 0,
+                    }),
+                });
+                if (!response.ok) {
+                    throw new Error(await response.text());
+                }
+                const upload = await sendUploadChunks(file, await response.json());
+                if (upload.conflict === 'skipped') {
+                    summary.skipped++;
+                    activeTab.term.write(`\r\n\x1b[33mSkipped '${name}': ${upload.path} already exists.\x1b[0m\r\n`);
+                    continue;
+                }
+                summary.uploaded++;
+                if (upload.conflict === 'overwritten') summary.overwritten++;
+                if (upload.conflict === 'renamed') summary.renamed++;
+                if (upload.summary) {
+                    const s = upload.summary;
+                    summary.extracted += s.written;
+                    activeTab.term.write(`\r\n\x1b[32mExtracted '${name}' into ${upload.path}: ${s.written} written, ${s.overwritten} overwritten, ${s.renamed} renamed, ${s.skipped} skipped.\x1b[0m\r\n`);
+                    (s.errors || []).forEach(err => activeTab.term.write(`\x1b[31m  ${err}\x1b[0m\r\n`));
+                } else {
+                    activeTab.term.write(`\r\n\x1b[32mFile '${name}' uploaded successfully to ${upload.path} (SHA-256 ${upload.sha256}).\x1b[0m\r\n`);
+                }
+            } catch (e) {
+                summary.failed++;
+                console.error("Upload error:", e);
+                activeTab.term.write(`\r\n\x1b[31mError uploading ${name}: ${e.message}\x1b[0m\r\n`);
+            }
+        }
 
-    function handleFileDownload({ filename, payload }) {
-        const byteCharacters = atob(payload);
-        const byteNumbers = new Array(byteCharacters.length);
-        for (let i = 0; i < byteCharacters.length; i++) {
-            byteNumbers[i] = byteCharacters.charCodeAt(i);
+        let text = `${summary.uploaded} uploaded`;
+        if (summary.overwritten) text += `, ${summary.overwritten} overwritten`;
+        if (summary.renamed) text += `, ${summary.renamed} renamed`;
+        if (summary.extracted) text += `, ${summary.extracted} extracted`;
+        if (summary.skipped) text += `, ${summary.skipped} skipped`;
+        if (summary.failed) text += `, ${summary.failed} failed`;
+        window.showToast(`Upload finished: ${text}`);
+        if (files.length > 1) {
+            activeTab.term.write(`\r\n\x1b[36mUpload finished: ${text}.\x1b[0m\r\n`);
+        }
+        if (!fileBrowserModal.classList.contains('hidden')) {
+            requestFileList(currentRemotePath);
+            loadUsage();
         }
-        const byteArray = new Uint8Array(byteNumbers);
-        const blob = new Blob([byteArray]);
+    }
 
-        const link = document.createElement('a');
-        link.href = URL.createObjectURL(blob);
-        link.download = filename;
-        document.body.appendChild(link);
-        link.click();
-        document.body.removeChild(link);
+    function isArchive(name) {
+        return /\.(zip|tar|tar\.gz|tgz)$/i.test(name);
+    }
+
+    // sendUploadChunks sends the file in order, one chunk per request. After a
+    // failed request it asks the server how much arrived and resumes there.
+    async function sendUploadChunks(file, upload) {
+        let retries = 0;
+        while (!upload.done) {
+            const chunk = file.slice(upload.offset, upload.offset + UPLOAD_CHUNK_SIZE);
+            try {
+                const response = await fetch(`/api/uploads/${upload.id}?offset=${upload.offset}`, {
+                    method: 'PUT',
+                    body: chunk,
+                });
+                if (response.status === 409) {
+                    // The server already has a different amount; continue from there.
+                    upload = await response.json();
+                    continue;
+                }
+                if (!response.ok) {
+                    throw new Error(await response.text());
+                }
+                upload = await response.json();
+                retries = 0;
+                window.showToast(`Uploading ${file.name}: ${upload.progress.toFixed(0)}%`);
+            } catch (e) {
+                if (++retries > UPLOAD_MAX_RETRIES) {
+                    throw e;
+                }
+                await new Promise(resolve => setTimeout(resolve, 1000 * retries));
+                const status = await fetch(`/api/uploads/${upload.id}`);
+                if (status.ok) {
+                    upload = await status.json();
+                }
+            }
+        }
+        return upload;
     }
 
     // --- File Browser Logic ---
@@ -299,9 +511,29 @@ document.addEventListener('DOMContentLoaded', () => {
         }
         fileBrowserModal.classList.remove('hidden');
         requestFileList(''); // Request root/home directory
+        loadUsage();
+    }
+
+    // loadUsage shows today's transfer usage and the limits that apply.
+    async function loadUsage() {
+        try {
+            const response = await fetch('/api/usage');
+            if (!response.ok) return;
+            const usage = await response.json();
+            const parts = [`Today: ${formatSize(usage.uploaded)} up, ${formatSize(usage.downloaded)} down`];
+            if (usage.quota > 0) parts.push(`${formatSize(usage.remaining)} of ${formatSize(usage.quota)} left`);
+            if (usage.max_upload_size > 0) parts.push(`max upload ${formatSize(usage.max_upload_size)}`);
+            if (usage.max_download_size > 0) parts.push(`max download ${formatSize(usage.max_download_size)}`);
+            if (usage.bandwidth_limit > 0) parts.push(`limited to ${formatSize(usage.bandwidth_limit)}/s`);
+            fbUsage.textContent = parts.join(' · ');
+            fbUsage.classList.toggle('exhausted', usage.quota > 0 && usage.remaining === 0);
+        } catch (e) {
+            console.error('Failed to load usage:', e);
+        }
     }
 
     function closeFileBrowser() {
+        cancelSearch();
         fileBrowserModal.classList.add('hidden');
         fileBrowserList.innerHTML = ''; // Clear content
         currentRemotePath = '';
@@ -324,30 +556,59 @@ document.addEventListener('DOMContentLoaded', () => {
         }
     }
 
-    function requestFileList(path) {
+    function requestFileList(path, offset = 0) {
         const activeTab = tabs.find(t => t.id === activeTabId);
         if (activeTab && activeTab.socket && activeTab.socket.readyState === WebSocket.OPEN) {
             // Immediately update the path state to what we are requesting.
             // This prevents race conditions or mismatches if the backend's CWD is different
             // from the requested path (especially when requesting '/').
+            if (path !== currentRemotePath) {
+                fbFilterInput.value = '';
+            }
             currentRemotePath = path;
+            fileListOffset = offset;
             fbPathInput.value = path;
-            activeTab.socket.send(JSON.stringify({ type: 'list', path: path }));
+            activeTab.socket.send(JSON.stringify({
+                type: 'list',
+                path: path,
+                sort: fbSortSelect.value,
+                order: fileListOrder,
+                filter: fbFilterInput.value,
+                showHidden: fbHiddenInput.checked,
+                offset: offset,
+                limit: FILE_LIST_PAGE_SIZE,
+            }));
         }
     }
 
-    function renderFileList({ path, files }) {
+    function escapeHtml(text) {
+        const div = document.createElement('div');
+        div.textContent = text;
+        return div.innerHTML;
+    }
+
+    function formatSize(bytes) {
+        if (bytes < 1024) return `${bytes} B`;
+        const units = ['KB', 'MB', 'GB', 'TB'];
+        let value = bytes / 1024;
+        let unit = 0;
+        while (value >= 1024 && unit < units.length - 1) {
+            value /= 1024;
+            unit++;
+        }
+        return `${value.toFixed(1)} ${units[unit]}`;
+    }
+
+    function renderFileList({ path, files, total, offset, limit, scp }) {
         currentRemotePath = path;
+        fileListOffset = offset;
         fbPathInput.value = path;
         fileBrowserList.innerHTML = '';
-
-        // Sort files: directories first, then by name
-        files.sort((a, b) => {
-            if (a.isDir !== b.isDir) {
-                return a.isDir ? -1 : 1;
-            }
-            return a.name.localeCompare(b.name);
-        });
+        if (scp) {
+            renderSCPNotice(path);
+            return;
+        }
+        renderFilePager(total, offset, limit, files.length);
 
         files.forEach(file => {
             const li = document.createElement('div');
@@ -359,15 +620,32 @@ document.addEventListener('DOMContentLoaded', () => {
 
             li.dataset.isDir = file.isDir;
 
-            const icon = file.isDir ? '📁' : '📄';
-            const size = file.isDir ? '' : `(${(file.size / 1024).toFixed(2)} KB)`;
+            const icon = file.isLink ? '🔗' : (file.isDir ? '📁' : '📄');
+            const size = file.isDir ? '' : formatSize(file.size);
+            const owner = `${file.owner || file.uid}:${file.group || file.gid}`;
+            const link = file.isLink ? ` → ${escapeHtml(file.linkTarget || '?')}` : '';
 
             li.innerHTML = `
-                <span>${icon} ${file.name}</span>
-                <span>${size}</span>
-                ${features.fileBrowser && features.download ? `
+                <span class="${file.hidden ? 'file-hidden' : ''}">${icon} ${escapeHtml(file.name)}${link}</span>
+                <span class="file-meta">
+                    <code>${file.mode}</code> ${escapeHtml(owner)} ${size}
+                    <span title="${file.mtime}">${new Date(file.mtime).toLocaleString()}</span>
+                </span>
+                ${features.fileBrowser ? `
                     <div class="file-actions">
-                        <button class="btn-download">Download</button>
+                        ${features.download ? '<button class="btn-download">Download</button>' : ''}
+                        ${file.isDir || !features.download ? '' : '<button class="btn-preview">Preview</button>'}
+                        ${file.isDir || !features.download ? '' : '<button class="btn-edit">Edit</button>'}
+                        ${file.isDir ? '' : '<button class="btn-checksum">Checksum</button>'}
+                        ${file.isDir || !features.download ? '' : '<button class="btn-tail">Tail</button>'}
+                        <button class="btn-compress">Compress</button>
+                        ${!file.isDir && isArchiveName(file.name) ? '<button class="btn-extract">Extract</button>' : ''}
+                        <button class="btn-rename">Rename</button>
+                        <button class="btn-copy">Copy</button>
+                        <button class="btn-send">Send to…</button>
+                        <button class="btn-chmod">Chmod</button>
+                        <button class="btn-chown">Chown</button>
+                        <button class="btn-delete">Delete</button>
                     </div>
                 ` : ''}
             `;
@@ -375,6 +653,52 @@ document.addEventListener('DOMContentLoaded', () => {
         });
     }
 
+    // Hosts without SFTP cannot be listed; files are uploaded to and
+    // downloaded from the typed path with scp instead.
+    function renderSCPNotice(path) {
+        fbPager.innerHTML = '';
+        const notice = document.createElement('div');
+        notice.className = 'fb-scp-notice';
+        notice.textContent = 'This host does not offer SFTP, so folders cannot be listed. ' +
+            'Uploads go to the folder typed above (your home folder if it is empty), sent with scp. ' +
+            'To download, type the path of a file or folder above and click Download.';
+        fileBrowserList.appendChild(notice);
+        if (!features.download || !path) return;
+        const btn = document.createElement('button');
+        btn.textContent = `Download ${path}`;
+        btn.addEventListener('click', () => {
+            const activeTab = tabs.find(t => t.id === activeTabId);
+            if (!activeTab) return;
+            // Whether the path is a folder is only known once scp sends it.
+            const link = document.createElement('a');
+            link.href = `/api/download?id=${activeTab.connection.id}&path=${encodeURIComponent(path)}&format=${encodeURIComponent(fbArchiveFormatSelect.value)}`;
+            link.download = '';
+            document.body.appendChild(link);
+            link.click();
+            document.body.removeChild(link);
+        });
+        fileBrowserList.appendChild(btn);
+    }
+
+    function renderFilePager(total, offset, limit, count) {
+        fbPager.innerHTML = '';
+        if (total <= limit && offset === 0) {
+            fbPager.textContent = `${total} entries`;
+            return;
+        }
+        const prev = document.createElement('button');
+        prev.textContent = '◀ Prev';
+        prev.disabled = offset === 0;
+        prev.addEventListener('click', () => requestFileList(currentRemotePath, Math.max(0, offset - limit)));
+        const next = document.createElement('button');
+        next.textContent = 'Next ▶';
+        next.disabled = offset + count >= total;
+        next.addEventListener('click', () => requestFileList(currentRemotePath, offset + limit));
+        const info = document.createElement('span');
+        info.textContent = count ? `${offset + 1}–${offset + count} of ${total}` : `0 of ${total}`;
+        fbPager.append(prev, info, next);
+    }
+
     fileBrowserList.addEventListener('click', (e) => {
         const item = e.target.closest('.file-item');
         if (!item) return;
@@ -384,15 +708,792 @@ document.addEventListener('DOMContentLoaded', () => {
 
         if (features.fileBrowser && features.download && e.target.classList.contains('btn-download')) {
             const activeTab = tabs.find(t => t.id === activeTabId);
-            if (activeTab && activeTab.socket) {
-                activeTab.socket.send(JSON.stringify({ type: 'download', path: path }));
+            if (!activeTab) return;
+            // Files and directories are streamed over HTTP so the browser can
+            // show progress; directories are archived on the fly.
+            let url = `/api/download?id=${activeTab.connection.id}&path=${encodeURIComponent(path)}`;
+            if (isDir) {
+                const exclude = prompt('Exclude (comma-separated patterns such as node_modules, *.log; leave empty for everything):', '');
+                if (exclude === null) return;
+                url += `&format=${encodeURIComponent(fbArchiveFormatSelect.value)}`;
+                exclude.split(',').map(p => p.trim()).filter(p => p).forEach(p => {
+                    url += `&exclude=${encodeURIComponent(p)}`;
+                });
             }
+            const link = document.createElement('a');
+            link.href = url;
+            link.download = '';
+            document.body.appendChild(link);
+            link.click();
+            document.body.removeChild(link);
+        } else if (features.fileBrowser && e.target.closest('.file-actions')) {
+            promptFileOperation(e.target, path, isDir);
         } else if (isDir) {
             // Navigate into directory
             requestFileList(path);
         }
     });
 
+    // --- File Operations ---
+
+    let fileOpCounter = 0;
+
+    function sendFileOperation(op) {
+        const activeTab = tabs.find(t => t.id === activeTabId);
+        if (!activeTab || !activeTab.socket || activeTab.socket.readyState !== WebSocket.OPEN) {
+            alert("No active connection.");
+            return;
+        }
+        op.id = String(++fileOpCounter);
+        activeTab.socket.send(JSON.stringify(op));
+    }
+
+    function promptFileOperation(button, path, isDir) {
+        const name = path.substring(path.lastIndexOf('/') + 1);
+        if (button.classList.contains('btn-edit')) {
+            sendFileOperation({ type: 'read', path });
+        } else if (button.classList.contains('btn-rename')) {
+            const target = prompt(`Rename or move ${name} to:`, path);
+            if (target && target !== path) {
+                sendFileOperation({ type: 'rename', path, target });
+            }
+        } else if (button.classList.contains('btn-copy')) {
+            const target = prompt(`Copy ${name} to:`, path + '.copy');
+            if (target && target !== path) {
+                sendFileOperation({ type: 'copy', path, target });
+            }
+        } else if (button.classList.contains('btn-send')) {
+            startTransfer(path);
+        } else if (button.classList.contains('btn-preview')) {
+            openPreview(path);
+        } else if (button.classList.contains('btn-tail')) {
+            startTail(path);
+        } else if (button.classList.contains('btn-compress')) {
+            const target = prompt(`Create archive of ${name} at (.tar.gz, .tgz or .zip):`, path + '.tar.gz');
+            if (target) {
+                startArchive({ type: 'compress', path, target });
+            }
+        } else if (button.classList.contains('btn-extract')) {
+            const target = prompt(`Extract ${name} into:`, path.substring(0, path.lastIndexOf('/')) || '/');
+            if (!target) return;
+            const onConflict = prompt('When a file already exists: overwrite, skip or rename', 'overwrite');
+            if (onConflict) {
+                startArchive({ type: 'extract', path, target, onConflict: onConflict.trim() });
+            }
+        } else if (button.classList.contains('btn-checksum')) {
+            const hash = prompt(`Expected SHA-256 of ${name} (leave empty to just compute it):`, '');
+            if (hash !== null) {
+                sendFileOperation({ type: 'checksum', path, hash: hash.trim() });
+            }
+        } else if (button.classList.contains('btn-chmod')) {
+            const mode = prompt(`New permissions for ${name} (octal, e.g. 644):`);
+            if (mode) {
+                sendFileOperation({ type: 'chmod', path, mode });
+            }
+        } else if (button.classList.contains('btn-chown')) {
+            const owner = prompt(`New owner for ${name} as uid:gid (either may be left empty):`);
+            if (!owner) return;
+            const [uid, gid] = owner.split(':');
+            const op = { type: 'chown', path };
+            if (uid) op.uid = parseInt(uid, 10);
+            if (gid) op.gid = parseInt(gid, 10);
+            sendFileOperation(op);
+        } else if (button.classList.contains('btn-delete')) {
+            const what = isDir ? `directory ${name}` : name;
+            if (confirm(`Delete ${what}?`)) {
+                sendFileOperation({ type: 'delete', path });
+            }
+        }
+    }
+
+    function handleFileOperationResult(result) {
+        if (result.code === 'confirm_required') {
+            // Non-empty directories are only deleted after a second confirmation.
+            if (confirm(`${result.path} is not empty. Delete it and everything in it?`)) {
+                sendFileOperation({ type: 'delete', path: result.path, recursive: true });
+            }
+            return;
+        }
+        if (!result.ok) {
+            alert(`${result.op} failed for ${result.path}: ${result.error}`);
+            return;
+        }
+        window.showToast(`${result.op} of ${result.path} done`);
+        if (!fileBrowserModal.classList.contains('hidden')) {
+            requestFileList(currentRemotePath);
+        }
+    }
+
+    function handleChecksumResult(tab, result) {
+        if (!result.ok) {
+            alert(`Checksum failed for ${result.path}: ${result.error}`);
+            return;
+        }
+        tab.term.write(`\r\n\x1b[36mSHA-256 ${result.sha256}  ${result.path}\x1b[0m\r\n`);
+        if (result.match === false) {
+            alert(`Checksum mismatch for ${result.path}:\nexpected ${result.expected}\ngot      ${result.sha256}`);
+        } else if (result.match) {
+            window.showToast(`${result.path} matches the expected SHA-256`);
+        } else {
+            window.showToast(`SHA-256 of ${result.path}: ${result.sha256}`);
+        }
+    }
+
+    // --- Remote Archives ---
+
+    // Compress and extract run on the remote host; each one in progress
+    // has a line in the file browser until it finishes.
+    const archiveOps = new Map();
+
+    function isArchiveName(name) {
+        return /\.(zip|tar|tar\.gz|tgz)$/i.test(name);
+    }
+
+    function startArchive(op) {
+        const tab = tabs.find(t => t.id === activeTabId);
+        sendFileOperation(op);
+        if (!op.id) return;
+        const row = document.createElement('div');
+        row.className = 'fb-archive';
+        const text = document.createElement('span');
+        text.className = 'fb-archive-text';
+        const cancel = document.createElement('button');
+        cancel.textContent = 'Cancel';
+        cancel.addEventListener('click', () => {
+            if (tab.socket && tab.socket.readyState === WebSocket.OPEN) {
+                tab.socket.send(JSON.stringify({ type: 'archive_cancel', id: op.id }));
+            }
+        });
+        row.append(text, cancel);
+        fbArchives.appendChild(row);
+        const entry = { op, tab, row, text, method: '' };
+        archiveOps.set(op.id, entry);
+        renderArchiveOp(entry, 0, '');
+    }
+
+    function renderArchiveOp(entry, files, current) {
+        const verb = entry.op.type === 'compress' ? 'Compressing' : 'Extracting';
+        const method = entry.method ? ` (${entry.method})` : '';
+        const progress = files ? ` · ${files} entries · ${current}` : '';
+        entry.text.textContent = `${verb} ${entry.op.path} → ${entry.op.target}${method}${progress}`;
+        entry.text.title = entry.text.textContent;
+    }
+
+    function handleArchiveMessage(msg) {
+        const entry = archiveOps.get(msg.id);
+        if (!entry) return;
+        if (msg.started) {
+            entry.method = msg.method;
+            renderArchiveOp(entry, 0, '');
+            return;
+        }
+        if (!msg.done) {
+            renderArchiveOp(entry, msg.files, msg.current);
+            return;
+        }
+        entry.row.remove();
+        archiveOps.delete(msg.id);
+        const what = entry.op.type === 'compress' ? `Archive ${msg.target}` : `Extraction of ${msg.path}`;
+        if (msg.code === 'exists') {
+            if (confirm(`${msg.target} already exists. Replace it?`)) {
+                startArchive({ ...entry.op, force: true });
+            }
+            return;
+        }
+        if (msg.stopped) {
+            window.showToast(`${what} cancelled`);
+        } else if (!msg.ok) {
+            alert(`${what} failed: ${msg.error}`);
+        } else {
+            let detail = `${msg.files} entries`;
+            if (msg.summary) {
+                const s = msg.summary;
+                detail = `${s.written} written, ${s.overwritten} overwritten, ${s.skipped} skipped, ${s.renamed} renamed`;
+            }
+            window.showToast(`${what} done (${detail})`);
+            const problems = (msg.summary && msg.summary.errors) || msg.errors;
+            if (problems && problems.length) {
+                alert(`${what} finished with errors:\n${problems.join('\n')}`);
+            }
+        }
+        if (!fileBrowserModal.classList.contains('hidden')) {
+            requestFileList(currentRemotePath);
+        }
+    }
+
+    // The server stops a tab's archives when its connection closes.
+    function endTabArchives(tab) {
+        archiveOps.forEach((entry, id) => {
+            if (entry.tab !== tab) return;
+            entry.row.remove();
+            archiveOps.delete(id);
+        });
+    }
+
+    // --- Preview ---
+
+    // The object URL of the previewed image or PDF, released when the next
+    // preview opens.
+    let previewUrl = null;
+
+    async function openPreview(path) {
+        const activeTab = tabs.find(t => t.id === activeTabId);
+        if (!activeTab) return;
+        if (previewUrl) {
+            URL.revokeObjectURL(previewUrl);
+            previewUrl = null;
+        }
+        previewTitle.textContent = path;
+        previewInfo.textContent = 'Loading…';
+        previewContent.innerHTML = '';
+        previewModal.classList.remove('hidden');
+
+        try {
+            const response = await fetch(`/api/preview?id=${activeTab.connection.id}&path=${encodeURIComponent(path)}`);
+            if (!response.ok) {
+                throw new Error(await response.text());
+            }
+            const kind = response.headers.get('X-Preview-Kind');
+            const size = parseInt(response.headers.get('X-File-Size'), 10);
+            let info = `${response.headers.get('X-Preview-Type')}, ${formatSize(size)}`;
+            if (kind === 'text') {
+                const pre = document.createElement('pre');
+                pre.textContent = await response.text();
+                previewContent.appendChild(pre);
+                info += `, ${response.headers.get('X-Preview-Encoding')}`;
+                if (response.headers.get('X-Preview-Truncated') === 'true') {
+                    info += ' (showing the beginning only)';
+                }
+            } else {
+                previewUrl = URL.createObjectURL(await response.blob());
+                const el = document.createElement(kind === 'pdf' ? 'iframe' : 'img');
+                el.src = previewUrl;
+                previewContent.appendChild(el);
+            }
+            previewInfo.textContent = info;
+        } catch (e) {
+            previewInfo.textContent = `Cannot preview ${path}: ${e.message}`;
+        }
+    }
+
+    // --- Live Tail ---
+
+    // Followed files by ID. Each runs on the socket of the tab that started
+    // it and ends with that tab.
+    const tails = new Map();
+    const TAIL_MAX_LINES = 2000;
+    let tailCounter = 0;
+
+    function startTail(path) {
+        const activeTab = tabs.find(t => t.id === activeTabId);
+        if (!activeTab || !activeTab.socket || activeTab.socket.readyState !== WebSocket.OPEN) {
+            alert("No active connection.");
+            return;
+        }
+        const filter = prompt(`Only show lines of ${path} matching (regular expression, leave empty for all):`, '');
+        if (filter === null) return;
+
+        const id = `tail-${++tailCounter}`;
+        const el = document.createElement('div');
+        el.className = 'tail-item';
+        el.innerHTML = `
+            <div class="tail-header">
+                <span class="tail-title"></span>
+                <span class="tail-status">starting…</span>
+                <button class="btn-tail-stop">Stop</button>
+                <button class="btn-tail-clear">Clear</button>
+                <button class="btn-tail-remove" title="Remove">×</button>
+            </div>
+            <pre></pre>
+        `;
+        const title = `${activeTab.connection.name}: ${path}` + (filter ? ` /${filter}/` : '');
+        el.querySelector('.tail-title').textContent = title;
+        el.querySelector('.tail-title').title = title;
+        el.querySelector('.btn-tail-stop').addEventListener('click', () => stopTail(id));
+        el.querySelector('.btn-tail-clear').addEventListener('click', () => {
+            el.querySelector('pre').textContent = '';
+            tails.get(id).lineCount = 0;
+        });
+        el.querySelector('.btn-tail-remove').addEventListener('click', () => {
+            stopTail(id);
+            tails.delete(id);
+            el.remove();
+            if (tails.size === 0) hideTailPanel();
+        });
+        tailList.appendChild(el);
+        tails.set(id, { tab: activeTab, el, running: true });
+
+        activeTab.socket.send(JSON.stringify({ type: 'tail', id, path, filter, limit: 50 }));
+        fileBrowserModal.classList.add('hidden');
+        showTailPanel();
+    }
+
+    function stopTail(id) {
+        const tail = tails.get(id);
+        if (!tail || !tail.running) return;
+        if (tail.tab.socket && tail.tab.socket.readyState === WebSocket.OPEN) {
+            tail.tab.socket.send(JSON.stringify({ type: 'tail_stop', id }));
+        }
+    }
+
+    function handleTailMessage(msg) {
+        const tail = tails.get(msg.id);
+        if (!tail) return;
+        const status = tail.el.querySelector('.tail-status');
+        if (msg.started) {
+            status.textContent = 'following';
+        }
+        if (msg.lines) {
+            appendTailLines(tail, msg.lines.join('\n') + '\n', msg.lines.length);
+        }
+        if (msg.event) {
+            const text = msg.event === 'skipped'
+                ? `--- skipped ${formatSize(msg.skipped)} written too fast to show ---`
+                : `--- file ${msg.event} ---`;
+            const line = document.createElement('span');
+            line.className = 'tail-event';
+            line.textContent = text + '\n';
+            appendTailLines(tail, line, 1);
+        }
+        if (msg.done) {
+            endTail(tail, msg.error || 'stopped');
+        }
+    }
+
+    // appendTailLines adds text or an element holding count lines to the
+    // output, dropping the oldest batches past TAIL_MAX_LINES. It keeps
+    // following the end unless the user scrolled up.
+    function appendTailLines(tail, content, count) {
+        const output = tail.el.querySelector('pre');
+        const atBottom = output.scrollTop + output.clientHeight >= output.scrollHeight - 4;
+        const node = typeof content === 'string' ? document.createTextNode(content) : content;
+        node.lineCount = count;
+        output.appendChild(node);
+        tail.lineCount = (tail.lineCount || 0) + count;
+        while (output.childNodes.length > 1 && tail.lineCount > TAIL_MAX_LINES) {
+            tail.lineCount -= output.firstChild.lineCount || 0;
+            output.firstChild.remove();
+        }
+        if (atBottom) output.scrollTop = output.scrollHeight;
+    }
+
+    function endTail(tail, reason) {
+        if (!tail.running) return;
+        tail.running = false;
+        tail.el.classList.add('ended');
+        tail.el.querySelector('.tail-status').textContent = reason;
+        tail.el.querySelector('.btn-tail-stop').disabled = true;
+    }
+
+    function endTabTails(tab, reason) {
+        tails.forEach(tail => {
+            if (tail.tab === tab) endTail(tail, reason);
+        });
+    }
+
+    function showTailPanel() {
+        tailPanel.classList.remove('hidden');
+        const activeTab = tabs.find(t => t.id === activeTabId);
+        setTimeout(() => fitTerminal(activeTab), 1);
+    }
+
+    function hideTailPanel() {
+        tailPanel.classList.add('hidden');
+        const activeTab = tabs.find(t => t.id === activeTabId);
+        setTimeout(() => fitTerminal(activeTab), 1);
+    }
+
+    tailPanelClose.addEventListener('click', hideTailPanel);
+    tailBtn.addEventListener('click', () => {
+        if (tailPanel.classList.contains('hidden')) {
+            showTailPanel();
+        } else {
+            hideTailPanel();
+        }
+    });
+
+    function joinRemotePath(dir, name) {
+        if (name.startsWith('/')) return name;
+        return (dir === '/' ? '' : dir) + '/' + name;
+    }
+
+    // --- Editor ---
+
+    // The file as last read or saved; its hash lets the server detect
+    // changes made by someone else while we were editing.
+    let editorFile = null;
+
+    function handleEditorRead(result) {
+        if (!result.ok) {
+            alert(`Cannot open ${result.path}: ${result.error}`);
+            return;
+        }
+        editorFile = result.file;
+        editorTitle.textContent = editorFile.path;
+        editorContent.value = editorFile.content;
+        updateEditorInfo();
+        editorModal.classList.remove('hidden');
+        editorContent.focus();
+    }
+
+    function updateEditorInfo() {
+        const mtime = new Date(editorFile.mtime).toLocaleString();
+        editorInfo.textContent = `${editorFile.size} bytes, mode ${editorFile.mode}, modified ${mtime}`;
+    }
+
+    function saveEditor(force) {
+        if (!editorFile) return;
+        sendFileOperation({
+            type: 'write',
+            path: editorFile.path,
+            payload: editorContent.value,
+            hash: editorFile.hash,
+            force: force,
+        });
+    }
+
+    function handleEditorWrite(result) {
+        if (result.code === 'conflict') {
+            if (confirm(`${result.error}. Overwrite it with your version?`)) {
+                saveEditor(true);
+            }
+            return;
+        }
+        if (!result.ok) {
+            alert(`Saving ${result.path} failed: ${result.error}`);
+            return;
+        }
+        editorFile = { ...editorFile, ...result.file, content: editorContent.value };
+        updateEditorInfo();
+        window.showToast(`Saved ${result.file.path}`);
+        if (!fileBrowserModal.classList.contains('hidden')) {
+            requestFileList(currentRemotePath);
+        }
+    }
+
+    // --- Host-to-host Transfers ---
+
+    async function startTransfer(path) {
+        const activeTab = tabs.find(t => t.id === activeTabId);
+        if (!activeTab) return;
+        const choices = connections.map(c => `${c.id}: ${c.name} (${c.user}@${c.host})`).join('\n');
+        const targetId = prompt(`Send ${path} to which connection?\n${choices}`);
+        if (!targetId) return;
+        const target = connections.find(c => String(c.id) === targetId.split(':')[0].trim());
+        if (!target) {
+            alert('Unknown connection.');
+            return;
+        }
+        const targetPath = prompt(`Destination path on ${target.name}:`, path.substring(0, path.lastIndexOf('/')) || '/');
+        if (!targetPath) return;
+
+        const response = await fetch('/api/transfers', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({
+                source: { connection_id: String(activeTab.connection.id), path },
+                target: { connection_id: String(target.id), path: targetPath },
+            }),
+        });
+        if (!response.ok) {
+            alert(`Transfer failed: ${await response.text()}`);
+            return;
+        }
+        const t = await response.json();
+        handleTransferUpdate(t);
+        window.showToast(t.status === 'queued' ? `Transfer of ${path} queued` : `Transferring ${path}`);
+    }
+
+    // Transfers run on the server; every open tab receives 'transfer'
+    // messages as they change, and the list is reloaded when the page opens.
+    const transferList = new Map();
+
+    async function loadTransfers() {
+        try {
+            const response = await fetch('/api/transfers');
+            if (!response.ok) return;
+            transferList.clear();
+            (await response.json()).forEach(t => transferList.set(t.id, t));
+            renderTransfers();
+        } catch (e) {
+            console.error('Failed to load transfers:', e);
+        }
+    }
+
+    // Upload chunks and file browser jobs wait in the same queue. The server
+    // forgets the short ones once they succeed, and their results arrive in
+    // replies of their own. Copies and archive jobs stay listed, since they
+    // keep running after a reload.
+    const lastingTransferKinds = ['copy', 'download', 'duplicate', 'compress', 'extract'];
+
+    function isTransientTransfer(t) {
+        return !lastingTransferKinds.includes(t.kind);
+    }
+
+    function handleTransferUpdate(t) {
+        const previous = transferList.get(t.id);
+        if (isTransientTransfer(t)) {
+            if (t.status === 'completed') transferList.delete(t.id);
+            else transferList.set(t.id, t);
+            renderTransfers();
+            return;
+        }
+        transferList.set(t.id, t);
+        renderTransfers();
+        // Copies within a connection and archive jobs are reported by their
+        // own replies.
+        if (previous && previous.status !== t.status && (t.kind === 'copy' || t.kind === 'download')) {
+            const what = t.kind === 'download' ? 'Download' : 'Transfer';
+            if (t.status === 'completed') {
+                window.showToast(t.sha256 ? `${what} of ${t.source.path} complete (SHA-256 ${t.sha256})` : `${what} of ${t.source.path} complete`);
+            } else if (t.status === 'failed') {
+                window.showToast(`${what} of ${t.source.path} failed: ${t.error}`);
+            }
+        }
+    }
+
+    function connectionName(id) {
+        const c = connections.find(c => String(c.id) === String(id));
+        return c ? c.name : `#${id}`;
+    }
+
+    function renderTransfers() {
+        const active = [...transferList.values()].filter(t => t.status === 'queued' || t.status === 'running').length;
+        transfersBtn.title = active ? `Transfers (${active} active)` : 'Transfers';
+        if (transfersModal.classList.contains('hidden')) return;
+
+        const list = [...transferList.values()].sort((a, b) => b.queued_at.localeCompare(a.queued_at));
+        if (list.length === 0) {
+            transfersList.innerHTML = '<p>No transfers.</p>';
+            return;
+        }
+        transfersList.innerHTML = list.map(t => {
+            const percent = t.bytes_total ? Math.floor(t.bytes_done * 100 / t.bytes_total) : 0;
+            // Listings and the like have no size to show.
+            let detail = t.bytes_total || t.files_total ? `${formatSize(t.bytes_done)} of ${formatSize(t.bytes_total)}, ${t.files_done}/${t.files_total} files` : '';
+            if (t.status === 'failed') detail = t.error;
+            else if (t.status === 'queued') detail = 'Waiting for a free slot';
+            else if (t.current) detail += ` — ${t.current}`;
+            else if (t.sha256) detail += ` — SHA-256 ${t.sha256}`;
+            const canCancel = t.status === 'queued' || t.status === 'running';
+            // Downloads can only be started again from the browser.
+            const canRetry = t.kind === 'copy' && (t.status === 'failed' || t.status === 'cancelled');
+            const endpoint = e => `${escapeHtml(connectionName(e.connection_id))}:${escapeHtml(e.path)}`;
+            let title;
+            if (t.kind === 'copy') title = `${endpoint(t.source)} → ${endpoint(t.target)}`;
+            else if (t.kind === 'download') title = `${endpoint(t.source)} → browser`;
+            else if (t.kind === 'upload') title = `browser → ${endpoint(t.target)}`;
+            else title = `${escapeHtml(t.kind)} ${endpoint(t.source)}${t.target ? ` → ${endpoint(t.target)}` : ''}`;
+            return `
+                <div class="transfer-item ${t.status}" data-id="${t.id}">
+                    <div class="transfer-header">
+                        <span>${title}</span>
+                        <span>
+                            ${t.status}${t.attempt > 1 ? ` (attempt ${t.attempt})` : ''}
+                            ${canCancel ? '<button class="btn-transfer-cancel">Cancel</button>' : ''}
+                            ${canRetry ? '<button class="btn-transfer-retry">Retry</button>' : ''}
+                        </span>
+                    </div>
+                    ${t.status === 'running' ? `<progress max="100" value="${percent}"></progress>` : ''}
+                    <div class="transfer-detail">${escapeHtml(detail || '')}</div>
+                </div>`;
+        }).join('');
+    }
+
+    function openTransfers() {
+        transfersModal.classList.remove('hidden');
+        loadTransfers();
+    }
+
+    // --- Two-Factor Authentication ---
+
+    async function twoFactorRequest(body) {
+        const response = await fetch('/api/2fa', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify(body)
+        });
+        if (!response.ok) {
+            throw new Error(await response.text());
+        }
+        return response.headers.get('Content-Type') === 'application/json' ? response.json() : null;
+    }
+
+    async function openTwoFactor() {
+        twoFactorModal.classList.remove('hidden');
+        twoFactorBody.innerHTML = '<p>Loading...</p>';
+        try {
+            const response = await fetch('/api/2fa');
+            if (!response.ok) throw new Error(await response.text());
+            renderTwoFactorStatus(await response.json());
+        } catch (error) {
+            twoFactorBody.innerHTML = `<p class="error">${escapeHtml(error.message)}</p>`;
+        }
+    }
+
+    function renderTwoFactorStatus(status) {
+        if (!status.enabled) {
+            twoFactorBody.innerHTML = `
+                <p>Two-factor authentication is off. With it on, logging in also asks for a code from an authenticator app.</p>
+                ${status.required ? '<p>Your administrator requires it: you will be asked to set it up at your next login.</p>' : ''}
+                <button class="btn btn-primary" data-2fa="begin">Set Up</button>`;
+            return;
+        }
+        twoFactorBody.innerHTML = `
+            <p>Two-factor authentication is on. ${status.recovery_codes} recovery code${status.recovery_codes === 1 ? '' : 's'} left.</p>
+            <button class="btn btn-secondary" data-2fa="recovery_codes">New Recovery Codes</button>
+            ${status.required ? '' : '<button class="btn btn-danger" data-2fa="disable">Turn Off</button>'}`;
+    }
+
+    function renderRecoveryCodes(codes) {
+        twoFactorBody.innerHTML = `
+            <p>Write these recovery codes down and keep them safe: each one logs you in once if you lose your authenticator app. They are not shown again.</p>
+            <pre class="recovery-codes">${codes.map(escapeHtml).join('\n')}</pre>
+            <button class="btn btn-primary" data-2fa="done">Done</button>`;
+    }
+
+    twoFactorBody.addEventListener('click', async (e) => {
+        const action = e.target.dataset['2fa'];
+        if (!action) return;
+        try {
+            if (action === 'done') {
+                openTwoFactor();
+            } else if (action === 'begin') {
+                const { secret, uri } = await twoFactorRequest({ action: 'begin' });
+                let qr = '';
+                if (window.qrcode) {
+                    const code = qrcode(0, 'M');
+                    code.addData(uri);
+                    code.make();
+                    qr = code.createImgTag(4, 8);
+                }
+                twoFactorBody.innerHTML = `
+                    <p>Scan this code with an authenticator app, or enter the key by hand, then enter the code the app shows.</p>
+                    <div class="totp-qr">${qr}</div>
+                    <p class="totp-secret">${escapeHtml(secret)}</p>
+                    <input type="text" id="two-factor-code" placeholder="Code" autocomplete="one-time-code">
+                    <button class="btn btn-primary" data-2fa="enable">Enable</button>`;
+            } else if (action === 'enable') {
+                const code = document.getElementById('two-factor-code').value;
+                const { recovery_codes } = await twoFactorRequest({ action: 'enable', code });
+                renderRecoveryCodes(recovery_codes);
+            } else {
+                const code = prompt('Enter a code from your authenticator app or a recovery code.');
+                if (!code) return;
+                const result = await twoFactorRequest({ action, code });
+                if (action === 'recovery_codes') {
+                    renderRecoveryCodes(result.recovery_codes);
+                } else {
+                    showToast('Two-factor authentication turned off');
+                    openTwoFactor();
+                }
+            }
+        } catch (error) {
+            showToast(`Error: ${error.message}`);
+        }
+    });
+
+    transfersList.addEventListener('click', async (e) => {
+        const item = e.target.closest('.transfer-item');
+        if (!item) return;
+        let response;
+        if (e.target.classList.contains('btn-transfer-cancel')) {
+            response = await fetch(`/api/transfers/${item.dataset.id}`, { method: 'DELETE' });
+        } else if (e.target.classList.contains('btn-transfer-retry')) {
+            response = await fetch(`/api/transfers/${item.dataset.id}/retry`, { method: 'POST' });
+        } else {
+            return;
+        }
+        if (!response.ok) {
+            alert(await response.text());
+            return;
+        }
+        handleTransferUpdate(await response.json());
+    });
+
+    // --- Search ---
+
+    // Only results for the latest search are shown.
+    let currentSearchId = null;
+    let searchResultCount = 0;
+
+    function startSearch() {
+        const query = {};
+        const value = id => document.getElementById(id).value.trim();
+        if (value('fb-search-name')) query.name = value('fb-search-name');
+        if (value('fb-search-content')) query.content = value('fb-search-content');
+        if (value('fb-search-min-size')) query.minSize = parseInt(value('fb-search-min-size'), 10);
+        if (value('fb-search-max-size')) query.maxSize = parseInt(value('fb-search-max-size'), 10);
+        if (value('fb-search-after')) query.modifiedAfter = value('fb-search-after');
+        if (value('fb-search-before')) query.modifiedBefore = value('fb-search-before');
+        if (value('fb-search-depth')) query.depth = parseInt(value('fb-search-depth'), 10);
+
+        cancelSearch();
+        currentSearchId = `search-${++fileOpCounter}`;
+        searchResultCount = 0;
+        fbSearchResults.innerHTML = '';
+        fbSearchStatus.textContent = `Searching ${currentRemotePath || 'home directory'}...`;
+        fbSearchCancelBtn.disabled = false;
+        const activeTab = tabs.find(t => t.id === activeTabId);
+        if (activeTab && activeTab.socket && activeTab.socket.readyState === WebSocket.OPEN) {
+            activeTab.socket.send(JSON.stringify({
+                type: 'search',
+                id: currentSearchId,
+                path: currentRemotePath,
+                payload: JSON.stringify(query),
+            }));
+        }
+    }
+
+    function cancelSearch() {
+        if (!currentSearchId) return;
+        const activeTab = tabs.find(t => t.id === activeTabId);
+        if (activeTab && activeTab.socket && activeTab.socket.readyState === WebSocket.OPEN) {
+            activeTab.socket.send(JSON.stringify({ type: 'search_cancel', id: currentSearchId }));
+        }
+    }
+
+    function handleSearchResults(msg) {
+        if (msg.id !== currentSearchId) return;
+        (msg.results || []).forEach(result => {
+            const row = document.createElement('div');
+            row.className = 'search-result';
+            row.dataset.path = result.path;
+            row.dataset.isDir = result.isDir;
+            const size = result.isDir ? '' : formatSize(result.size);
+            row.innerHTML = `
+                <span>${result.isDir ? '📁' : '📄'} ${escapeHtml(result.path)}</span>
+                <span class="file-meta">${size} ${new Date(result.mtime).toLocaleString()}</span>
+            `;
+            fbSearchResults.appendChild(row);
+            searchResultCount++;
+        });
+        if (!msg.done) {
+            fbSearchStatus.textContent = `Searching... ${searchResultCount} found`;
+            return;
+        }
+        currentSearchId = null;
+        fbSearchCancelBtn.disabled = true;
+        let status = `${msg.count || 0} found`;
+        if (msg.truncated) status += ' (result limit reached)';
+        if (msg.timedOut) status += ' (timed out)';
+        if (msg.cancelled) status += ' (cancelled)';
+        if (msg.error) status = `Search failed: ${msg.error}`;
+        fbSearchStatus.textContent = status;
+    }
+
+    fbSearchResults.addEventListener('click', (e) => {
+        const row = e.target.closest('.search-result');
+        if (!row) return;
+        const path = row.dataset.path;
+        // Open directories themselves, and files in their directory.
+        if (row.dataset.isDir === 'true') {
+            requestFileList(path);
+        } else {
+            requestFileList(path.substring(0, path.lastIndexOf('/')) || '/');
+        }
+    });
+
     // --- Admin Panel Modal Logic ---
 
     async function openAdminPanel() {
@@ -832,9 +1933,19 @@ document.addEventListener('DOMContentLoaded', () => {
             // Hide UI elements based on features
             if (!features.fileBrowser) {
                 fileBrowserBtn.style.display = 'none';
+                transfersBtn.style.display = 'none';
+                tailBtn.style.display = 'none';
             }
-            if (!features.fileBrowser) { // Also hide upload button inside modal
+            if (!features.fileBrowser) { // Also hide upload and file operation buttons inside modal
                 fbUploadBtn.style.display = 'none';
+                fbUploadFolderBtn.style.display = 'none';
+                fbMkdirBtn.style.display = 'none';
+                fbSymlinkBtn.style.display = 'none';
+                fbSearchBtn.style.display = 'none';
+                fbWebdavBtn.style.display = 'none';
+            }
+            if (!features.twoFactor) {
+                twoFactorBtn.style.display = 'none';
             }
         } catch (e) {
             console.error("Failed to load server features:", e);
@@ -849,9 +1960,12 @@ document.addEventListener('DOMContentLoaded', () => {
             connections.forEach(conn => {
                 const li = document.createElement('li');
                 li.innerHTML = `
-                    <span>${conn.name} <small>(${conn.user}@${conn.host})</small></span>
+                    <span>${features.healthCheck ? healthDot(conn) : ''}${conn.name} <small>(${conn.user}@${conn.host})</small></span>
                     <div class="action-buttons">
-                        <button class="btn btn-secondary" data-id="${conn.id}">Connect</button>
+                        ${features.filesOnly ? '' : `<button class="btn btn-secondary" data-id="${conn.id}">Connect</button>`}
+                        ${features.fileBrowser ? `<button class="btn btn-files" data-id="${conn.id}" title="Open a file-only session without a shell">Files</button>` : ''}
+                        <button class="btn btn-test" data-id="${conn.id}">Test</button>
+                        ${features.filesOnly ? '' : `<button class="btn btn-startup" data-id="${conn.id}" title="Command run in the shell on connect and reconnect">Startup</button>`}
                         <button class="btn btn-danger" data-id="${conn.id}">Delete</button>
                     </div>
                 `;
@@ -862,6 +1976,67 @@ document.addEventListener('DOMContentLoaded', () => {
         }
     }
 
+    function healthDot(conn) {
+        if (conn.disable_health_check) {
+            return '<span class="status-dot status-off" title="Health checks disabled"></span>';
+        }
+        const health = conn.health;
+        if (!health) {
+            return '<span class="status-dot status-unknown" title="Not checked yet"></span>';
+        }
+        let title = health.status === 'up'
+            ? `Up (${health.latency_ms} ms) - ${health.banner}`
+            : `Down - ${health.error}`;
+        if (health.banner_changed_at) {
+            title += `\nBanner changed at ${new Date(health.banner_changed_at).toLocaleString()} (was: ${health.previous_banner})`;
+        }
+        title += `\nLast checked: ${new Date(health.checked_at).toLocaleString()}`;
+        return `<span class="status-dot status-${health.status}" title="${title}"></span>`;
+    }
+
+    async function testConnection(id) {
+        try {
+            const response = await fetch(`/api/connections/test?id=${id}`, { method: 'POST' });
+            if (!response.ok) {
+                throw new Error(await response.text());
+            }
+            const result = await response.json();
+            if (!result.success) {
+                alert(`Connection failed:\n${result.error}`);
+                return;
+            }
+            const algs = result.algorithms || {};
+            alert([
+                `Connected in ${result.latency_ms} ms to ${result.server_version}`,
+                `Key exchange: ${algs.key_exchange}`,
+                `Host key: ${algs.host_key}`,
+                `Cipher: ${algs.cipher_client_to_server} / ${algs.cipher_server_to_client}`,
+                `MAC: ${algs.mac_client_to_server || '(implicit)'} / ${algs.mac_server_to_client || '(implicit)'}`,
+            ].join('\n'));
+        } catch (e) {
+            alert(`Connection test failed: ${e.message}`);
+        }
+    }
+
+    function splitList(value) {
+        return value.split(',').map(v => v.trim()).filter(v => v);
+    }
+
+    async function editStartupCommand(conn) {
+        const command = prompt(`Command to run in the shell when "${conn.name}" connects or reconnects (empty for none):`, conn.startup_command || '');
+        if (command === null) return;
+        const response = await fetch(`/api/connections?id=${conn.id}`, {
+            method: 'PATCH',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ startup_command: command }),
+        });
+        if (!response.ok) {
+            alert(`Failed to save startup command: ${await response.text()}`);
+            return;
+        }
+        loadConnections();
+    }
+
     async function deleteConnection(id) {
         await fetch(`/api/connections?id=${id}`, { method: 'DELETE' });
         loadConnections();
@@ -874,13 +2049,27 @@ document.addEventListener('DOMContentLoaded', () => {
             user: userInput.value,
             password: passwordInput.value,
             key: keyInput.value,
+            startup_command: startupCommandInput.value,
+            disable_health_check: disableHealthCheckInput.checked,
+            algorithm_preset: algorithmPresetInput.value,
+            key_exchanges: splitList(keyExchangesInput.value),
+            ciphers: splitList(ciphersInput.value),
+            macs: splitList(macsInput.value),
+            host_key_algorithms: splitList(hostKeyAlgorithmsInput.value),
         };
-        await fetch('/api/connections', {
+        const response = await fetch('/api/connections', {
             method: 'POST',
             headers: { 'Content-Type': 'application/json' },
             body: JSON.stringify(connection),
         });
-        [nameInput, hostInput, userInput, passwordInput, keyInput].forEach(i => i.value = '');
+        if (!response.ok) {
+            alert(`Failed to save connection: ${await response.text()}`);
+            return;
+        }
+        [nameInput, hostInput, userInput, passwordInput, keyInput, startupCommandInput,
+         keyExchangesInput, ciphersInput, macsInput, hostKeyAlgorithmsInput].forEach(i => i.value = '');
+        disableHealthCheckInput.checked = false;
+        algorithmPresetInput.value = '';
         loadConnections();
     });
 
@@ -894,6 +2083,15 @@ document.addEventListener('DOMContentLoaded', () => {
         if (button.classList.contains('btn-secondary')) { // Connect
             if (connection) createNewTab(connection);
         }
+        if (button.classList.contains('btn-files')) {
+            if (connection) createNewTab(connection, 'files');
+        }
+        if (button.classList.contains('btn-test')) {
+            testConnection(connId);
+        }
+        if (button.classList.contains('btn-startup')) {
+            if (connection) editStartupCommand(connection);
+        }
         if (button.classList.contains('btn-danger')) { // Delete
             if (confirm(`Are you sure you want to delete "${connection.name}"?`)) {
                 deleteConnection(connId);
@@ -917,8 +2115,11 @@ document.addEventListener('DOMContentLoaded', () => {
     });
 
     fileUploadInput.addEventListener('change', handleFileUpload);
+    folderUploadInput.addEventListener('change', handleFileUpload);
 
     fileBrowserBtn.addEventListener('click', openFileBrowser);
+    transfersBtn.addEventListener('click', openTransfers);
+    twoFactorBtn.addEventListener('click', openTwoFactor);
     
     // Generic modal close handler
     document.querySelectorAll('.modal .close-modal').forEach(btn => {
@@ -946,7 +2147,68 @@ document.addEventListener('DOMContentLoaded', () => {
         fileUploadInput.click(); // Trigger the hidden file input
     });
 
+    fbUploadFolderBtn.addEventListener('click', () => {
+        folderUploadInput.click();
+    });
+
+    fbMkdirBtn.addEventListener('click', () => {
+        const name = prompt('New folder name:');
+        if (name) {
+            sendFileOperation({ type: 'mkdir', path: joinRemotePath(currentRemotePath, name) });
+        }
+    });
+
+    fbSymlinkBtn.addEventListener('click', () => {
+        const target = prompt('Symlink points to:');
+        if (!target) return;
+        const name = prompt('Symlink name:');
+        if (name) {
+            sendFileOperation({ type: 'symlink', path: target, target: joinRemotePath(currentRemotePath, name) });
+        }
+    });
+
+    editorSaveBtn.addEventListener('click', () => saveEditor(false));
+
+    editorContent.addEventListener('keydown', (e) => {
+        if ((e.ctrlKey || e.metaKey) && e.key === 's') {
+            e.preventDefault();
+            saveEditor(false);
+        }
+    });
+
     fbRefreshBtn.addEventListener('click', () => {
+        requestFileList(currentRemotePath, fileListOffset);
+    });
+
+    fbWebdavBtn.addEventListener('click', () => {
+        const activeTab = tabs.find(t => t.id === activeTabId);
+        if (!activeTab) return;
+        const path = currentRemotePath.split('/').filter(Boolean).map(encodeURIComponent).join('/');
+        const url = `${location.origin}/dav/${activeTab.connection.id}/${path ? path + '/' : ''}`;
+        prompt('Mount this folder as a network drive at (sign in with your WebSSH username and password):', url);
+    });
+
+    let fbFilterTimer = null;
+    fbFilterInput.addEventListener('input', () => {
+        clearTimeout(fbFilterTimer);
+        fbFilterTimer = setTimeout(() => requestFileList(currentRemotePath), 300);
+    });
+
+    fbSearchBtn.addEventListener('click', () => {
+        fbSearchPanel.classList.toggle('hidden');
+    });
+
+    fbSearchStartBtn.addEventListener('click', startSearch);
+
+    fbSearchCancelBtn.addEventListener('click', cancelSearch);
+
+    fbSortSelect.addEventListener('change', () => requestFileList(currentRemotePath));
+
+    fbHiddenInput.addEventListener('change', () => requestFileList(currentRemotePath));
+
+    fbOrderBtn.addEventListener('click', () => {
+        fileListOrder = fileListOrder === 'asc' ? 'desc' : 'asc';
+        fbOrderBtn.textContent = fileListOrder === 'asc' ? '↑' : '↓';
         requestFileList(currentRemotePath);
     });
 
@@ -994,8 +2256,22 @@ document.addEventListener('DOMContentLoaded', () => {
     // Load connections and then set the initial view.
     loadFeatures()
         .then(loadConnections)
+        .then(() => {
+		if (features.healthCheck) {
+			// Keep the status dots current while the connection list is visible.
+			setInterval(() => {
+				if (!document.body.classList.contains('terminal-active')) {
+					loadConnections();
+				}
+			}, 30000);
+		}
+	})
         .then(() => {
 		checkAdminStatus();
+		if (features.fileBrowser) {
+			// Transfers keep running across reloads; pick them up again.
+			loadTransfers();
+		}
 	})
         .then(setInitialView);
 });
\ No newline at end of file
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// tailPollInterval is how often a followed file is checked for new
+	// data.
+	tailPollInterval = time.Second
+	// maxTails is how many files one WebSocket may follow at once.
+	maxTails = 8
+	// Lines already in the file when following starts: the default and
+	// maximum count, and how far back they are looked for.
+	defaultTailLines = 10
+	maxTailLines     = 1000
+	tailBacklogBytes = 256 << 10
+	// maxTailRead is the most sent for one poll. When a file grows faster,
+	// the rest is skipped so the browser is not flooded.
+	maxTailRead = 1 << 20
+	// maxTailLineLength splits lines that never end, such as binary data.
+	maxTailLineLength = 64 << 10
+	maxTailFilter     = 1000
+)
+
+// Events reported while following a file.
+const (
+	tailTruncated = "truncated" // the file shrank and is read from the start
+	tailRotated   = "rotated"   // the path now names a new file
+	tailSkipped   = "skipped"   // data arrived faster than it is sent
+)
+
+// fileTail follows a remote file like tail -F and sends appended lines in
+// "tail" messages. SFTP has no change notification, so the file is polled.
+// What is read counts as downloaded by account.
+type fileTail struct {
+	ws      *wsConn
+	id      string
+	path    string
+	filter  *regexp.Regexp
+	sftp    *sftp.Client
+	jail    *pathJail
+	account transferAccount
+	ctx     context.Context
+
+	file    *sftp.File
+	offset  int64
+	partial []byte // the last line, until it ends
+}
+
+// handleFileTail follows msg.Path until ctx is cancelled, by "tail_stop" or
+// the socket closing. msg.Filter is a regular expression lines must match,
+// and msg.Limit how many existing lines are sent first.
+func handleFileTail(ctx context.Context, ws *wsConn, sshClient *ssh.Client, jail *pathJail, account transferAccount, msg wsMessage) error {
+	done := map[string]interface{}{"id": msg.ID, "path": msg.Path, "done": true}
+	if ctx.Err() != nil {
+		done["stopped"] = true
+		sendJSON(ws, "tail", done)
+		return nil
+	}
+	t, err := startTail(ctx, ws, sshClient, jail, account, msg)
+	if err != nil {
+		done["error"] = err.Error()
+		sendJSON(ws, "tail", done)
+		return err
+	}
+	defer t.file.Close()
+
+	sendJSON(ws, "tail", map[string]interface{}{"id": t.id, "path": t.path, "started": true})
+	if err := t.backlog(msg.Limit); err != nil {
+		done["error"] = err.Error()
+		sendJSON(ws, "tail", done)
+		return err
+	}
+
+	ticker := time.NewTicker(tailPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			done["stopped"] = true
+			sendJSON(ws, "tail", done)
+			return nil
+		case <-ticker.C:
+			if err := t.poll(); err != nil {
+				if ctx.Err() != nil {
+					// Stopped while waiting for the bandwidth limit.
+					done["stopped"] = true
+					err = nil
+				} else {
+					done["error"] = err.Error()
+				}
+				sendJSON(ws, "tail", done)
+				return err
+			}
+		}
+	}
+}
+
+// refuseTail tells the browser a file is not followed.
+func refuseTail(ws *wsConn, msg wsMessage, reason string) {
+	sendJSON(ws, "tail", map[string]interface{}{"id": msg.ID, "path": msg.Path, "done": true, "error": reason})
+}
+
+func startTail(ctx context.Context, ws *wsConn, sshClient *ssh.Client, jail *pathJail, account transferAccount, msg wsMessage) (*fileTail, error) {
+	if msg.ID == "" || msg.Path == "" {
+		return nil, errors.New("id and path are required")
+	}
+	t := &fileTail{ws: ws, id: msg.ID, jail: jail, account: account, ctx: ctx}
+	if msg.Filter != "" {
+		if len(msg.Filter) > maxTailFilter {
+			return nil, errors.New("filter is too long")
+		}
+		filter, err := regexp.Compile(msg.Filter)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter: %v", err)
+		}
+		t.filter = filter
+	}
+
+	var err error
+	if t.sftp, err = sshPool.SFTP(sshClient); err != nil {
+		return nil, err
+	}
+	if t.path, err = jail.Resolve(t.sftp, "tail", msg.Path); err != nil {
+		return nil, err
+	}
+	if err := t.open(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// open opens the file at t.path from the start. The jail is checked again
+// since a rotated path may have been replaced by a symlink.
+func (t *fileTail) open() error {
+	if _, err := t.jail.Resolve(t.sftp, "tail", t.path); err != nil {
+		return err
+	}
+	f, err := t.sftp.Open(t.path)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		f.Close()
+		return fmt.Errorf("%s is not a regular file", t.path)
+	}
+	if t.file != nil {
+		t.file.Close()
+	}
+	t.file, t.offset, t.partial = f, 0, nil
+	return nil
+}
+
+// backlog sends up to lines of the lines already in the file and leaves
+// the offset at its end.
+func (t *fileTail) backlog(lines int) error {
+	if lines <= 0 {
+		lines = defaultTailLines
+	}
+	lines = min(lines, maxTailLines)
+
+	info, err := t.file.Stat()
+	if err != nil {
+		return err
+	}
+	start := max(info.Size()-tailBacklogBytes, 0)
+	data := make([]byte, info.Size()-start)
+	n, err := t.readAt(data, start)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	data = data[:n]
+	t.offset = info.Size()
+	if start > 0 {
+		// The first line is probably cut off.
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			data = data[i+1:]
+		}
+	}
+
+	matched := t.lines(data)
+	if len(matched) > lines {
+		matched = matched[len(matched)-lines:]
+	}
+	t.send(matched)
+	return nil
+}
+
+// poll sends whatever was appended since the last poll. The file is
+// followed by name: when the path names a different file than the one
+// open, it was rotated and the new one is read from the start.
+func (t *fileTail) poll() error {
+	pathInfo, pathErr := t.sftp.Stat(t.path)
+	info, err := t.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case info.Size() < t.offset:
+		t.event(tailTruncated)
+		t.offset, t.partial = 0, nil
+	case info.Size() == t.offset:
+		// Everything in the open file has been read. If nothing was
+		// written since, the path still naming this file must show the
+		// same size and time; a difference means it is another file.
+		// A path that is missing is waited for, as after a rotation
+		// that has not created the new file yet.
+		if pathErr == nil && (pathInfo.Size() != info.Size() || !pathInfo.ModTime().Equal(info.ModTime())) {
+			t.flushPartial()
+			if err := t.open(); err != nil {
+				return err
+			}
+			t.event(tailRotated)
+			info, err = t.file.Stat()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return t.read(info.Size())
+}
+
+// read sends the file from the offset up to size.
+func (t *fileTail) read(size int64) error {
+	if size <= t.offset {
+		return nil
+	}
+	skipped := max(size-t.offset-maxTailRead, 0)
+	if skipped > 0 {
+		sendJSON(t.ws, "tail", map[string]interface{}{"id": t.id, "event": tailSkipped, "skipped": skipped})
+		t.offset, t.partial = t.offset+skipped, nil
+	}
+	data := make([]byte, size-t.offset)
+	n, err := t.readAt(data, t.offset)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	t.offset += int64(n)
+	data = data[:n]
+	if skipped > 0 {
+		// Resume at the next whole line.
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			data = data[i+1:]
+		}
+	}
+	t.send(t.lines(data))
+	return nil
+}
+
+// readAt reads data from the file at off like ReadAt, paced by the
+// session's download limit. Following stops once the daily quota is used up.
+func (t *fileTail) readAt(data []byte, off int64) (int, error) {
+	quota := t.account.quota()
+	r := &meteredReader{r: io.NewSectionReader(t.file, off, int64(len(data))), ctx: t.ctx, limiter: t.account.limiter(downloadDirection), quota: quota}
+	n, err := io.ReadFull(r, data)
+	quota.close()
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// lines splits data into the complete lines that pass the filter. An
+// unfinished last line is held until the rest of it arrives.
+func (t *fileTail) lines(data []byte) []string {
+	data = append(t.partial, data...)
+	t.partial = nil
+	var lines []string
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			if len(data) < maxTailLineLength {
+				t.partial = append([]byte(nil), data...)
+				break
+			}
+			i = len(data)
+		}
+		line := string(bytes.TrimSuffix(data[:i], []byte("\r")))
+		data = data[min(i+1, len(data)):]
+		if t.filter == nil || t.filter.MatchString(line) {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// flushPartial sends the unfinished last line of a file that will not be
+// read any further.
+func (t *fileTail) flushPartial() {
+	if len(t.partial) == 0 {
+		return
+	}
+	line := string(t.partial)
+	t.partial = nil
+	if t.filter == nil || t.filter.MatchString(line) {
+		t.send([]string{line})
+	}
+}
+
+func (t *fileTail) send(lines []string) {
+	if len(lines) > 0 {
+		sendJSON(t.ws, "tail", map[string]interface{}{"id": t.id, "lines": lines})
+	}
+}
+
+func (t *fileTail) event(event string) {
+	sendJSON(t.ws, "tail", map[string]interface{}{"id": t.id, "event": event})
+}
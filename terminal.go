@@ -0,0 +1,400 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	reconnectMaxAttempts = 10
+	reconnectBaseDelay   = time.Second
+	reconnectMaxDelay    = 30 * time.Second
+	// maxStartupCommand is the longest startup command a connection may
+	// have.
+	maxStartupCommand = 4096
+)
+
+// Error codes sent to the browser in the "code" field of "error" messages
+// when a terminal session cannot be set up.
+const (
+	errCodeMissingConnectionID = "missing_connection_id"
+	errCodeUserNotFound        = "user_not_found"
+	errCodeConnectionNotFound  = "connection_not_found"
+	errCodeDialFailed          = "dial_failed"
+	errCodeHandshakeFailed     = "handshake_failed"
+	errCodeAuthFailed          = "auth_failed"
+	errCodeSessionFailed       = "session_failed"
+	errCodePtyFailed           = "pty_failed"
+	errCodeShellFailed         = "shell_failed"
+	errCodeSFTPFailed          = "sftp_failed"
+	errCodeFilesDisabled       = "files_disabled"
+)
+
+// Session modes, chosen with the mode query parameter of /ws. A files
+// session opens only the SFTP subsystem, for accounts that have no shell
+// or are forced into internal-sftp.
+const (
+	sessionModeShell = "shell"
+	sessionModeFiles = "files"
+)
+
+// sessionError is a terminal setup failure with a machine-readable code.
+type sessionError struct {
+	Code    string
+	Message string
+}
+
+func (e *sessionError) Error() string {
+	return e.Message
+}
+
+// sessionErrorCode returns the code of err, or errCodeSessionFailed when
+// it is not a *sessionError.
+func sessionErrorCode(err error) string {
+	var sessionErr *sessionError
+	if errors.As(err, &sessionErr) {
+		return sessionErr.Code
+	}
+	return errCodeSessionFailed
+}
+
+// classifyDialError tells network failures apart from SSH handshake and
+// authentication failures.
+func classifyDialError(err error) *sessionError {
+	code := errCodeHandshakeFailed
+	var netErr net.Error
+	switch {
+	case strings.Contains(err.Error(), "unable to authenticate"):
+		code = errCodeAuthFailed
+	case errors.As(err, &netErr):
+		code = errCodeDialFailed
+	}
+	return &sessionError{Code: code, Message: fmt.Sprintf("Failed to dial: %s", err)}
+}
+
+// sshTerminal is the interactive shell behind one terminal tab. It owns the
+// SSH transport and, when that transport is lost, redials it and restores
+// the PTY so the tab keeps working. In a file-only session there is no
+// shell; the transport is kept for the file browser alone.
+type sshTerminal struct {
+	userID    int
+	details   *SSHConnection
+	ws        *wsConn
+	filesOnly bool
+
+	mutex   sync.Mutex
+	client  *ssh.Client
+	release func() // returns client to sshPool
+	session *ssh.Session
+	stdin   io.WriteCloser
+	cols    int
+	rows    int
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newSSHTerminal(userID int, details *SSHConnection, ws *wsConn, filesOnly bool) *sshTerminal {
+	return &sshTerminal{
+		userID:    userID,
+		details:   details,
+		ws:        ws,
+		filesOnly: filesOnly,
+		cols:      80,
+		rows:      40,
+		done:      make(chan struct{}),
+	}
+}
+
+// connect starts the shell, or only SFTP in a file-only session, on the
+// pooled transport for the connection, dialing it if needed. Errors are
+// *sessionError.
+func (t *sshTerminal) connect() error {
+	client, release, err := sshPool.Acquire(t.userID, t.details)
+	if err != nil {
+		return classifyDialError(err)
+	}
+	if err := t.startShell(client, release); err != nil {
+		release()
+		return err
+	}
+	return nil
+}
+
+func (t *sshTerminal) startShell(client *ssh.Client, release func()) error {
+	if t.filesOnly {
+		return t.startFiles(client, release)
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		return &sessionError{Code: errCodeSessionFailed, Message: fmt.Sprintf("Failed to create session: %s", err)}
+	}
+
+	stdin, _ := session.StdinPipe()
+	stdout, _ := session.StdoutPipe()
+	stderr, _ := session.StderrPipe()
+
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          1,
+		ssh.TTY_OP_ISPEED: 14400,
+		ssh.TTY_OP_OSPEED: 14400,
+	}
+
+	t.mutex.Lock()
+	cols, rows := t.cols, t.rows
+	t.mutex.Unlock()
+
+	if err := session.RequestPty("xterm-256color", rows, cols, modes); err != nil {
+		session.Close()
+		return &sessionError{Code: errCodePtyFailed, Message: fmt.Sprintf("request for pseudo terminal failed: %s", err)}
+	}
+
+	if err := session.Shell(); err != nil {
+		session.Close()
+		return &sessionError{Code: errCodeShellFailed, Message: fmt.Sprintf("failed to start shell: %s", err)}
+	}
+	// The command is typed into the shell rather than run in its place, so
+	// the shell stays open when it ends.
+	if command := strings.TrimSpace(t.details.StartupCommand); command != "" {
+		if _, err := io.WriteString(stdin, command+"\n"); err != nil {
+			session.Close()
+			return &sessionError{Code: errCodeShellFailed, Message: fmt.Sprintf("failed to run startup command: %s", err)}
+		}
+	}
+
+	t.mutex.Lock()
+	t.client = client
+	t.release = release
+	t.session = session
+	t.stdin = stdin
+	t.mutex.Unlock()
+
+	go t.pump(stdout)
+	go t.pump(stderr)
+	go t.waitForExit(client, session)
+	return nil
+}
+
+// startFiles opens the SFTP subsystem so that a host which cannot give a
+// shell fails here rather than on the first file operation. Hosts without
+// SFTP are accepted, since uploads and downloads can use scp.
+func (t *sshTerminal) startFiles(client *ssh.Client, release func()) error {
+	if _, err := sshPool.SFTP(client); err != nil && !errors.Is(err, errSFTPUnavailable) {
+		return &sessionError{Code: errCodeSFTPFailed, Message: fmt.Sprintf("failed to start SFTP: %s", err)}
+	}
+	t.mutex.Lock()
+	t.client = client
+	t.release = release
+	t.mutex.Unlock()
+	return nil
+}
+
+// waitForExit sends an "exit" message when the remote shell ends and then
+// closes the tab's connection. Losing the transport is left to monitor,
+// which reconnects instead.
+func (t *sshTerminal) waitForExit(client *ssh.Client, session *ssh.Session) {
+	err := session.Wait()
+	if t.closed() {
+		return
+	}
+
+	event := map[string]interface{}{"code": 0, "reason": "exited"}
+	var exitErr *ssh.ExitError
+	var missingErr *ssh.ExitMissingError
+	switch {
+	case err == nil:
+	case errors.As(err, &exitErr):
+		event["code"] = exitErr.ExitStatus()
+		if signal := exitErr.Signal(); signal != "" {
+			event["reason"] = "signal"
+			event["signal"] = signal
+		}
+		if msg := exitErr.Msg(); msg != "" {
+			event["message"] = msg
+		}
+	default:
+		// The channel also ends without an exit status when the whole
+		// transport goes away.
+		if pingTransport(client, keepaliveTimeout) != nil {
+			return
+		}
+		event["code"] = nil
+		if errors.As(err, &missingErr) {
+			event["reason"] = "exit_status_missing"
+		} else {
+			event["reason"] = "session_error"
+			event["message"] = err.Error()
+		}
+	}
+
+	sendJSON(t.ws, "exit", event)
+	t.Close()
+	t.ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "session ended"))
+	t.ws.Close()
+}
+
+func (t *sshTerminal) pump(r io.Reader) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.Read(buf)
+		if err != nil {
+			return
+		}
+		msg, _ := json.Marshal(wsMessage{Type: "stdout", Payload: string(buf[:n])})
+		if err := t.ws.WriteMessage(websocket.TextMessage, msg); err != nil {
+			return
+		}
+	}
+}
+
+// Client returns the current SSH transport, which changes after a reconnect.
+func (t *sshTerminal) Client() *ssh.Client {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.client
+}
+
+func (t *sshTerminal) Write(p []byte) {
+	t.mutex.Lock()
+	stdin := t.stdin
+	t.mutex.Unlock()
+	if stdin != nil {
+		stdin.Write(p)
+	}
+}
+
+// Resize changes the PTY size and remembers it for later reconnects.
+func (t *sshTerminal) Resize(cols, rows int) {
+	if cols <= 0 || rows <= 0 {
+		return
+	}
+	t.mutex.Lock()
+	t.cols, t.rows = cols, rows
+	session := t.session
+	t.mutex.Unlock()
+	if session != nil {
+		session.WindowChange(rows, cols)
+	}
+}
+
+func (t *sshTerminal) Close() {
+	t.closeOnce.Do(func() {
+		close(t.done)
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+		if t.session != nil {
+			t.session.Close()
+		}
+		if t.release != nil {
+			t.release()
+		}
+	})
+}
+
+func (t *sshTerminal) closed() bool {
+	select {
+	case <-t.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// monitor watches the transport until the terminal is closed, reconnecting
+// whenever it is lost. The pool sends keepalives on the transport.
+func (t *sshTerminal) monitor() {
+	for {
+		t.mutex.Lock()
+		client, release := t.client, t.release
+		t.mutex.Unlock()
+
+		// A shared transport outlives this tab, so stop waiting for it
+		// once the tab is closed.
+		lost, lostErr := sshPool.Lost(client)
+		select {
+		case <-t.done:
+			return
+		case <-lost:
+		}
+		release()
+		err := lostErr()
+
+		if t.closed() {
+			return
+		}
+		reason := "connection lost"
+		if err != nil && !errors.Is(err, io.EOF) {
+			reason = err.Error()
+		}
+		log.Printf("SSH transport to %s lost: %s", t.details.Host, reason)
+
+		if !t.reconnect(reason) {
+			t.ws.Close()
+			return
+		}
+	}
+}
+
+func (t *sshTerminal) reconnect(reason string) bool {
+	code := "transport_lost"
+	for attempt := 1; attempt <= reconnectMaxAttempts; attempt++ {
+		delay := backoffDelay(attempt)
+		sendJSON(t.ws, "reconnecting", map[string]interface{}{
+			"attempt":     attempt,
+			"maxAttempts": reconnectMaxAttempts,
+			"delayMs":     delay.Milliseconds(),
+			"code":        code,
+			"reason":      reason,
+		})
+
+		select {
+		case <-t.done:
+			return false
+		case <-time.After(delay):
+		}
+
+		client, release, err := sshPool.Acquire(t.userID, t.details)
+		if err != nil {
+			err = classifyDialError(err)
+		} else if err = t.startShell(client, release); err != nil {
+			release()
+		}
+		if err != nil {
+			code, reason = sessionErrorCode(err), err.Error()
+			continue
+		}
+
+		// The tab may have been closed while we were dialing.
+		if t.closed() {
+			release()
+			return false
+		}
+		sendJSON(t.ws, "reconnected", map[string]interface{}{"attempt": attempt})
+		return true
+	}
+
+	sendJSON(t.ws, "disconnected", map[string]interface{}{"code": code, "reason": reason})
+	return false
+}
+
+// backoffDelay returns an exponentially growing delay with jitter, so that
+// many tabs losing the same host do not all redial at once.
+func backoffDelay(attempt int) time.Duration {
+	delay := reconnectMaxDelay
+	if attempt < 16 {
+		delay = min(reconnectBaseDelay<<(attempt-1), reconnectMaxDelay)
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
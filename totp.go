@@ -0,0 +1,316 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Two-factor authentication with time-based one-time passwords (RFC 6238),
+// as generated by authenticator apps, and single-use recovery codes for
+// when the app is lost.
+
+const (
+	totpIssuer = "WebSSH"
+	totpPeriod = 30 * time.Second
+	totpDigits = 6
+	// totpSkew is how many periods a code may be early or late, to allow
+	// for clocks that are slightly off.
+	totpSkew = 1
+
+	recoveryCodeCount = 10
+
+	// preAuthTTL is how long the second step of a login may take after the
+	// password was accepted, and maxPreAuthAttempts how many codes may be
+	// tried in it.
+	preAuthTTL         = 5 * time.Minute
+	maxPreAuthAttempts = 5
+	preAuthCookieName  = "webssh_preauth"
+
+	// Logging in again gives a new pre-auth token, so wrong codes are also
+	// counted per user: after maxSecondFactorFailures within
+	// secondFactorLockout, the user's codes are refused until it ends.
+	maxSecondFactorFailures = 10
+	secondFactorLockout     = 15 * time.Minute
+
+	// twoFactorSetting holds the admin's policy: which users must use
+	// two-factor authentication.
+	twoFactorSetting = "require_2fa"
+	twoFactorOff     = "off"
+	twoFactorAdmins  = "admins"
+	twoFactorAll     = "all"
+)
+
+var (
+	base32NoPadding   = base32.StdEncoding.WithPadding(base32.NoPadding)
+	twoFactorThrottle = newLoginThrottle(maxSecondFactorFailures, secondFactorLockout)
+)
+
+// newTOTPSecret returns a random 160-bit secret in the base32 form that
+// authenticator apps expect.
+func newTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base32NoPadding.EncodeToString(b), nil
+}
+
+// totpURI is the otpauth:// URI shown as a QR code when enrolling.
+func totpURI(username, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", totpIssuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(int(totpPeriod.Seconds())))
+	label := url.PathEscape(totpIssuer + ":" + username)
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+func totpCode(key []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+var (
+	// totpLastUsed is the last time step accepted per user, so that a
+	// code seen by someone else cannot be used again.
+	totpLastUsed      = make(map[int]uint64)
+	totpLastUsedMutex sync.Mutex
+)
+
+// checkTOTP tells whether code is the current code for secret, or one
+// from a neighbouring period. Each code is accepted only once per user.
+func checkTOTP(userID int, secret, code string) bool {
+	return checkTOTPAt(userID, secret, code, time.Now())
+}
+
+// checkTOTPAt is checkTOTP with the clock at t.
+func checkTOTPAt(userID int, secret, code string, t time.Time) bool {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != totpDigits {
+		return false
+	}
+	key, err := base32NoPadding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return false
+	}
+	now := uint64(t.Unix()) / uint64(totpPeriod.Seconds())
+
+	totpLastUsedMutex.Lock()
+	defer totpLastUsedMutex.Unlock()
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			if step <= totpLastUsed[userID] {
+				return false
+			}
+			totpLastUsed[userID] = step
+			return true
+		}
+	}
+	return false
+}
+
+// newRecoveryCodes returns fresh recovery codes for the user to write down,
+// and the hashes to store. The codes are random enough that a plain SHA-256
+// hash cannot be reversed.
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(base32NoPadding.EncodeToString(b))
+		codes[i] = code[:4] + "-" + code[4:8] + "-" + code[8:12] + "-" + code[12:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode ignores case, spaces and dashes, which are easy to get
+// wrong when typing a code from paper.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkSecondFactor accepts either a current TOTP code or one of the user's
+// unused recovery codes, which is then used up. It returns
+// errTooManyAttempts while the user is locked out after wrong codes.
+func checkSecondFactor(user *User, code string) (bool, error) {
+	key := fmt.Sprint(user.ID)
+	if err := twoFactorThrottle.attempt(key); err != nil {
+		return false, err
+	}
+	ok, err := matchSecondFactor(user, code)
+	if ok {
+		twoFactorThrottle.succeeded(key)
+	}
+	return ok, err
+}
+
+func matchSecondFactor(user *User, code string) (bool, error) {
+	secret, err := totpSecret(user.ID)
+	if err != nil {
+		return false, err
+	}
+	if checkTOTP(user.ID, secret, code) {
+		return true, nil
+	}
+	if len(strings.TrimSpace(code)) <= totpDigits {
+		return false, nil
+	}
+	return useRecoveryCodeDB(user.ID, hashRecoveryCode(code))
+}
+
+// totpSecret returns the user's TOTP secret, decrypted.
+func totpSecret(userID int) (string, error) {
+	stored, err := getTOTPSecretDB(userID)
+	if err != nil || stored == "" {
+		return "", err
+	}
+	encrypted, err := hex.DecodeString(stored)
+	if err != nil {
+		return "", err
+	}
+	secret, err := decrypt(encrypted)
+	return string(secret), err
+}
+
+// enableTOTP turns two-factor authentication on for the user with secret,
+// and returns their new recovery codes.
+func enableTOTP(userID int, secret string) ([]string, error) {
+	encrypted, err := encrypt([]byte(secret))
+	if err != nil {
+		return nil, err
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	if err := enableTOTPDB(userID, hex.EncodeToString(encrypted), hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func twoFactorPolicy() string {
+	policy, err := getSettingDB(twoFactorSetting)
+	if err != nil || policy == "" {
+		return twoFactorOff
+	}
+	return policy
+}
+
+func validTwoFactorPolicy(policy string) bool {
+	switch policy {
+	case twoFactorOff, twoFactorAdmins, twoFactorAll:
+		return true
+	}
+	return false
+}
+
+// twoFactorRequired tells whether the admin's policy makes user enroll.
+func twoFactorRequired(user *User) bool {
+	switch twoFactorPolicy() {
+	case twoFactorAll:
+		return true
+	case twoFactorAdmins:
+		return user.IsAdmin
+	}
+	return false
+}
+
+// pendingTOTPTTL is how long a logged-in user has to confirm a new secret
+// with a code from their app.
+const pendingTOTPTTL = 10 * time.Minute
+
+type pendingSecret struct {
+	secret  string
+	expires time.Time
+}
+
+var (
+	pendingTOTP      = make(map[int]pendingSecret)
+	pendingTOTPMutex sync.Mutex
+)
+
+// preAuth is a login whose password was accepted but whose second step is
+// still to come. Its token is all the browser holds until then.
+type preAuth struct {
+	username string
+	expires  time.Time
+	attempts int
+	// secret is the TOTP secret being enrolled by a user who must set up
+	// two-factor authentication before logging in.
+	secret string
+}
+
+var (
+	preAuths      = make(map[string]*preAuth)
+	preAuthsMutex sync.Mutex
+)
+
+func createPreAuth(username string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+
+	preAuthsMutex.Lock()
+	defer preAuthsMutex.Unlock()
+	now := time.Now()
+	for t, p := range preAuths {
+		if now.After(p.expires) {
+			delete(preAuths, t)
+		}
+	}
+	preAuths[token] = &preAuth{username: username, expires: now.Add(preAuthTTL)}
+	return token, nil
+}
+
+// getPreAuthLocked returns the pending login for token, or nil if it
+// expired or used up its attempts. The caller must hold preAuthsMutex.
+func getPreAuthLocked(token string) *preAuth {
+	p := preAuths[token]
+	if p == nil {
+		return nil
+	}
+	if time.Now().After(p.expires) || p.attempts >= maxPreAuthAttempts {
+		delete(preAuths, token)
+		return nil
+	}
+	return p
+}
+
+func deletePreAuth(token string) {
+	preAuthsMutex.Lock()
+	delete(preAuths, token)
+	preAuthsMutex.Unlock()
+}
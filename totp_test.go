@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// rfc6238Key is the SHA-1 key of the RFC 6238 test vectors, and
+// rfc6238Secret the same key in base32 as an authenticator app stores it.
+const (
+	rfc6238Key    = "12345678901234567890"
+	rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B, SHA-1, keeping the last six of its eight digits.
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		counter := uint64(tt.unix) / uint64(totpPeriod.Seconds())
+		if got := totpCode([]byte(rfc6238Key), counter); got != tt.want {
+			t.Errorf("totpCode(T=%d) = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestCheckTOTP(t *testing.T) {
+	at := time.Unix(1111111111, 0)
+	tests := []struct {
+		name   string
+		userID int
+		secret string
+		code   string
+		at     time.Time
+		want   bool
+	}{
+		{"current code", 1, rfc6238Secret, "050471", at, true},
+		{"same code again", 1, rfc6238Secret, "050471", at, false},
+		{"earlier code after a later one", 1, rfc6238Secret, "081804", at, false},
+		{"code of the previous period", 2, rfc6238Secret, "081804", at, true},
+		{"code of the next period", 3, rfc6238Secret, "081804", at.Add(-totpPeriod), true},
+		{"two periods late", 4, rfc6238Secret, "081804", at.Add(2 * totpPeriod), false},
+		{"spaces ignored", 5, rfc6238Secret, " 050 471 ", at, true},
+		{"lower-case secret", 6, "gezdgnbvgy3tqojqgezdgnbvgy3tqojq", "050471", at, true},
+		{"wrong code", 7, rfc6238Secret, "123456", at, false},
+		{"too short", 8, rfc6238Secret, "05047", at, false},
+		{"eight digits", 9, rfc6238Secret, "14050471", at, false},
+		{"invalid secret", 10, "not base32!", "050471", at, false},
+	}
+	for _, tt := range tests {
+		if got := checkTOTPAt(tt.userID, tt.secret, tt.code, tt.at); got != tt.want {
+			t.Errorf("%s: checkTOTPAt(%q) = %v, want %v", tt.name, tt.code, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,837 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+const (
+	// finishedTransferExpiry is how long finished transfers stay listed.
+	finishedTransferExpiry = time.Hour
+	// transferProgressInterval limits how often progress is pushed to the
+	// browser while a transfer runs.
+	transferProgressInterval = time.Second
+	// browseConcurrency is how many listings, reads, writes and checksums
+	// each user may have running at once. They have their own slots so
+	// that long downloads do not hold up browsing.
+	browseConcurrency = 4
+)
+
+// transferConcurrency is how many transfers each user may have running at
+// once, counting host-to-host copies, downloads, copies within a
+// connection and archive jobs; the rest wait in the queue. Upload chunks
+// have the same number of slots of their own.
+var transferConcurrency = 2
+
+// Transfer states.
+const (
+	transferQueued    = "queued"
+	transferRunning   = "running"
+	transferCompleted = "completed"
+	transferFailed    = "failed"
+	transferCancelled = "cancelled"
+)
+
+// Kinds of transfer.
+const (
+	transferCopy     = "copy"     // from one saved connection to another
+	transferDownload = "download" // from a saved connection to the browser
+	transferUpload   = "upload"   // one chunk from the browser to a saved connection
+	// File browser requests sent over the WebSocket.
+	transferList      = "list"
+	transferRead      = "read"
+	transferWrite     = "write"
+	transferChecksum  = "checksum"
+	transferSearch    = "search"
+	transferTail      = "tail"
+	transferDuplicate = "duplicate" // a copy within one connection
+	transferCompress  = "compress"
+	transferExtract   = "extract"
+)
+
+// transientTransfer reports whether a kind of transfer is dropped from the
+// list once it succeeds. The browser learns the outcome of short file
+// browser jobs and upload chunks from their own replies.
+func transientTransfer(kind string) bool {
+	switch kind {
+	case transferCopy, transferDownload, transferDuplicate, transferCompress, transferExtract:
+		return false
+	}
+	return true
+}
+
+// transferPool returns the pool of slots a kind of transfer waits for, and
+// how many of the pool's transfers may run at once, or 0 for no limit.
+// Searches and tails stream to the socket that asked for them and are
+// limited there.
+func transferPool(kind string) (string, int) {
+	switch kind {
+	case transferList, transferRead, transferWrite, transferChecksum:
+		return "browse", browseConcurrency
+	case transferUpload:
+		return transferUpload, transferConcurrency
+	case transferSearch, transferTail:
+		return kind, 0
+	}
+	return "bulk", transferConcurrency
+}
+
+type transferEndpoint struct {
+	ConnectionID string `json:"connection_id"`
+	Path         string `json:"path"`
+}
+
+// transfer copies a file or directory from one saved connection to another,
+// streaming through this server. Transfers belong to the user rather than to
+// a browser tab, so they keep running when the page is reloaded.
+//
+// Downloads, upload chunks and file browser jobs wait in the same queue,
+// each for a slot in its pool (see transferPool). Downloads and uploads are
+// served by their own requests once they leave the queue; file browser jobs
+// run work.
+type transfer struct {
+	ID         string            `json:"id"`
+	Kind       string            `json:"kind"`
+	Source     transferEndpoint  `json:"source"`
+	Target     *transferEndpoint `json:"target,omitempty"`
+	Status     string            `json:"status"`
+	Attempt    int               `json:"attempt"`
+	BytesDone  int64             `json:"bytes_done"`
+	BytesTotal int64             `json:"bytes_total"`
+	FilesDone  int               `json:"files_done"`
+	FilesTotal int               `json:"files_total"`
+	Current    string            `json:"current,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	SHA256     string            `json:"sha256,omitempty"`
+	Expected   string            `json:"expected,omitempty"`
+	QueuedAt   time.Time         `json:"queued_at"`
+	StartedAt  *time.Time        `json:"started_at,omitempty"`
+	FinishedAt *time.Time        `json:"finished_at,omitempty"`
+
+	userID       int
+	account      transferAccount
+	cancel       context.CancelFunc // set while running, or from the start when served by a request
+	work         func(ctx context.Context) error
+	started      chan struct{} // closed when the request serving the transfer may start
+	lastNotified time.Time
+	mutex        sync.Mutex
+}
+
+var (
+	transfers      = make(map[string]*transfer)
+	transfersMutex sync.Mutex
+
+	// transferWatchers are each user's open WebSockets, which receive
+	// "transfer" messages as their transfers change.
+	transferWatchers      = make(map[int]map[*wsConn]bool)
+	transferWatchersMutex sync.Mutex
+)
+
+func watchTransfers(userID int, ws *wsConn) {
+	transferWatchersMutex.Lock()
+	defer transferWatchersMutex.Unlock()
+	if transferWatchers[userID] == nil {
+		transferWatchers[userID] = make(map[*wsConn]bool)
+	}
+	transferWatchers[userID][ws] = true
+}
+
+func unwatchTransfers(userID int, ws *wsConn) {
+	transferWatchersMutex.Lock()
+	defer transferWatchersMutex.Unlock()
+	delete(transferWatchers[userID], ws)
+	if len(transferWatchers[userID]) == 0 {
+		delete(transferWatchers, userID)
+	}
+}
+
+// notify sends the transfer's current state to the user's open tabs.
+func (t *transfer) notify() {
+	snapshot := t.snapshot()
+	transferWatchersMutex.Lock()
+	watchers := make([]*wsConn, 0, len(transferWatchers[t.userID]))
+	for ws := range transferWatchers[t.userID] {
+		watchers = append(watchers, ws)
+	}
+	transferWatchersMutex.Unlock()
+	for _, ws := range watchers {
+		sendJSON(ws, "transfer", snapshot)
+	}
+}
+
+// snapshot returns a copy that is safe to encode while the transfer runs.
+func (t *transfer) snapshot() *transfer {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return &transfer{
+		ID:         t.ID,
+		Kind:       t.Kind,
+		Source:     t.Source,
+		Target:     t.Target,
+		Status:     t.Status,
+		Attempt:    t.Attempt,
+		BytesDone:  t.BytesDone,
+		BytesTotal: t.BytesTotal,
+		FilesDone:  t.FilesDone,
+		FilesTotal: t.FilesTotal,
+		Current:    t.Current,
+		Error:      t.Error,
+		SHA256:     t.SHA256,
+		Expected:   t.Expected,
+		QueuedAt:   t.QueuedAt,
+		StartedAt:  t.StartedAt,
+		FinishedAt: t.FinishedAt,
+	}
+}
+
+func (t *transfer) update(f func(t *transfer)) {
+	t.mutex.Lock()
+	f(t)
+	t.mutex.Unlock()
+}
+
+// progress records copied bytes and tells the browser, at most once per
+// transferProgressInterval.
+func (t *transfer) progress(n int64) {
+	t.mutex.Lock()
+	t.BytesDone += n
+	due := time.Since(t.lastNotified) >= transferProgressInterval
+	if due {
+		t.lastNotified = time.Now()
+	}
+	t.mutex.Unlock()
+	if due {
+		t.notify()
+	}
+}
+
+func getTransfer(id string, userID int) *transfer {
+	transfersMutex.Lock()
+	defer transfersMutex.Unlock()
+	t := transfers[id]
+	if t == nil || t.userID != userID {
+		return nil
+	}
+	return t
+}
+
+func expireTransfersLocked() {
+	for id, t := range transfers {
+		t.mutex.Lock()
+		stale := t.FinishedAt != nil && time.Since(*t.FinishedAt) > finishedTransferExpiry
+		t.mutex.Unlock()
+		if stale {
+			delete(transfers, id)
+		}
+	}
+}
+
+// scheduleTransfersLocked starts the user's oldest queued transfers whose
+// pools have free slots.
+func scheduleTransfersLocked(userID int) {
+	var queued []*transfer
+	running := make(map[string]int)
+	for _, t := range transfers {
+		if t.userID != userID {
+			continue
+		}
+		t.mutex.Lock()
+		switch t.Status {
+		case transferRunning:
+			pool, _ := transferPool(t.Kind)
+			running[pool]++
+		case transferQueued:
+			queued = append(queued, t)
+		}
+		t.mutex.Unlock()
+	}
+	sort.Slice(queued, func(i, j int) bool { return queued[i].QueuedAt.Before(queued[j].QueuedAt) })
+
+	for _, t := range queued {
+		pool, limit := transferPool(t.Kind)
+		if limit > 0 && running[pool] >= limit {
+			continue
+		}
+		running[pool]++
+		now := time.Now()
+		if t.started != nil {
+			t.update(func(t *transfer) {
+				t.Status = transferRunning
+				t.StartedAt = &now
+			})
+			close(t.started)
+			continue
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		t.update(func(t *transfer) {
+			t.Status = transferRunning
+			t.StartedAt = &now
+			t.cancel = cancel
+		})
+		go t.run(ctx)
+	}
+}
+
+// handleTransfers manages host-to-host transfers and the user's other queued
+// jobs:
+//
+//	GET    /api/transfers             list the user's transfers and jobs
+//	POST   /api/transfers             queue a transfer
+//	GET    /api/transfers/{id}        progress of one transfer
+//	DELETE /api/transfers/{id}        cancel a queued or running transfer
+//	POST   /api/transfers/{id}/retry  queue a failed or cancelled copy again
+func handleTransfers(w http.ResponseWriter, r *http.Request) {
+	if disableFileBrowser {
+		http.Error(w, "File browser is disabled", http.StatusForbidden)
+		return
+	}
+
+	user, err := getUserByUsernameDB(getSessionUser(r))
+	if err != nil || user == nil {
+		http.Error(w, "User not found", http.StatusInternalServerError)
+		return
+	}
+
+	rest := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/transfers"), "/")
+	if rest == "" {
+		switch r.Method {
+		case http.MethodGet:
+			listTransfers(w, user.ID)
+		case http.MethodPost:
+			queueTransfer(w, r, user.ID)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	id, action, _ := strings.Cut(rest, "/")
+	t := getTransfer(id, user.ID)
+	if t == nil {
+		http.Error(w, "Transfer not found", http.StatusNotFound)
+		return
+	}
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, t.snapshot())
+	case action == "" && r.Method == http.MethodDelete:
+		cancelTransfer(t)
+		writeJSON(w, http.StatusOK, t.snapshot())
+	case action == "retry" && r.Method == http.MethodPost:
+		if !retryTransfer(t) {
+			http.Error(w, "Only failed or cancelled copies can be retried", http.StatusConflict)
+			return
+		}
+		writeJSON(w, http.StatusOK, t.snapshot())
+	case action != "" && action != "retry":
+		http.Error(w, "Not found", http.StatusNotFound)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func listTransfers(w http.ResponseWriter, userID int) {
+	transfersMutex.Lock()
+	expireTransfersLocked()
+	list := []*transfer{}
+	for _, t := range transfers {
+		if t.userID == userID {
+			list = append(list, t.snapshot())
+		}
+	}
+	transfersMutex.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].QueuedAt.After(list[j].QueuedAt) })
+	writeJSON(w, http.StatusOK, list)
+}
+
+func queueTransfer(w http.ResponseWriter, r *http.Request, userID int) {
+	var req struct {
+		Source transferEndpoint `json:"source"`
+		Target transferEndpoint `json:"target"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Source.Path == "" || req.Target.Path == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	// Both ends must be the user's own connections, so nobody can read from
+	// or write to someone else's server. Connecting waits until the transfer
+	// leaves the queue.
+	if conn, err := getConnectionByIDDB(userID, req.Source.ConnectionID); err != nil || conn == nil {
+		http.Error(w, "Source: "+errConnectionNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	if conn, err := getConnectionByIDDB(userID, req.Target.ConnectionID); err != nil || conn == nil {
+		http.Error(w, "Target: "+errConnectionNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	t := &transfer{
+		ID:       newTransferID(),
+		Kind:     transferCopy,
+		Source:   req.Source,
+		Target:   &req.Target,
+		Status:   transferQueued,
+		Attempt:  1,
+		QueuedAt: time.Now(),
+		userID:   userID,
+		account:  newTransferAccount(r, userID),
+	}
+
+	transfersMutex.Lock()
+	expireTransfersLocked()
+	transfers[t.ID] = t
+	scheduleTransfersLocked(userID)
+	transfersMutex.Unlock()
+
+	go t.notify()
+	writeJSON(w, http.StatusCreated, t.snapshot())
+}
+
+func newTransferID() string {
+	idBytes := make([]byte, 16)
+	rand.Read(idBytes)
+	return hex.EncodeToString(idBytes)
+}
+
+// queueJob queues t, whose Kind, Source and Target are set, to run work
+// for the user once its pool has a free slot. work reports progress to t.
+// If ops is not nil, the job is added to it under id until work returns, so
+// that the socket that asked for it can cancel it; when ops is full,
+// nothing is queued and nil is returned.
+//
+// A job cancelled while queued still has work called, with a context that
+// is already done, so that it can reply to the browser.
+func queueJob(userID int, account transferAccount, t *transfer, ops *operationSet, id string, work func(ctx context.Context, t *transfer) error) *transfer {
+	t.ID = newTransferID()
+	t.Status = transferQueued
+	t.Attempt = 1
+	t.QueuedAt = time.Now()
+	t.userID = userID
+	t.account = account
+	t.work = func(ctx context.Context) error {
+		return work(ctx, t)
+	}
+	if ops != nil {
+		t.work = func(ctx context.Context) error {
+			defer ops.remove(id)
+			return work(ctx, t)
+		}
+		if !ops.add(id, func() { cancelTransfer(t) }) {
+			return nil
+		}
+	}
+
+	transfersMutex.Lock()
+	expireTransfersLocked()
+	transfers[t.ID] = t
+	scheduleTransfersLocked(userID)
+	transfersMutex.Unlock()
+
+	go t.notify()
+	return t
+}
+
+// queueRequestTransfer adds t, which request r serves itself, to the user's
+// queue and waits until it may start. It returns r with a context that ends
+// when the browser goes away or t is cancelled, and finish must be called
+// once t is served. If that happens while t is still queued, an error is
+// written instead and false returned.
+func queueRequestTransfer(w http.ResponseWriter, r *http.Request, userID int, t *transfer) (*http.Request, bool) {
+	ctx, cancel := context.WithCancel(r.Context())
+	t.ID = newTransferID()
+	t.Status = transferQueued
+	t.Attempt = 1
+	t.QueuedAt = time.Now()
+	t.userID = userID
+	t.account = newTransferAccount(r, userID)
+	t.cancel = cancel
+	t.started = make(chan struct{})
+
+	transfersMutex.Lock()
+	expireTransfersLocked()
+	transfers[t.ID] = t
+	scheduleTransfersLocked(userID)
+	transfersMutex.Unlock()
+	t.notify()
+
+	select {
+	case <-t.started:
+		t.notify()
+		return r.WithContext(ctx), true
+	case <-ctx.Done():
+	}
+
+	// Cancelled or abandoned while queued, unless it was started meanwhile.
+	transfersMutex.Lock()
+	running := false
+	t.update(func(t *transfer) {
+		switch t.Status {
+		case transferQueued:
+			now := time.Now()
+			t.Status = transferCancelled
+			t.FinishedAt = &now
+		case transferRunning:
+			running = true
+		}
+	})
+	transfersMutex.Unlock()
+	if running {
+		t.finish(ctx, ctx.Err())
+	} else {
+		cancel()
+		t.notify()
+	}
+	// Drop the headers meant for the response that is not sent.
+	for k := range w.Header() {
+		w.Header().Del(k)
+	}
+	http.Error(w, "Cancelled while queued", http.StatusConflict)
+	return nil, false
+}
+
+// transferResponseWriter remembers how a response served for a transfer
+// went, since ServeContent and the upload handlers do not report failed
+// writes or error statuses. With t set, what is written counts as t's
+// progress.
+type transferResponseWriter struct {
+	http.ResponseWriter
+	t      *transfer
+	status int
+	err    error
+}
+
+func (w *transferResponseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *transferResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	if w.t != nil {
+		w.t.progress(int64(n))
+	}
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// result is the error to finish the transfer with.
+func (w *transferResponseWriter) result() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.status >= http.StatusBadRequest {
+		return fmt.Errorf("%d %s", w.status, http.StatusText(w.status))
+	}
+	return nil
+}
+
+// cancelTransfer drops a queued transfer or stops a running one. A running
+// transfer is marked cancelled by run once its copy has stopped.
+func cancelTransfer(t *transfer) {
+	transfersMutex.Lock()
+	defer transfersMutex.Unlock()
+
+	t.update(func(t *transfer) {
+		switch t.Status {
+		case transferQueued:
+			now := time.Now()
+			t.Status = transferCancelled
+			t.FinishedAt = &now
+			if t.cancel != nil {
+				// Wake the request waiting to serve it.
+				t.cancel()
+			}
+			if t.work != nil {
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				go t.work(ctx)
+			}
+		case transferRunning:
+			t.cancel()
+		}
+	})
+	go t.notify()
+}
+
+// retryTransfer queues a failed or cancelled transfer again from the start.
+func retryTransfer(t *transfer) bool {
+	transfersMutex.Lock()
+	defer transfersMutex.Unlock()
+
+	retried := false
+	t.update(func(t *transfer) {
+		// Only the browser can ask for a download again.
+		if t.Kind != transferCopy || (t.Status != transferFailed && t.Status != transferCancelled) {
+			return
+		}
+		retried = true
+		t.Status = transferQueued
+		t.Attempt++
+		t.BytesDone, t.BytesTotal, t.FilesDone, t.FilesTotal = 0, 0, 0, 0
+		t.Error = ""
+		t.QueuedAt = time.Now()
+		t.StartedAt, t.FinishedAt = nil, nil
+	})
+	if !retried {
+		return false
+	}
+	scheduleTransfersLocked(t.userID)
+	go t.notify()
+	return true
+}
+
+func (t *transfer) run(ctx context.Context) {
+	t.notify()
+	if t.work != nil {
+		t.finish(ctx, t.work(ctx))
+		return
+	}
+	t.finish(ctx, t.connectAndCopy(ctx))
+}
+
+// finish records how a running transfer ended and starts the next queued
+// ones in its place.
+func (t *transfer) finish(ctx context.Context, err error) {
+	now := time.Now()
+	t.update(func(t *transfer) {
+		t.FinishedAt = &now
+		t.Current = ""
+		switch {
+		case err == nil:
+			t.Status = transferCompleted
+			if t.Kind == transferDownload {
+				t.FilesDone = t.FilesTotal
+			}
+		case ctx.Err() != nil:
+			t.Status = transferCancelled
+		default:
+			t.Status = transferFailed
+			t.Error = err.Error()
+		}
+		t.cancel()
+		t.cancel = nil
+	})
+	switch t.Kind {
+	case transferCopy:
+		log.Printf("Transfer %s from %s:%s to %s:%s %s", t.ID, t.Source.ConnectionID, t.Source.Path, t.Target.ConnectionID, t.Target.Path, t.Status)
+	case transferDownload:
+		log.Printf("Download %s of %s:%s %s", t.ID, t.Source.ConnectionID, t.Source.Path, t.Status)
+	}
+	t.notify()
+
+	transfersMutex.Lock()
+	if t.Status == transferCompleted && transientTransfer(t.Kind) {
+		delete(transfers, t.ID)
+	}
+	scheduleTransfersLocked(t.userID)
+	transfersMutex.Unlock()
+}
+
+func (t *transfer) connectAndCopy(ctx context.Context) error {
+	src, srcJail, releaseSrc, err := acquireConnectionSFTP(t.userID, t.Source.ConnectionID)
+	if err != nil {
+		return err
+	}
+	defer releaseSrc()
+	dst, dstJail, releaseDst, err := acquireConnectionSFTP(t.userID, t.Target.ConnectionID)
+	if err != nil {
+		return err
+	}
+	defer releaseDst()
+
+	srcPath, err := srcJail.Resolve(src, "transfer", t.Source.Path)
+	if err != nil {
+		return err
+	}
+	dstPath, err := dstJail.Resolve(dst, "transfer", t.Target.Path)
+	if err != nil {
+		return err
+	}
+	return t.copy(ctx, &transferTarget{dst, dstJail}, src, srcPath, dstPath)
+}
+
+// transferTarget is the receiving end of a transfer. Each path written is
+// checked against its jail, since the target may already contain symlinks.
+type transferTarget struct {
+	*sftp.Client
+	jail *pathJail
+}
+
+func (d *transferTarget) check(p string) error {
+	_, err := d.jail.Resolve(d.Client, "transfer", p)
+	return err
+}
+
+func (t *transfer) copy(ctx context.Context, dst *transferTarget, src *sftp.Client, srcPath, dstPath string) error {
+	info, err := src.Lstat(srcPath)
+	if err != nil {
+		return err
+	}
+
+	// Like cp, copying onto an existing directory puts the source inside it.
+	if target, err := dst.Stat(dstPath); err == nil && target.IsDir() {
+		dstPath = path.Join(dstPath, path.Base(srcPath))
+	}
+
+	if err := t.measure(src, srcPath, info); err != nil {
+		return err
+	}
+	// Every byte passes through this server twice, in and out, and counts
+	// against the quota both ways.
+	if err := checkTransferSize(t.userID, 2*t.BytesTotal, 0); err != nil {
+		return err
+	}
+	t.notify()
+	return t.copyTree(ctx, src, dst, srcPath, dstPath, info)
+}
+
+// measure counts the files and bytes to copy so progress can be reported.
+func (t *transfer) measure(src *sftp.Client, root string, info os.FileInfo) error {
+	var files int
+	var bytes int64
+	switch {
+	case info.Mode().IsRegular():
+		files, bytes = 1, info.Size()
+	case info.Mode()&os.ModeSymlink != 0:
+		files = 1
+	case info.IsDir():
+		walker := src.Walk(root)
+		for walker.Step() {
+			if err := walker.Err(); err != nil {
+				return err
+			}
+			if mode := walker.Stat().Mode(); mode.IsRegular() {
+				files++
+				bytes += walker.Stat().Size()
+			} else if mode&os.ModeSymlink != 0 {
+				files++
+			}
+		}
+	}
+	t.update(func(t *transfer) {
+		t.FilesTotal = files
+		t.BytesTotal = bytes
+	})
+	return nil
+}
+
+func (t *transfer) copyTree(ctx context.Context, src *sftp.Client, dst *transferTarget, srcPath, dstPath string, info os.FileInfo) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := dst.check(dstPath); err != nil {
+		return err
+	}
+
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := src.ReadLink(srcPath)
+		if err != nil {
+			return err
+		}
+		if err := dst.Symlink(target, dstPath); err != nil {
+			return err
+		}
+		t.update(func(t *transfer) { t.FilesDone++ })
+		return nil
+	case info.IsDir():
+		if err := dst.Mkdir(dstPath); err != nil && !isRemoteDir(dst.Client, dstPath) {
+			return err
+		}
+		entries, err := src.ReadDir(srcPath)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := t.copyTree(ctx, src, dst, path.Join(srcPath, entry.Name()), path.Join(dstPath, entry.Name()), entry); err != nil {
+				return err
+			}
+		}
+		return dst.Chmod(dstPath, info.Mode().Perm())
+	case !info.Mode().IsRegular():
+		// Devices, sockets and pipes cannot be copied over SFTP.
+		return nil
+	default:
+		return t.copyFile(ctx, src, dst, srcPath, dstPath, info.Mode().Perm())
+	}
+}
+
+func isRemoteDir(c *sftp.Client, p string) bool {
+	info, err := c.Stat(p)
+	return err == nil && info.IsDir()
+}
+
+func (t *transfer) copyFile(ctx context.Context, src *sftp.Client, dst *transferTarget, srcPath, dstPath string, mode os.FileMode) error {
+	t.update(func(t *transfer) { t.Current = srcPath })
+
+	in, err := src.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := dst.Create(dstPath)
+	if err != nil {
+		return err
+	}
+	quota := t.account.quota()
+	_, err = io.Copy(out, &transferReader{ctx: ctx, r: in, t: t, limiter: t.account.limiter(downloadDirection), quota: quota, direction: bothDirections})
+	quota.close()
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// Don't leave a truncated copy behind.
+		dst.Remove(dstPath)
+		return err
+	}
+	t.update(func(t *transfer) { t.FilesDone++ })
+	return dst.Chmod(dstPath, mode)
+}
+
+// transferReader counts progress, charges what is read to quota in
+// direction, paces reads to the bandwidth limit and stops reading once the
+// transfer is cancelled.
+type transferReader struct {
+	ctx       context.Context
+	r         io.Reader
+	t         *transfer
+	limiter   *bandwidthLimiter
+	quota     *quotaMeter
+	direction int
+}
+
+func (r *transferReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := r.r.Read(p)
+	if quotaErr := r.quota.chargeDirection(r.direction, int64(n)); quotaErr != nil {
+		return 0, quotaErr
+	}
+	r.t.progress(int64(n))
+	if waitErr := r.limiter.wait(r.ctx, n); waitErr != nil && err == nil {
+		err = waitErr
+	}
+	return n, err
+}
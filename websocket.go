@@ -1,19 +1,13 @@
 package main
 
 import (
-	"archive/zip"
-	"bytes"
-	"encoding/base64"
-	"encoding/hex"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
-	"net"
 	"net/http"
-	"path/filepath"
 	"sync"
-	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/pkg/sftp"
@@ -26,16 +20,24 @@ var upgrader = websocket.Upgrader{
 	CheckOrigin:     func(r *http.Request) bool { return true },
 }
 
+// sftpClientManager keeps the SFTP session of one pooled transport, opening
+// a new one if the old one has died.
 type sftpClientManager struct {
 	sftpClient *sftp.Client
 	sshClient  *ssh.Client
-	mutex      sync.Mutex
+	// unavailable is set once sshClient's server has refused SFTP, so that
+	// later calls fail at once and callers can fall back to scp.
+	unavailable error
+	mutex       sync.Mutex
 }
 
 func (m *sftpClientManager) Get(sshClient *ssh.Client) (*sftp.Client, error) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
+	if m.unavailable != nil && m.sshClient == sshClient {
+		return nil, m.unavailable
+	}
 	if m.sftpClient != nil && m.sshClient == sshClient {
 		// Check if the client is still alive
 		if _, err := m.sftpClient.Getwd(); err == nil {
@@ -48,8 +50,19 @@ func (m *sftpClientManager) Get(sshClient *ssh.Client) (*sftp.Client, error) {
 		m.sftpClient.Close()
 	}
 
+	m.sftpClient = nil
+	m.unavailable = nil
+
 	sftpClient, err := sftp.NewClient(sshClient)
 	if err != nil {
+		// If a channel could be opened and the transport still answers,
+		// it is the subsystem itself that the server refused.
+		var openErr *ssh.OpenChannelError
+		if !errors.As(err, &openErr) && pingTransport(sshClient, keepaliveTimeout) == nil {
+			m.sshClient = sshClient
+			m.unavailable = fmt.Errorf("%w (%v)", errSFTPUnavailable, err)
+			return nil, m.unavailable
+		}
 		return nil, err
 	}
 
@@ -64,136 +77,111 @@ func (m *sftpClientManager) Close() {
 	if m.sftpClient != nil {
 		m.sftpClient.Close()
 		m.sftpClient = nil
-		m.sshClient = nil
 	}
+	m.sshClient = nil
+	m.unavailable = nil
+}
+
+// wsConn serialises writes to a websocket.Conn, which supports only one
+// concurrent writer, while the terminal output and file operations all write
+// from their own goroutines.
+type wsConn struct {
+	*websocket.Conn
+	writeMutex sync.Mutex
+}
+
+func (c *wsConn) WriteMessage(messageType int, data []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	return c.Conn.WriteMessage(messageType, data)
 }
 
 func handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	rawConn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println("Upgrade error:", err)
 		return
 	}
+	conn := &wsConn{Conn: rawConn}
 	defer conn.Close()
 
 	connID := r.URL.Query().Get("id")
 	if connID == "" {
-		conn.WriteMessage(websocket.TextMessage, []byte("Connection ID is required"))
+		sendErrorCode(conn, errCodeMissingConnectionID, "Connection ID is required")
 		return
 	}
 
 	username := getSessionUser(r)
 	user, err := getUserByUsernameDB(username)
 	if err != nil || user == nil {
-		conn.WriteMessage(websocket.TextMessage, []byte("User not found"))
+		sendErrorCode(conn, errCodeUserNotFound, "User not found")
 		return
 	}
 
 	sshConnDetails, err := getConnectionByIDDB(user.ID, connID)
 	if err != nil {
-		conn.WriteMessage(websocket.TextMessage, []byte("Failed to get connection details"))
-		return
-	}
-
-	encryptedPasswordBytes, _ := hex.DecodeString(sshConnDetails.Password)
-	decryptedPassword, err := decrypt(encryptedPasswordBytes)
-	if err != nil {
-		log.Printf("Failed to decrypt password for conn %s: %v", connID, err)
-	}
-
-	encryptedKeyBytes, _ := hex.DecodeString(sshConnDetails.Key)
-	decryptedKey, _ := decrypt(encryptedKeyBytes)
-
-	var authMethods []ssh.AuthMethod
-	if len(decryptedPassword) > 0 {
-		authMethods = append(authMethods, ssh.Password(string(decryptedPassword)))
-	}
-	if len(decryptedKey) > 0 {
-		signer, err := ssh.ParsePrivateKey(decryptedKey)
-		if err == nil {
-			authMethods = append(authMethods, ssh.PublicKeys(signer))
-		} else {
-			log.Printf("Failed to parse private key: %v", err)
-		}
-	}
-
-	config := &ssh.ClientConfig{
-		User:            sshConnDetails.User,
-		Auth:            authMethods,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout:         10 * time.Second,
-	}
-
-	host := sshConnDetails.Host
-	// Check if port is specified, if not, use default port 22
-	if _, _, err := net.SplitHostPort(host); err != nil {
-		host = net.JoinHostPort(host, "22")
-	}
-
-	client, err := ssh.Dial("tcp", host, config)
-	if err != nil {
-		conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("Failed to dial: %s", err)))
+		sendErrorCode(conn, errCodeConnectionNotFound, "Failed to get connection details")
 		return
 	}
-	defer client.Close()
 
-	session, err := client.NewSession()
-	if err != nil {
-		conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("Failed to create session: %s", err)))
+	// Users an admin limited to files get a file-only session whatever
+	// they asked for.
+	filesOnly := user.FilesOnly || r.URL.Query().Get("mode") == sessionModeFiles
+	if filesOnly && disableFileBrowser {
+		sendErrorCode(conn, errCodeFilesDisabled, "File-only sessions are unavailable while the file browser is disabled")
 		return
 	}
-	defer session.Close()
-
-	sftpMgr := &sftpClientManager{}
-	defer sftpMgr.Close()
-
-	stdin, _ := session.StdinPipe()
-	stdout, _ := session.StdoutPipe()
-	stderr, _ := session.StderrPipe()
 
-	modes := ssh.TerminalModes{
-		ssh.ECHO:          1,
-		ssh.TTY_OP_ISPEED: 14400,
-		ssh.TTY_OP_OSPEED: 14400,
-	}
-
-	if err := session.RequestPty("xterm-256color", 80, 40, modes); err != nil {
-		conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("request for pseudo terminal failed: %s", err)))
-		return
-	}
-
-	if err := session.Shell(); err != nil {
-		conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("failed to start shell: %s", err)))
+	term := newSSHTerminal(user.ID, sshConnDetails, conn, filesOnly)
+	if err := term.connect(); err != nil {
+		sendErrorCode(conn, sessionErrorCode(err), err.Error())
 		return
 	}
-
-	go func() {
-		buf := make([]byte, 4096)
-		for {
-			n, err := stdout.Read(buf)
-			if err != nil {
-				return
-			}
-			msg, _ := json.Marshal(wsMessage{Type: "stdout", Payload: string(buf[:n])})
-			if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
-				return
-			}
+	defer term.Close()
+	go term.monitor()
+
+	mode := sessionModeShell
+	if filesOnly {
+		mode = sessionModeFiles
+	}
+	sendJSON(conn, "session", map[string]interface{}{"mode": mode, "forced": user.FilesOnly})
+
+	// File browser jobs wait in the user's transfer queue and keep going
+	// when the page is reloaded. Searches and tails only stream to this
+	// socket, so they stop with it.
+	searches := newOperationSet(0)
+	defer searches.CancelAll()
+	tails := newOperationSet(maxTails)
+	defer tails.CancelAll()
+	archives := newOperationSet(maxArchiveOps)
+
+	// File browser paths are checked against the roots an admin allowed.
+	jail := newPathJail(user, sshConnDetails)
+	account := newTransferAccount(r, user.ID)
+	// queue runs work as a job of the given kind. ops, if not nil, is where
+	// messages can cancel it by msg.ID. Jobs hold the SSH transport
+	// themselves, since they may outlive this socket and its terminal.
+	queue := func(kind string, msg wsMessage, ops *operationSet, work func(ctx context.Context, t *transfer, client *ssh.Client) error) bool {
+		t := &transfer{Kind: kind, Source: transferEndpoint{connID, msg.Path}}
+		if msg.Target != "" {
+			t.Target = &transferEndpoint{connID, msg.Target}
 		}
-	}()
-
-	go func() {
-		buf := make([]byte, 4096)
-		for {
-			n, err := stderr.Read(buf)
+		return queueJob(user.ID, account, t, ops, msg.ID, func(ctx context.Context, t *transfer) error {
+			client, release, err := sshPool.Acquire(user.ID, sshConnDetails)
 			if err != nil {
-				return
-			}
-			msg, _ := json.Marshal(wsMessage{Type: "stdout", Payload: string(buf[:n])})
-			if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
-				return
+				// The handlers report the missing connection themselves.
+				log.Printf("%s job on connection %s: %v", kind, connID, err)
+			} else {
+				defer release()
 			}
-		}
-	}()
+			return work(ctx, t, client)
+		}) != nil
+	}
+
+	// Transfers outlive the tab that started them; every open tab hears
+	// about their progress.
+	watchTransfers(user.ID, conn)
+	defer unwatchTransfers(user.ID, conn)
 
 	for {
 		_, p, err := conn.ReadMessage()
@@ -208,191 +196,188 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 
 		switch msg.Type {
 		case "data":
-			stdin.Write([]byte(msg.Payload))
+			term.Write([]byte(msg.Payload))
 		case "resize":
-			var size struct {
+			// The browser sends cols and rows as top-level fields; older
+			// clients wrapped them in the payload.
+			size := struct {
 				Cols int `json:"cols"`
 				Rows int `json:"rows"`
+			}{msg.Cols, msg.Rows}
+			if size.Cols == 0 && msg.Payload != "" {
+				json.Unmarshal([]byte(msg.Payload), &size)
 			}
-			if err := json.Unmarshal([]byte(msg.Payload), &size); err == nil {
-				session.WindowChange(size.Rows, size.Cols)
-			}
+			term.Resize(size.Cols, size.Rows)
 		case "list":
 			if disableFileBrowser {
 				continue
 			}
-			go handleFileListing(conn, client, sftpMgr, msg.Path)
-		case "upload":
+			queue(transferList, msg, nil, func(ctx context.Context, t *transfer, client *ssh.Client) error {
+				return handleFileListing(ctx, conn, client, jail, msg)
+			})
+		case "rename", "delete", "mkdir", "chmod", "chown", "symlink":
+			if disableFileBrowser {
+				continue
+			}
+			go handleFileOperation(conn, term.Client(), jail, msg)
+		case "copy":
+			if disableFileBrowser {
+				continue
+			}
+			queue(transferDuplicate, msg, nil, func(ctx context.Context, t *transfer, client *ssh.Client) error {
+				return handleFileCopy(ctx, t, conn, client, jail, msg)
+			})
+		case "read":
+			// Opening a file in the editor sends its content to the browser.
+			if disableFileBrowser || disableDownload {
+				continue
+			}
+			queue(transferRead, msg, nil, func(ctx context.Context, t *transfer, client *ssh.Client) error {
+				return handleFileRead(ctx, conn, client, jail, account, msg)
+			})
+		case "write":
+			if disableFileBrowser {
+				continue
+			}
+			queue(transferWrite, msg, nil, func(ctx context.Context, t *transfer, client *ssh.Client) error {
+				return handleFileWrite(ctx, conn, client, jail, account, msg)
+			})
+		case "search":
+			if disableFileBrowser {
+				continue
+			}
+			queue(transferSearch, msg, searches, func(ctx context.Context, t *transfer, client *ssh.Client) error {
+				return handleFileSearch(ctx, conn, client, jail, msg)
+			})
+		case "checksum":
 			if disableFileBrowser {
 				continue
 			}
-			go handleFileUpload(conn, client, sftpMgr, msg.Filename, msg.Payload, msg.Path)
-		case "download":
+			queue(transferChecksum, msg, nil, func(ctx context.Context, t *transfer, client *ssh.Client) error {
+				return handleFileChecksum(ctx, t, conn, client, jail, msg)
+			})
+		case "search_cancel":
+			searches.Cancel(msg.ID)
+		case "tail":
 			if disableFileBrowser || disableDownload {
 				continue
 			}
-			go handleFileDownload(conn, client, sftpMgr, msg.Path)
+			queued := queue(transferTail, msg, tails, func(ctx context.Context, t *transfer, client *ssh.Client) error {
+				return handleFileTail(ctx, conn, client, jail, account, msg)
+			})
+			if !queued {
+				refuseTail(conn, msg, fmt.Sprintf("at most %d files can be followed at once", maxTails))
+			}
+		case "tail_stop":
+			tails.Cancel(msg.ID)
+		case "compress", "extract":
+			if disableFileBrowser {
+				continue
+			}
+			kind := transferCompress
+			if msg.Type == archiveExtract {
+				kind = transferExtract
+			}
+			queued := queue(kind, msg, archives, func(ctx context.Context, t *transfer, client *ssh.Client) error {
+				return handleArchive(ctx, conn, client, jail, t.account, msg)
+			})
+			if !queued {
+				refuseArchive(conn, msg, fmt.Sprintf("at most %d archives can be processed at once", maxArchiveOps))
+			}
+		case "archive_cancel":
+			archives.Cancel(msg.ID)
 		}
 	}
 }
 
-func handleFileListing(ws *websocket.Conn, sshClient *ssh.Client, sftpMgr *sftpClientManager, path string) {
-	sftpClient, err := sftpMgr.Get(sshClient)
-	if err != nil {
-		sendError(ws, fmt.Sprintf("Failed to get SFTP client: %v", err))
-		return
-	}
-
-	if path == "" {
-		path, _ = sftpClient.Getwd()
-	}
-
-	files, err := sftpClient.ReadDir(path)
-	if err != nil {
-		sendError(ws, fmt.Sprintf("Failed to list files in %s: %v", path, err))
-		return
-	}
-
-	var fileEntries []FileEntry
-	for _, f := range files {
-		fileEntries = append(fileEntries, FileEntry{
-			Name:  f.Name(),
-			Size:  f.Size(),
-			IsDir: f.IsDir(),
+// handleFileListing sends one page of a directory. The whole directory is
+// read, since SFTP cannot page, but only the requested entries are
+// described in full and sent to the browser. Nothing is sent once ctx is
+// cancelled.
+func handleFileListing(ctx context.Context, ws *wsConn, sshClient *ssh.Client, jail *pathJail, msg wsMessage) error {
+	sftpClient, err := sshPool.SFTP(sshClient)
+	if errors.Is(err, errSFTPUnavailable) && jail == nil {
+		// scp cannot list directories, but files can still be uploaded
+		// to and downloaded from a path typed by the user.
+		sendJSON(ws, "list", map[string]interface{}{
+			"path":   msg.Path,
+			"files":  []FileEntry{},
+			"total":  0,
+			"offset": 0,
+			"limit":  listOptionsFromMessage(msg).Limit,
+			"scp":    true,
 		})
+		return nil
 	}
-
-	payload, _ := json.Marshal(map[string]interface{}{"path": path, "files": fileEntries})
-	msg, _ := json.Marshal(wsMessage{Type: "list", Payload: string(payload)})
-	ws.WriteMessage(websocket.TextMessage, msg)
-}
-
-func handleFileUpload(ws *websocket.Conn, sshClient *ssh.Client, sftpMgr *sftpClientManager, filename, base64Content, remotePath string) {
-	sftpClient, err := sftpMgr.Get(sshClient)
 	if err != nil {
 		sendError(ws, fmt.Sprintf("Failed to get SFTP client: %v", err))
-		return
-	}
-
-	content, err := base64.StdEncoding.DecodeString(base64Content)
-	if err != nil {
-		sendError(ws, fmt.Sprintf("Failed to decode file content: %v", err))
-		return
+		return err
 	}
 
-	if remotePath == "" {
-		remotePath, _ = sftpClient.Getwd()
+	path := msg.Path
+	if path == "" {
+		path = jail.Home(sftpClient)
 	}
-	dstPath := filepath.Join(remotePath, filename)
-
-	f, err := sftpClient.Create(dstPath)
-	if err != nil {
-		sendError(ws, fmt.Sprintf("Failed to create remote file: %v", err))
-		return
+	if path, err = jail.Resolve(sftpClient, "list", path); err != nil {
+		sendError(ws, fmt.Sprintf("Failed to list files: %v", err))
+		return err
 	}
-	defer f.Close()
-
-	if _, err := f.Write(content); err != nil {
-		sendError(ws, fmt.Sprintf("Failed to write to remote file: %v", err))
-		return
-	}
-
-	sendStatus(ws, fmt.Sprintf("\r\n\x1b[32mFile '%s' uploaded successfully to %s.\x1b[0m\r\n", filename, remotePath))
-}
 
-func handleFileDownload(ws *websocket.Conn, sshClient *ssh.Client, sftpMgr *sftpClientManager, path string) {
-	sftpClient, err := sftpMgr.Get(sshClient)
+	files, err := sftpClient.ReadDir(path)
 	if err != nil {
-		sendError(ws, fmt.Sprintf("Failed to get SFTP client: %v", err))
-		return
+		sendError(ws, fmt.Sprintf("Failed to list files in %s: %v", path, err))
+		return err
 	}
-
-	stat, err := sftpClient.Stat(path)
-	if err != nil {
-		sendError(ws, fmt.Sprintf("Failed to stat path '%s': %v", path, err))
-		return
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
-	if stat.IsDir() {
-		handleDirectoryDownload(ws, sftpClient, path)
-		return
-	}
+	opts := listOptionsFromMessage(msg)
+	page, total := selectEntries(files, opts)
 
-	srcFile, err := sftpClient.Open(path)
-	if err != nil {
-		sendError(ws, fmt.Sprintf("Failed to open remote file: %v", err))
-		return
+	owners := sshPool.Owners(sshClient)
+	owners.load(sftpClient)
+	fileEntries := make([]FileEntry, 0, len(page))
+	for _, f := range page {
+		fileEntries = append(fileEntries, newFileEntry(sftpClient, path, f, owners))
 	}
-	defer srcFile.Close()
 
-	content, err := io.ReadAll(srcFile)
-	if err != nil {
-		sendError(ws, fmt.Sprintf("Failed to read remote file: %v", err))
-		return
+	if err := ctx.Err(); err != nil {
+		return err
 	}
-
-	payload, _ := json.Marshal(map[string]string{
-		"filename": filepath.Base(path),
-		"payload":  base64.StdEncoding.EncodeToString(content),
+	sendJSON(ws, "list", map[string]interface{}{
+		"path":   path,
+		"files":  fileEntries,
+		"total":  total,
+		"offset": opts.Offset,
+		"limit":  opts.Limit,
 	})
-	msg, _ := json.Marshal(wsMessage{Type: "download", Payload: string(payload)})
-	ws.WriteMessage(websocket.TextMessage, msg)
+	return nil
 }
 
-func handleDirectoryDownload(ws *websocket.Conn, sftpClient *sftp.Client, dirPath string) {
-	buf := new(bytes.Buffer)
-	zipWriter := zip.NewWriter(buf)
-
-	walker := sftpClient.Walk(dirPath)
-	for walker.Step() {
-		if walker.Err() != nil {
-			continue
-		}
-		path := walker.Path()
-		if path == dirPath {
-			continue
-		}
-
-		relPath, err := filepath.Rel(dirPath, path)
-		if err != nil {
-			continue
-		}
-
-		info := walker.Stat()
-		if info.IsDir() {
-			zipWriter.Create(relPath + "/")
-		} else {
-			file, err := sftpClient.Open(path)
-			if err != nil {
-				continue
-			}
-			f, err := zipWriter.Create(relPath)
-			if err != nil {
-				file.Close()
-				continue
-			}
-			io.Copy(f, file)
-			file.Close()
-		}
-	}
-
-	zipWriter.Close()
-
-	payload, _ := json.Marshal(map[string]string{
-		"filename": filepath.Base(dirPath) + ".zip",
-		"payload":  base64.StdEncoding.EncodeToString(buf.Bytes()),
-	})
-	msg, _ := json.Marshal(wsMessage{Type: "download", Payload: string(payload)})
+func sendError(ws *wsConn, message string) {
+	log.Println("SFTP/WS Error:", message)
+	msg, _ := json.Marshal(wsMessage{Type: "error", Payload: message})
 	ws.WriteMessage(websocket.TextMessage, msg)
 }
 
-func sendError(ws *websocket.Conn, message string) {
-	log.Println("SFTP/WS Error:", message)
-	msg, _ := json.Marshal(wsMessage{Type: "error", Payload: message})
+// sendErrorCode sends an "error" message carrying a machine-readable code
+// alongside the human-readable text.
+func sendErrorCode(ws *wsConn, code, message string) {
+	log.Printf("WS Error (%s): %s", code, message)
+	msg, _ := json.Marshal(wsMessage{Type: "error", Code: code, Payload: message})
 	ws.WriteMessage(websocket.TextMessage, msg)
 }
 
-func sendStatus(ws *websocket.Conn, message string) {
+func sendStatus(ws *wsConn, message string) {
 	msg, _ := json.Marshal(wsMessage{Type: "status", Payload: message})
 	ws.WriteMessage(websocket.TextMessage, msg)
 }
+
+// sendJSON sends a message whose payload is v encoded as JSON, the same
+// shape used for "list" and "fileop" replies.
+func sendJSON(ws *wsConn, msgType string, v interface{}) error {
+	payload, _ := json.Marshal(v)
+	msg, _ := json.Marshal(wsMessage{Type: msgType, Payload: string(payload)})
+	return ws.WriteMessage(websocket.TextMessage, msg)
+}